@@ -1,6 +1,7 @@
 package database
 
 import (
+	"fmt"
 	"strings"
 	"time"
 
@@ -14,10 +15,16 @@ type Status string
 const (
 	// StatusPending indicates that the file is awaiting processing.
 	StatusPending Status = "pending"
+	// StatusConfirming indicates that the root of the file was submitted and
+	// waits for the message adding it to land on chain.
+	StatusConfirming Status = "confirming"
 	// StatusCompleted indicates that the file has been successfully processed.
 	StatusCompleted Status = "completed"
 	// StatusFailed indicates that the file processing has failed.
 	StatusFailed Status = "failed"
+	// StatusRemoved indicates that the root of the file was removed from its
+	// proof set.
+	StatusRemoved Status = "removed"
 )
 
 // FileInfo represents the structure of a file record in the database.
@@ -26,12 +33,51 @@ type FileInfo struct {
 	UserAddress string `gorm:"index;not null"`
 	FileName    string `gorm:"uniqueIndex:unique_user_file;not null"`
 	Size        uint64 `gorm:"not null"`
+	// ContentSize is the size of the content before padding, 0 for files
+	// stored before it was recorded.
+	ContentSize int64
 	ProofSetID  int
 	CIDs        string `gorm:"column:cids"`
 	Root        string
-	Status      Status    `gorm:"default:'pending'"`
+	Format      string `gorm:"default:'html'"`
+	Profile     string `gorm:"default:'default'"`
+	// OriginalName is the name of a file uploaded directly by its owner.
+	OriginalName string
+	MimeType     string
+	// Headers holds the JSON encoded response headers of resources that were
+	// fetched verbatim.
+	Headers string
+	// Status only changes through TransitionFile, which validates the
+	// transitions and records them.
+	Status Status `gorm:"default:'pending'"`
+	// Attempts counts the retries of the root of the file.
+	Attempts int
+	// LastError is the error of the last failed attempt.
+	LastError string
+	// StatusAt is when the file entered its status, and the other
+	// timestamps when it last entered each status.
+	StatusAt     *time.Time `gorm:"index"`
+	PendingAt    *time.Time
+	ConfirmingAt *time.Time
+	CompletedAt  *time.Time
+	FailedAt     *time.Time
+	RemovedAt    *time.Time
+	CreatedAt    time.Time `gorm:"autoCreateTime"`
+	UpdatedAt    time.Time `gorm:"autoUpdateTime"`
+}
+
+// Rendition represents an additional rendition of a file, such as a
+// screenshot or PDF, stored as its own pieces under the file's root.
+type Rendition struct {
+	ID     uint   `gorm:"primaryKey"`
+	FileID uint   `gorm:"uniqueIndex:unique_file_rendition;not null"`
+	Format string `gorm:"uniqueIndex:unique_file_rendition;not null"`
+	Size   uint64 `gorm:"not null"`
+	// ContentSize is the size of the rendition before padding, 0 for
+	// renditions stored before it was recorded.
+	ContentSize int64
+	CIDs        string    `gorm:"column:cids"`
 	CreatedAt   time.Time `gorm:"autoCreateTime"`
-	UpdatedAt   time.Time `gorm:"autoUpdateTime"`
 }
 
 // InitDB initializes the database connection and migrates the schema.
@@ -42,66 +88,191 @@ func InitDB(dbPath string) (*gorm.DB, error) {
 	}
 
 	// Auto-migrate the schema
-	if err := db.AutoMigrate(&FileInfo{}); err != nil {
+	if err := db.AutoMigrate(&FileInfo{}, &Rendition{}, &Job{}, &JobPiece{}, &ProofSet{}, &Replica{}, &ProofRecord{}, &FileTransition{}); err != nil {
 		return nil, err
 	}
 
 	return db, nil
 }
 
-// InsertData inserts a new file record into the database.
-func InsertData(db *gorm.DB, userAddress, fileName string, size uint64, proofSetID int, root string, cids []string) error {
-	fileInfo := FileInfo{
-		UserAddress: userAddress,
-		FileName:    fileName,
+// InsertData inserts a new pending file record into the database and returns
+// its ID.
+func InsertData(db *gorm.DB, fileInfo *FileInfo, cids []string) (uint, error) {
+	now := time.Now()
+	fileInfo.CIDs = strings.Join(cids, " ")
+	fileInfo.Status = StatusPending
+	fileInfo.StatusAt = &now
+	fileInfo.PendingAt = &now
+	if err := db.Create(fileInfo).Error; err != nil {
+		return 0, err
+	}
+
+	transition := &FileTransition{FileID: fileInfo.ID, ToStatus: StatusPending}
+	if err := db.Create(transition).Error; err != nil {
+		return 0, err
+	}
+
+	return fileInfo.ID, nil
+}
+
+// InsertRendition inserts a rendition record for the given file.
+func InsertRendition(db *gorm.DB, fileID uint, format string, size uint64, contentSize int64, cids []string) error {
+	rendition := Rendition{
+		FileID:      fileID,
+		Format:      format,
 		Size:        size,
-		ProofSetID:  proofSetID,
-		Root:        root,
+		ContentSize: contentSize,
 		CIDs:        strings.Join(cids, " "),
-		Status:      StatusPending,
 	}
-	return db.Create(&fileInfo).Error
+	return db.Create(&rendition).Error
+}
+
+// CompleteFile marks a file as completed once its root was added to the
+// given proof set.
+func CompleteFile(db *gorm.DB, id uint, proofSetID int) error {
+	return TransitionFile(db, id, StatusCompleted, "", map[string]any{"proof_set_id": proofSetID})
+}
+
+// QueryFileInfoByName retrieves a file record by user address and file name,
+// whatever its status.
+func QueryFileInfoByName(db *gorm.DB, userAddress, fileName string) (*FileInfo, error) {
+	var fileInfo FileInfo
+	if err := db.Where("user_address = ? AND file_name = ?", userAddress, fileName).
+		First(&fileInfo).Error; err != nil {
+		return nil, err
+	}
+
+	return &fileInfo, nil
+}
+
+// QueryFileInfo retrieves a file record by user address, file name and status.
+func QueryFileInfo(db *gorm.DB, userAddress, fileName string, status Status) (*FileInfo, error) {
+	var fileInfo FileInfo
+	if err := db.Where("user_address = ? AND file_name = ? AND status = ?", userAddress, fileName, status).
+		First(&fileInfo).Error; err != nil {
+		return nil, err
+	}
+
+	return &fileInfo, nil
 }
 
-// UpdateFileStatus updates the status of a file record in the database.
-func UpdateFileStatus(db *gorm.DB, id uint, status Status) error {
+// UpdateFileContentSize records the content size of a file stored before it
+// was recorded.
+func UpdateFileContentSize(db *gorm.DB, id uint, size int64) error {
 	return db.Model(&FileInfo{}).
 		Where("id = ?", id).
-		Update("status", status).Error
+		Update("content_size", size).Error
+}
+
+// UpdateRenditionContentSize records the content size of a rendition stored
+// before it was recorded.
+func UpdateRenditionContentSize(db *gorm.DB, id uint, size int64) error {
+	return db.Model(&Rendition{}).
+		Where("id = ?", id).
+		Update("content_size", size).Error
+}
+
+// QueryRendition retrieves a file's rendition in the given format.
+func QueryRendition(db *gorm.DB, fileID uint, format string) (*Rendition, error) {
+	var rendition Rendition
+	if err := db.Where("file_id = ? AND format = ?", fileID, format).First(&rendition).Error; err != nil {
+		return nil, err
+	}
+
+	return &rendition, nil
 }
 
-// QueryCIDs retrieves a file record by user address and file name.
-func QueryCIDs(db *gorm.DB, userAddress, fileName string, status Status) ([]string, error) {
-	cids := ""
-	if err := db.Model(&FileInfo{}).Where("user_address = ? AND file_name = ? AND status = ?", userAddress, fileName, status).
-		Pluck("cids", &cids).Error; err != nil {
+// QueryRenditions retrieves all renditions of a file in insertion order.
+func QueryRenditions(db *gorm.DB, fileID uint) ([]Rendition, error) {
+	var renditions []Rendition
+	if err := db.Where("file_id = ?", fileID).Order("id").Find(&renditions).Error; err != nil {
 		return nil, err
 	}
 
-	return strings.Split(cids, " "), nil
+	return renditions, nil
 }
 
-// QueryCIDsByRoot retrieves CIDs associated with a specific root and status.
-func QueryCIDsByRoot(db *gorm.DB, root string, status Status) ([]string, error) {
-	cids := ""
-	if err := db.Model(&FileInfo{}).Where("root = ? AND status = ?", root, status).
-		Pluck("cids", &cids).Error; err != nil {
+// QueryFileInfoByID retrieves a file record by its ID.
+func QueryFileInfoByID(db *gorm.DB, id uint) (*FileInfo, error) {
+	var fileInfo FileInfo
+	if err := db.First(&fileInfo, id).Error; err != nil {
 		return nil, err
 	}
 
-	return strings.Split(cids, " "), nil
+	return &fileInfo, nil
 }
 
-// QueryPendingInfo retrieves all file records with a status of "pending".
-func QueryPendingInfo(db *gorm.DB) ([]FileInfo, error) {
+// QueryFileInfoByRoot retrieves a file record by its root CID and status.
+func QueryFileInfoByRoot(db *gorm.DB, root string, status Status) (*FileInfo, error) {
+	var fileInfo FileInfo
+	if err := db.Where("root = ? AND status = ?", root, status).First(&fileInfo).Error; err != nil {
+		return nil, err
+	}
+
+	return &fileInfo, nil
+}
+
+// QueryFilesByProofSet retrieves the file records whose roots were added to
+// the given proof set of a provider.
+func QueryFilesByProofSet(db *gorm.DB, provider string, proofSetID int) ([]FileInfo, error) {
 	var fileInfos []FileInfo
-	if err := db.Where("status = ?", StatusPending).Find(&fileInfos).Error; err != nil {
+	if err := db.Where("id IN (?)", db.Model(&Replica{}).
+		Select("file_id").
+		Where("provider = ? AND proof_set_id = ? AND state IN ?", provider, proofSetID, []ReplicaState{ReplicaCompleted, ReplicaRemoved})).
+		Find(&fileInfos).Error; err != nil {
 		return nil, err
 	}
 
 	return fileInfos, nil
 }
 
+// MarkRootsRemoved marks the completed replicas in a proof set of a provider
+// of the files with the given roots as removed. The files left without a
+// live replica are marked as removed too. It returns the number of replicas
+// and files marked.
+func MarkRootsRemoved(db *gorm.DB, provider string, proofSetID int, roots []string) (replicas, files int64, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var removed []Replica
+		if err := tx.Where("provider = ? AND proof_set_id = ? AND state = ? AND file_id IN (?)", provider, proofSetID, ReplicaCompleted,
+			tx.Model(&FileInfo{}).Select("id").Where("root IN ?", roots)).
+			Find(&removed).Error; err != nil {
+			return err
+		}
+
+		for _, replica := range removed {
+			msg := fmt.Sprintf("root removed from proof set %d", proofSetID)
+			if err := UpdateReplicaState(tx, replica.ID, ReplicaRemoved, msg); err != nil {
+				return err
+			}
+			replicas++
+
+			var live int64
+			if err := tx.Model(&Replica{}).
+				Where("file_id = ? AND state IN ?", replica.FileID, liveReplicaStates).
+				Count(&live).Error; err != nil {
+				return err
+			}
+			if live > 0 {
+				continue
+			}
+
+			var fileInfo FileInfo
+			if err := tx.First(&fileInfo, replica.FileID).Error; err != nil {
+				return err
+			}
+			if fileInfo.Status != StatusCompleted {
+				continue
+			}
+			if err := transitionFile(tx, &fileInfo, StatusRemoved, "", nil); err != nil {
+				return err
+			}
+			files++
+		}
+		return nil
+	})
+	return replicas, files, err
+}
+
 // ListFiles retrieves all files for a specific user address.
 func ListFiles(db *gorm.DB, userAddress string) ([]FileInfo, error) {
 	var fileInfos []FileInfo
@@ -0,0 +1,248 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// JobState represents the progress of an upload job.
+type JobState string
+
+const (
+	// JobQueued indicates that the job waits for a worker.
+	JobQueued JobState = "queued"
+	// JobCapturing indicates that the resource is being captured.
+	JobCapturing JobState = "capturing"
+	// JobHashing indicates that the pieces of the capture are being computed.
+	JobHashing JobState = "hashing"
+	// JobUploading indicates that the pieces are being uploaded to the PDP service.
+	JobUploading JobState = "uploading"
+	// JobAddingRoots indicates that the file waits for its root to be added to the proof set.
+	JobAddingRoots JobState = "adding-roots"
+	// JobConfirming indicates that the message adding the root waits to land on chain.
+	JobConfirming JobState = "confirming"
+	// JobProving indicates that the root was added and is being proven.
+	JobProving JobState = "proving"
+	// JobFailed indicates that the job failed.
+	JobFailed JobState = "failed"
+)
+
+// PieceState represents the upload state of a piece of a job.
+type PieceState string
+
+const (
+	// PiecePending indicates that the piece has not been uploaded yet.
+	PiecePending PieceState = "pending"
+	// PieceUploaded indicates that the PDP service has the piece.
+	PieceUploaded PieceState = "uploaded"
+)
+
+// Job represents an upload request processed in the background.
+type Job struct {
+	ID          uint   `gorm:"primaryKey"`
+	UserAddress string `gorm:"index;not null"`
+	FileName    string `gorm:"not null"`
+	ResourceURL string
+	Format      string
+	// Renditions holds the requested rendition formats separated by spaces.
+	Renditions string
+	Profile    string
+	// OriginalName is the client-side name of a file uploaded directly.
+	OriginalName string
+	// Spool is the name prefix of the files holding the captured content and
+	// renditions until the file is recorded. It is empty until the resource
+	// is captured, so an interrupted job resumes from its spool instead of
+	// capturing the resource again.
+	Spool string
+	// CaptureFormat, MimeType and Headers describe the captured content.
+	CaptureFormat string
+	MimeType      string
+	// Headers holds the response headers of the resource encoded as JSON.
+	Headers string
+	State   JobState `gorm:"index;default:'queued'"`
+	Error   string
+	// FileID is the file record created once the pieces are uploaded.
+	FileID    uint      `gorm:"index"`
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime"`
+}
+
+// JobPiece represents a piece of the content of a job.
+type JobPiece struct {
+	ID    uint `gorm:"primaryKey"`
+	JobID uint `gorm:"index;not null"`
+	// Part is "content" for the primary content or the rendition format.
+	Part       string `gorm:"not null"`
+	Index      int
+	Offset     int64
+	Size       int64
+	PaddedSize uint64
+	CID        string     `gorm:"column:cid"`
+	State      PieceState `gorm:"default:'pending'"`
+}
+
+// InsertJob inserts a new queued job and returns its ID.
+func InsertJob(db *gorm.DB, job *Job) (uint, error) {
+	job.State = JobQueued
+	if err := db.Create(job).Error; err != nil {
+		return 0, err
+	}
+
+	return job.ID, nil
+}
+
+// QueryJob retrieves a job by its ID.
+func QueryJob(db *gorm.DB, id uint) (*Job, error) {
+	var job Job
+	if err := db.First(&job, id).Error; err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// ClaimQueuedJob moves the oldest queued job to the capturing state and
+// returns it, or returns nil when no job is queued.
+func ClaimQueuedJob(db *gorm.DB) (*Job, error) {
+	var jobs []Job
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Find does not log a missing record as an error, unlike First.
+		if err := tx.Where("state = ?", JobQueued).Order("id").Limit(1).Find(&jobs).Error; err != nil {
+			return err
+		}
+		if len(jobs) == 0 {
+			return nil
+		}
+
+		jobs[0].State = JobCapturing
+		return tx.Model(&jobs[0]).Update("state", JobCapturing).Error
+	})
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+
+	return &jobs[0], nil
+}
+
+// UpdateJobState updates the state and error of a job.
+func UpdateJobState(db *gorm.DB, id uint, state JobState, errMsg string) error {
+	return db.Model(&Job{}).
+		Where("id = ?", id).
+		Updates(map[string]any{"state": state, "error": errMsg}).Error
+}
+
+// UpdateJobStateByFile updates the state and error of the job that created
+// the given file. Files without a job are ignored.
+func UpdateJobStateByFile(db *gorm.DB, fileID uint, state JobState, errMsg string) error {
+	return db.Model(&Job{}).
+		Where("file_id = ?", fileID).
+		Updates(map[string]any{"state": state, "error": errMsg}).Error
+}
+
+// CompleteJobUpload records the file created by a job, forgets its spool and
+// moves the job to the adding-roots state.
+func CompleteJobUpload(db *gorm.DB, id, fileID uint) error {
+	return db.Model(&Job{}).
+		Where("id = ?", id).
+		Updates(map[string]any{"state": JobAddingRoots, "file_id": fileID, "spool": ""}).Error
+}
+
+// RequeueJob moves a failed job that has not recorded its file yet back to
+// the queue. A job whose spool was removed can only be retried if its
+// resource can be captured again.
+func RequeueJob(db *gorm.DB, id uint) error {
+	res := db.Model(&Job{}).
+		Where("id = ? AND state = ? AND file_id = 0 AND (spool != '' OR resource_url != '')", id, JobFailed).
+		Updates(map[string]any{"state": JobQueued, "error": ""})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errors.New("only jobs that failed before their file was recorded and whose content is still available can be retried")
+	}
+	return nil
+}
+
+// QueryStaleFailedJobs retrieves the failed jobs that still have a spool and
+// have not been updated since the given time.
+func QueryStaleFailedJobs(db *gorm.DB, before time.Time) ([]Job, error) {
+	var jobs []Job
+	if err := db.Where("state = ? AND spool != '' AND updated_at < ?", JobFailed, before).Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// ForgetJobSpool clears the spool of a job if it is still failed, and
+// reports whether it was cleared.
+func ForgetJobSpool(db *gorm.DB, id uint) (bool, error) {
+	res := db.Model(&Job{}).
+		Where("id = ? AND state = ?", id, JobFailed).
+		Update("spool", "")
+	return res.RowsAffected > 0, res.Error
+}
+
+// ResumeInterruptedJobs moves the jobs that were being processed when the
+// service stopped back to the queue.
+func ResumeInterruptedJobs(db *gorm.DB) (int64, error) {
+	res := db.Model(&Job{}).
+		Where("state IN ?", []JobState{JobCapturing, JobHashing, JobUploading}).
+		Updates(map[string]any{"state": JobQueued, "error": ""})
+	return res.RowsAffected, res.Error
+}
+
+// RecordJobCapture records the spooled capture of a job. The pieces of a
+// previous capture are removed, and the CIDs of those that were uploaded are
+// returned so that unchanged pieces are not uploaded again.
+func RecordJobCapture(db *gorm.DB, job *Job) ([]string, error) {
+	var uploaded []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&JobPiece{}).
+			Where("job_id = ? AND state = ?", job.ID, PieceUploaded).
+			Pluck("cid", &uploaded).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("job_id = ?", job.ID).Delete(&JobPiece{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&Job{}).
+			Where("id = ?", job.ID).
+			Updates(map[string]any{
+				"spool":          job.Spool,
+				"capture_format": job.CaptureFormat,
+				"mime_type":      job.MimeType,
+				"headers":        job.Headers,
+			}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return uploaded, nil
+}
+
+// InsertJobPiece records a piece of a job.
+func InsertJobPiece(db *gorm.DB, piece *JobPiece) error {
+	return db.Create(piece).Error
+}
+
+// UpdateJobPieceState updates the upload state of a piece.
+func UpdateJobPieceState(db *gorm.DB, id uint, state PieceState) error {
+	return db.Model(&JobPiece{}).
+		Where("id = ?", id).
+		Update("state", state).Error
+}
+
+// QueryJobPieces retrieves the pieces of a job in the order they were recorded.
+func QueryJobPieces(db *gorm.DB, jobID uint) ([]JobPiece, error) {
+	var pieces []JobPiece
+	if err := db.Where("job_id = ?", jobID).Order("id").Find(&pieces).Error; err != nil {
+		return nil, err
+	}
+
+	return pieces, nil
+}
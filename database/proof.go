@@ -0,0 +1,84 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ProofStatus represents the proving state of a root with a provider.
+type ProofStatus string
+
+const (
+	// ProofPending indicates that no challenge of the root was due yet.
+	ProofPending ProofStatus = "pending"
+	// ProofProving indicates that the last due challenge was proven.
+	ProofProving ProofStatus = "proving"
+	// ProofFaulty indicates that a challenge was missed since the last
+	// proof.
+	ProofFaulty ProofStatus = "faulty"
+	// ProofMissing indicates that the root is not in its proof set.
+	ProofMissing ProofStatus = "missing"
+	// ProofUnknown indicates that the provider does not report the proving
+	// state.
+	ProofUnknown ProofStatus = "unknown"
+)
+
+// ProofRecord is an observed change of the proving state of the root of a
+// replica.
+type ProofRecord struct {
+	ID                 uint   `gorm:"primaryKey"`
+	ReplicaID          uint   `gorm:"index"`
+	FileID             uint   `gorm:"index"`
+	Provider           string `gorm:"not null"`
+	ProofSetID         int
+	RootID             uint64
+	Status             ProofStatus
+	CurrentEpoch       int64
+	NextChallengeEpoch int64
+	LastProvenEpoch    int64
+	Faults             int
+	CreatedAt          time.Time `gorm:"autoCreateTime"`
+}
+
+// RecordRootProof updates the proving state of a replica, and records it in
+// the history of the root when it changed.
+func RecordRootProof(db *gorm.DB, replica *Replica, record *ProofRecord) error {
+	changed := replica.ProofStatus != record.Status ||
+		replica.NextChallengeEpoch != record.NextChallengeEpoch ||
+		replica.LastProvenEpoch != record.LastProvenEpoch ||
+		replica.Faults != record.Faults
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Replica{}).
+			Where("id = ?", replica.ID).
+			Updates(map[string]any{
+				"proof_status":         record.Status,
+				"next_challenge_epoch": record.NextChallengeEpoch,
+				"last_proven_epoch":    record.LastProvenEpoch,
+				"faults":               record.Faults,
+				"proof_checked_at":     time.Now(),
+			}).Error; err != nil {
+			return err
+		}
+
+		if !changed {
+			return nil
+		}
+		record.ReplicaID = replica.ID
+		record.FileID = replica.FileID
+		record.Provider = replica.Provider
+		return tx.Create(record).Error
+	})
+}
+
+// QueryProofRecords retrieves the proving history of the roots of a file,
+// the oldest first.
+func QueryProofRecords(db *gorm.DB, fileID uint) ([]ProofRecord, error) {
+	var records []ProofRecord
+	if err := db.Where("file_id = ?", fileID).Order("id").Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
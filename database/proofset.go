@@ -0,0 +1,257 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ProofSetState represents the lifecycle of a proof set managed by the
+// service.
+type ProofSetState string
+
+const (
+	// ProofSetCreating indicates that the creation message was sent and has
+	// not landed yet.
+	ProofSetCreating ProofSetState = "creating"
+	// ProofSetActive indicates that new roots are added to the proof set.
+	ProofSetActive ProofSetState = "active"
+	// ProofSetFull indicates that the proof set reached its thresholds and
+	// no longer receives new roots.
+	ProofSetFull ProofSetState = "full"
+	// ProofSetFailed indicates that the creation of the proof set failed.
+	ProofSetFailed ProofSetState = "failed"
+)
+
+// ProofSet represents a proof set used by the service.
+type ProofSet struct {
+	ID uint `gorm:"primaryKey"`
+	// Provider is the name of the PDP provider holding the proof set.
+	Provider string `gorm:"index"`
+	// ProofSetID is the on-chain ID, 0 until the creation lands.
+	ProofSetID   int `gorm:"index"`
+	TxHash       string
+	RecordKeeper string
+	State        ProofSetState `gorm:"index"`
+	Error        string
+	// Roots and Bytes count the roots added by the service and their padded
+	// size.
+	Roots int
+	Bytes uint64
+	// The fields below track the proving of the proof set, as reported by
+	// its provider. ChallengeEpoch is the challenge waiting for its proof,
+	// and MissedEpoch the last challenge whose proof was missed.
+	NextChallengeEpoch int64
+	LastProvenEpoch    int64
+	ChallengeEpoch     int64
+	MissedEpoch        int64
+	Faults             int
+	CreatedAt          time.Time `gorm:"autoCreateTime"`
+	UpdatedAt          time.Time `gorm:"autoUpdateTime"`
+}
+
+// InsertProofSet records a proof set and returns its ID.
+func InsertProofSet(db *gorm.DB, ps *ProofSet) (uint, error) {
+	if err := db.Create(ps).Error; err != nil {
+		return 0, err
+	}
+
+	return ps.ID, nil
+}
+
+// QueryProofSetByState retrieves the latest proof set of a provider in the
+// given state, or nil if there is none.
+func QueryProofSetByState(db *gorm.DB, provider string, state ProofSetState) (*ProofSet, error) {
+	var sets []ProofSet
+	if err := db.Where("provider = ? AND state = ?", provider, state).Order("id DESC").Limit(1).Find(&sets).Error; err != nil {
+		return nil, err
+	}
+	if len(sets) == 0 {
+		return nil, nil
+	}
+
+	return &sets[0], nil
+}
+
+// ListProofSets retrieves all proof sets, the latest first.
+func ListProofSets(db *gorm.DB) ([]ProofSet, error) {
+	var sets []ProofSet
+	if err := db.Order("id DESC").Find(&sets).Error; err != nil {
+		return nil, err
+	}
+
+	return sets, nil
+}
+
+// ActivateProofSet records the on-chain ID of a created proof set and makes
+// it the active one of its provider. Any other active proof set of the
+// provider is marked as full.
+func ActivateProofSet(db *gorm.DB, id uint, proofSetID int) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var ps ProofSet
+		if err := tx.First(&ps, id).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&ProofSet{}).
+			Where("provider = ? AND state = ? AND id <> ?", ps.Provider, ProofSetActive, id).
+			Update("state", ProofSetFull).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&ProofSet{}).
+			Where("id = ?", id).
+			Updates(map[string]any{"state": ProofSetActive, "proof_set_id": proofSetID, "error": ""}).Error
+	})
+}
+
+// AdoptProofSet makes an existing on-chain proof set the active one of a
+// provider. A proof set already known to the service keeps its state; an
+// unknown one is recorded with the usage of the completed replicas in it.
+func AdoptProofSet(db *gorm.DB, provider string, proofSetID int) error {
+	var count int64
+	if err := db.Model(&ProofSet{}).Where("provider = ? AND proof_set_id = ?", provider, proofSetID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	ps, err := insertExistingProofSet(db, provider, proofSetID, ProofSetCreating)
+	if err != nil {
+		return err
+	}
+	return ActivateProofSet(db, ps.ID, proofSetID)
+}
+
+// AdoptLegacyProofSets records the proof sets holding replicas of a provider
+// that were stored before proof sets were tracked. The most recently used
+// one becomes the active proof set of the provider unless it already has
+// one, the others are recorded as full. It returns the number of proof sets
+// adopted.
+func AdoptLegacyProofSets(db *gorm.DB, provider string) (int, error) {
+	var proofSetIDs []int
+	if err := db.Model(&Replica{}).
+		Where("provider = ? AND proof_set_id > 0 AND proof_set_id NOT IN (?)", provider,
+			db.Model(&ProofSet{}).Select("proof_set_id").Where("provider = ?", provider)).
+		Group("proof_set_id").
+		Order("MAX(file_id)").
+		Pluck("proof_set_id", &proofSetIDs).Error; err != nil {
+		return 0, err
+	}
+	if len(proofSetIDs) == 0 {
+		return 0, nil
+	}
+
+	var current int64
+	if err := db.Model(&ProofSet{}).
+		Where("provider = ? AND state IN ?", provider, []ProofSetState{ProofSetActive, ProofSetCreating}).
+		Count(&current).Error; err != nil {
+		return 0, err
+	}
+
+	for i, proofSetID := range proofSetIDs {
+		if i == len(proofSetIDs)-1 && current == 0 {
+			if err := AdoptProofSet(db, provider, proofSetID); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if _, err := insertExistingProofSet(db, provider, proofSetID, ProofSetFull); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(proofSetIDs), nil
+}
+
+// insertExistingProofSet records an on-chain proof set of a provider in the
+// given state, with the usage of the completed replicas in it.
+func insertExistingProofSet(db *gorm.DB, provider string, proofSetID int, state ProofSetState) (*ProofSet, error) {
+	var usage struct {
+		Roots int
+		Bytes uint64
+	}
+	if err := db.Model(&FileInfo{}).
+		Select("COUNT(*) AS roots, COALESCE(SUM(size), 0) AS bytes").
+		Where("id IN (?)", db.Model(&Replica{}).
+			Select("file_id").
+			Where("provider = ? AND proof_set_id = ? AND state = ?", provider, proofSetID, ReplicaCompleted)).
+		Scan(&usage).Error; err != nil {
+		return nil, err
+	}
+
+	ps := &ProofSet{
+		Provider:   provider,
+		ProofSetID: proofSetID,
+		State:      state,
+		Roots:      usage.Roots,
+		Bytes:      usage.Bytes,
+	}
+	if _, err := InsertProofSet(db, ps); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// AssignProofSetProvider records the given provider for the proof sets
+// created before providers were tracked.
+func AssignProofSetProvider(db *gorm.DB, provider string) error {
+	return db.Model(&ProofSet{}).
+		Where("provider = ''").
+		Update("provider", provider).Error
+}
+
+// QueryProvingProofSets retrieves the proof sets of a provider that hold
+// roots of the service.
+func QueryProvingProofSets(db *gorm.DB, provider string) ([]ProofSet, error) {
+	var sets []ProofSet
+	if err := db.Where("provider = ? AND state IN ?", provider, []ProofSetState{ProofSetActive, ProofSetFull}).
+		Find(&sets).Error; err != nil {
+		return nil, err
+	}
+
+	return sets, nil
+}
+
+// UpdateProofSetState updates the state and error of a proof set.
+func UpdateProofSetState(db *gorm.DB, id uint, state ProofSetState, errMsg string) error {
+	return db.Model(&ProofSet{}).
+		Where("id = ?", id).
+		Updates(map[string]any{"state": state, "error": errMsg}).Error
+}
+
+// ReleaseProofSetUsage removes roots of the given padded size from the usage
+// of a proof set of a provider.
+func ReleaseProofSetUsage(db *gorm.DB, provider string, proofSetID int, roots int, bytes uint64) error {
+	return db.Model(&ProofSet{}).
+		Where("provider = ? AND proof_set_id = ?", provider, proofSetID).
+		Updates(map[string]any{
+			"roots": gorm.Expr("MAX(roots - ?, 0)", roots),
+			"bytes": gorm.Expr("MAX(bytes - ?, 0)", bytes),
+		}).Error
+}
+
+// UpdateProofSetProving records the proving state of a proof set.
+func UpdateProofSetProving(db *gorm.DB, ps *ProofSet) error {
+	return db.Model(&ProofSet{}).
+		Where("id = ?", ps.ID).
+		Updates(map[string]any{
+			"next_challenge_epoch": ps.NextChallengeEpoch,
+			"last_proven_epoch":    ps.LastProvenEpoch,
+			"challenge_epoch":      ps.ChallengeEpoch,
+			"missed_epoch":         ps.MissedEpoch,
+			"faults":               ps.Faults,
+		}).Error
+}
+
+// AddProofSetUsage adds roots of the given padded size to the usage of a
+// proof set of a provider.
+func AddProofSetUsage(db *gorm.DB, provider string, proofSetID int, roots int, bytes uint64) error {
+	return db.Model(&ProofSet{}).
+		Where("provider = ? AND proof_set_id = ?", provider, proofSetID).
+		Updates(map[string]any{
+			"roots": gorm.Expr("roots + ?", roots),
+			"bytes": gorm.Expr("bytes + ?", bytes),
+		}).Error
+}
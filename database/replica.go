@@ -0,0 +1,194 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ReplicaState represents the progress of a copy of a file with a provider.
+type ReplicaState string
+
+const (
+	// ReplicaUploading indicates that the pieces of the file are being
+	// copied to the provider.
+	ReplicaUploading ReplicaState = "uploading"
+	// ReplicaAddingRoots indicates that the provider holds the pieces and the
+	// root waits to be added to a proof set.
+	ReplicaAddingRoots ReplicaState = "adding-roots"
+	// ReplicaConfirming indicates that the message adding the root was sent
+	// and waits to land on chain.
+	ReplicaConfirming ReplicaState = "confirming"
+	// ReplicaCompleted indicates that the root was added to a proof set of
+	// the provider.
+	ReplicaCompleted ReplicaState = "completed"
+	// ReplicaFailed indicates that the root could not be added.
+	ReplicaFailed ReplicaState = "failed"
+	// ReplicaLost indicates that the provider dropped the root.
+	ReplicaLost ReplicaState = "lost"
+	// ReplicaRemoved indicates that the root was removed from its proof set
+	// on purpose. The file is not replicated to the provider again.
+	ReplicaRemoved ReplicaState = "removed"
+)
+
+// liveReplicaStates are the states of replicas that hold or will hold the
+// file.
+var liveReplicaStates = []ReplicaState{ReplicaUploading, ReplicaAddingRoots, ReplicaConfirming, ReplicaCompleted}
+
+// Replica represents a copy of a file with a PDP provider.
+type Replica struct {
+	ID         uint         `gorm:"primaryKey"`
+	FileID     uint         `gorm:"uniqueIndex:unique_file_provider;not null"`
+	Provider   string       `gorm:"uniqueIndex:unique_file_provider;not null"`
+	ProofSetID int          `gorm:"index"`
+	State      ReplicaState `gorm:"index"`
+	Error      string
+	// TxHash is the hash of the message that added the root, shared by the
+	// replicas whose roots were added in the same batch.
+	TxHash string `gorm:"index"`
+	// RootID and Epoch are the ID of the root in the proof set and the
+	// epoch the message adding it landed at, once it is confirmed.
+	RootID uint64
+	Epoch  int64
+	// The fields below hold the last observed proving state of the root of
+	// a completed replica.
+	ProofStatus        ProofStatus
+	NextChallengeEpoch int64
+	LastProvenEpoch    int64
+	Faults             int
+	ProofCheckedAt     *time.Time
+	CreatedAt          time.Time `gorm:"autoCreateTime"`
+	UpdatedAt          time.Time `gorm:"autoUpdateTime"`
+}
+
+// InsertReplica records a replica of a file, or resets the replica the file
+// already has with the same provider.
+func InsertReplica(db *gorm.DB, fileID uint, provider string, state ReplicaState) error {
+	var replica Replica
+	err := db.Where(Replica{FileID: fileID, Provider: provider}).
+		Assign(map[string]any{"state": state, "proof_set_id": 0, "tx_hash": "", "root_id": 0, "epoch": 0, "error": ""}).
+		FirstOrCreate(&replica).Error
+	return err
+}
+
+// QueryReplicas retrieves the replicas of a file.
+func QueryReplicas(db *gorm.DB, fileID uint) ([]Replica, error) {
+	var replicas []Replica
+	if err := db.Where("file_id = ?", fileID).Order("id").Find(&replicas).Error; err != nil {
+		return nil, err
+	}
+
+	return replicas, nil
+}
+
+// QueryReplicasByState retrieves the replicas with a provider in the given
+// state, the oldest first.
+func QueryReplicasByState(db *gorm.DB, provider string, state ReplicaState) ([]Replica, error) {
+	var replicas []Replica
+	if err := db.Where("provider = ? AND state = ?", provider, state).Order("id").Find(&replicas).Error; err != nil {
+		return nil, err
+	}
+
+	return replicas, nil
+}
+
+// QueryCompletedReplicas retrieves the completed replicas in a proof set of a
+// provider.
+func QueryCompletedReplicas(db *gorm.DB, provider string, proofSetID int) ([]Replica, error) {
+	var replicas []Replica
+	if err := db.Where("provider = ? AND proof_set_id = ? AND state = ?", provider, proofSetID, ReplicaCompleted).
+		Find(&replicas).Error; err != nil {
+		return nil, err
+	}
+
+	return replicas, nil
+}
+
+// QueryUnderReplicatedFiles retrieves the pending and completed files with
+// fewer than n live replicas.
+func QueryUnderReplicatedFiles(db *gorm.DB, n int) ([]FileInfo, error) {
+	var fileInfos []FileInfo
+	live := db.Model(&Replica{}).
+		Select("COUNT(*)").
+		Where("replicas.file_id = file_infos.id AND replicas.state IN ?", liveReplicaStates)
+	if err := db.Where("status IN ? AND (?) < ?", []Status{StatusPending, StatusConfirming, StatusCompleted}, live, n).
+		Find(&fileInfos).Error; err != nil {
+		return nil, err
+	}
+
+	return fileInfos, nil
+}
+
+// QueryFilesReplicas retrieves the replicas of the given files.
+func QueryFilesReplicas(db *gorm.DB, fileIDs []uint) ([]Replica, error) {
+	var replicas []Replica
+	if err := db.Where("file_id IN ?", fileIDs).Order("id").Find(&replicas).Error; err != nil {
+		return nil, err
+	}
+
+	return replicas, nil
+}
+
+// UpdateReplicaState updates the state and error of a replica.
+func UpdateReplicaState(db *gorm.DB, id uint, state ReplicaState, errMsg string) error {
+	return db.Model(&Replica{}).
+		Where("id = ?", id).
+		Updates(map[string]any{"state": state, "error": errMsg}).Error
+}
+
+// SubmitReplica records the proof set the root of a replica is added to and
+// the hash of the message adding it.
+func SubmitReplica(db *gorm.DB, id uint, proofSetID int, txHash string) error {
+	return db.Model(&Replica{}).
+		Where("id = ?", id).
+		Updates(map[string]any{"state": ReplicaConfirming, "proof_set_id": proofSetID, "tx_hash": txHash, "error": ""}).Error
+}
+
+// QueryConfirmingReplicas retrieves the replicas with a provider whose root
+// addition waits to land on chain, ordered by message and in the order
+// their roots were sent.
+func QueryConfirmingReplicas(db *gorm.DB, provider string) ([]Replica, error) {
+	var replicas []Replica
+	if err := db.Where("provider = ? AND state = ?", provider, ReplicaConfirming).
+		Order("tx_hash, id").Find(&replicas).Error; err != nil {
+		return nil, err
+	}
+
+	return replicas, nil
+}
+
+// CompleteReplica records the ID the root of a replica was assigned and the
+// epoch it landed at.
+func CompleteReplica(db *gorm.DB, id uint, rootID uint64, epoch int64) error {
+	return db.Model(&Replica{}).
+		Where("id = ?", id).
+		Updates(map[string]any{"state": ReplicaCompleted, "root_id": rootID, "epoch": epoch, "error": ""}).Error
+}
+
+// BackfillReplicas records the replicas of files stored before replicas were
+// tracked. They were all stored with the given provider.
+func BackfillReplicas(db *gorm.DB, provider string) (int64, error) {
+	var fileInfos []FileInfo
+	if err := db.Where("id NOT IN (?)", db.Model(&Replica{}).Select("file_id")).Find(&fileInfos).Error; err != nil {
+		return 0, err
+	}
+
+	for _, fileInfo := range fileInfos {
+		replica := Replica{FileID: fileInfo.ID, Provider: provider, ProofSetID: fileInfo.ProofSetID}
+		switch fileInfo.Status {
+		case StatusCompleted:
+			replica.State = ReplicaCompleted
+		case StatusFailed:
+			replica.State = ReplicaFailed
+		case StatusRemoved:
+			replica.State = ReplicaRemoved
+		default:
+			replica.State = ReplicaAddingRoots
+		}
+		if err := db.Create(&replica).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(fileInfos)), nil
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidTransition is returned when a file is moved to a status that
+// cannot follow its current one.
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// fileTransitions lists the statuses each status of a file can move to.
+// Moving a file back to pending retries its root.
+var fileTransitions = map[Status][]Status{
+	StatusPending:    {StatusPending, StatusConfirming, StatusCompleted, StatusFailed},
+	StatusConfirming: {StatusPending, StatusCompleted, StatusFailed},
+	StatusCompleted:  {StatusRemoved},
+	StatusFailed:     nil,
+	StatusRemoved:    nil,
+}
+
+// FileTransition is a change of the status of a file.
+type FileTransition struct {
+	ID         uint   `gorm:"primaryKey"`
+	FileID     uint   `gorm:"index;not null"`
+	FromStatus Status // empty for the creation of the file
+	ToStatus   Status
+	// Attempt is the attempt of the file the transition belongs to.
+	Attempt   int
+	Error     string
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+// TransitionFile moves a file to a status and records the transition in its
+// history. The error, if not empty, becomes the last error of the file, and
+// updates are applied along with the status.
+func TransitionFile(db *gorm.DB, id uint, to Status, errMsg string, updates map[string]any) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var fileInfo FileInfo
+		if err := tx.Select("id", "status", "attempts").First(&fileInfo, id).Error; err != nil {
+			return err
+		}
+		return transitionFile(tx, &fileInfo, to, errMsg, updates)
+	})
+}
+
+// transitionFile moves a file from the status it was read with to another.
+// The update fails if the status changed in between.
+func transitionFile(tx *gorm.DB, fileInfo *FileInfo, to Status, errMsg string, updates map[string]any) error {
+	from := fileInfo.Status
+	if !slices.Contains(fileTransitions[from], to) {
+		return fmt.Errorf("%w: file %d from %s to %s", ErrInvalidTransition, fileInfo.ID, from, to)
+	}
+
+	now := time.Now()
+	values := map[string]any{"status": to, "status_at": now, string(to) + "_at": now}
+	for k, v := range updates {
+		values[k] = v
+	}
+	if to == StatusPending {
+		fileInfo.Attempts++
+		values["attempts"] = fileInfo.Attempts
+	}
+	if errMsg != "" {
+		values["last_error"] = errMsg
+	}
+
+	res := tx.Model(&FileInfo{}).Where("id = ? AND status = ?", fileInfo.ID, from).Updates(values)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("file %d is no longer %s", fileInfo.ID, from)
+	}
+	fileInfo.Status = to
+
+	return tx.Create(&FileTransition{
+		FileID:     fileInfo.ID,
+		FromStatus: from,
+		ToStatus:   to,
+		Attempt:    fileInfo.Attempts,
+		Error:      errMsg,
+	}).Error
+}
+
+// QueryFileTransitions retrieves the status history of a file, the oldest
+// first.
+func QueryFileTransitions(db *gorm.DB, fileID uint) ([]FileTransition, error) {
+	var transitions []FileTransition
+	if err := db.Where("file_id = ?", fileID).Order("id").Find(&transitions).Error; err != nil {
+		return nil, err
+	}
+
+	return transitions, nil
+}
+
+// QueryStuckFiles retrieves the files that entered the given status before
+// the cutoff. Files recorded before the status timestamps fall back to their
+// last update.
+func QueryStuckFiles(db *gorm.DB, status Status, cutoff time.Time) ([]FileInfo, error) {
+	var fileInfos []FileInfo
+	if err := db.Where("status = ? AND COALESCE(status_at, updated_at) < ?", status, cutoff).
+		Find(&fileInfos).Error; err != nil {
+		return nil, err
+	}
+
+	return fileInfos, nil
+}
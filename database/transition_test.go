@@ -0,0 +1,165 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := InitDB(filepath.Join(t.TempDir(), "ark.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestTransitionFile(t *testing.T) {
+	db := newTestDB(t)
+	id, err := InsertData(db, &FileInfo{UserAddress: "user", FileName: "file", Root: "root"}, []string{"piece"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		to     Status
+		errMsg string
+	}{
+		{to: StatusConfirming},
+		{to: StatusPending, errMsg: "root addition reverted"},
+		{to: StatusConfirming},
+		{to: StatusCompleted},
+		{to: StatusRemoved},
+	}
+	for _, step := range steps {
+		if err := TransitionFile(db, id, step.to, step.errMsg, nil); err != nil {
+			t.Fatalf("to %s: %v", step.to, err)
+		}
+	}
+
+	fileInfo, err := QueryFileInfoByID(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.Status != StatusRemoved || fileInfo.Attempts != 1 || fileInfo.LastError != "root addition reverted" {
+		t.Fatalf("file: status %s, attempts %d, last error %q", fileInfo.Status, fileInfo.Attempts, fileInfo.LastError)
+	}
+	for name, at := range map[string]*time.Time{
+		"status_at":     fileInfo.StatusAt,
+		"pending_at":    fileInfo.PendingAt,
+		"confirming_at": fileInfo.ConfirmingAt,
+		"completed_at":  fileInfo.CompletedAt,
+		"removed_at":    fileInfo.RemovedAt,
+	} {
+		if at == nil {
+			t.Errorf("%s is not set", name)
+		}
+	}
+	if fileInfo.FailedAt != nil {
+		t.Errorf("failed_at is set")
+	}
+	if fileInfo.RemovedAt.Before(*fileInfo.CompletedAt) || !fileInfo.StatusAt.Equal(*fileInfo.RemovedAt) {
+		t.Errorf("completed at %v, removed at %v, status at %v", fileInfo.CompletedAt, fileInfo.RemovedAt, fileInfo.StatusAt)
+	}
+
+	transitions, err := QueryFileTransitions(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FileTransition{
+		{ToStatus: StatusPending},
+		{FromStatus: StatusPending, ToStatus: StatusConfirming},
+		{FromStatus: StatusConfirming, ToStatus: StatusPending, Attempt: 1, Error: "root addition reverted"},
+		{FromStatus: StatusPending, ToStatus: StatusConfirming, Attempt: 1},
+		{FromStatus: StatusConfirming, ToStatus: StatusCompleted, Attempt: 1},
+		{FromStatus: StatusCompleted, ToStatus: StatusRemoved, Attempt: 1},
+	}
+	if len(transitions) != len(want) {
+		t.Fatalf("%d transitions, want %d", len(transitions), len(want))
+	}
+	for i, tr := range transitions {
+		if tr.FileID != id || tr.FromStatus != want[i].FromStatus || tr.ToStatus != want[i].ToStatus ||
+			tr.Attempt != want[i].Attempt || tr.Error != want[i].Error {
+			t.Errorf("transition %d: %+v, want %+v", i, tr, want[i])
+		}
+	}
+}
+
+func TestTransitionFileRejectsInvalidTransitions(t *testing.T) {
+	for _, tt := range []struct{ from, to Status }{
+		{StatusRemoved, StatusCompleted},
+		{StatusRemoved, StatusPending},
+		{StatusFailed, StatusPending},
+		{StatusFailed, StatusCompleted},
+		{StatusCompleted, StatusPending},
+		{StatusCompleted, StatusFailed},
+		{StatusCompleted, StatusConfirming},
+		{StatusConfirming, StatusConfirming},
+		{StatusConfirming, StatusRemoved},
+		{StatusPending, StatusRemoved},
+	} {
+		t.Run(string(tt.from)+" to "+string(tt.to), func(t *testing.T) {
+			db := newTestDB(t)
+			id, err := InsertData(db, &FileInfo{UserAddress: "user", FileName: "file", Root: "root"}, []string{"piece"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Model(&FileInfo{}).Where("id = ?", id).Update("status", tt.from).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			err = TransitionFile(db, id, tt.to, "", nil)
+			if !errors.Is(err, ErrInvalidTransition) {
+				t.Fatalf("error: %v, want %v", err, ErrInvalidTransition)
+			}
+
+			fileInfo, err := QueryFileInfoByID(db, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fileInfo.Status != tt.from {
+				t.Errorf("status changed to %s", fileInfo.Status)
+			}
+			transitions, err := QueryFileTransitions(db, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(transitions) != 1 {
+				t.Errorf("%d transitions recorded", len(transitions))
+			}
+		})
+	}
+}
+
+func TestTransitionFileFailsOnStaleStatus(t *testing.T) {
+	db := newTestDB(t)
+	id, err := InsertData(db, &FileInfo{UserAddress: "user", FileName: "file", Root: "root"}, []string{"piece"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is read as pending, then moved by someone else.
+	stale, err := QueryFileInfoByID(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := TransitionFile(db, id, StatusConfirming, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := transitionFile(db, stale, StatusFailed, "stuck", nil); err == nil {
+		t.Fatal("a file moved in between was transitioned")
+	}
+	fileInfo, err := QueryFileInfoByID(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.Status != StatusConfirming {
+		t.Errorf("status: %s", fileInfo.Status)
+	}
+}
@@ -98,6 +98,7 @@ export function FileManagement() {
       case "completed":
         return "bg-green-100 text-green-800"
       case "pending":
+      case "confirming":
         return "bg-yellow-100 text-yellow-800"
       case "failed":
         return "bg-red-100 text-red-800"
@@ -112,13 +113,44 @@ export function FileManagement() {
         return "Completed"
       case "pending":
         return "Pending"
+      case "confirming":
+        return "Confirming"
       case "failed":
         return "Failed"
+      case "removed":
+        return "Removed"
       default:
         return "Unknown"
     }
   }
 
+  const getProofStatusColor = (status: FileInfo["proof_status"]) => {
+    switch (status) {
+      case "proving":
+        return "bg-green-100 text-green-800"
+      case "faulty":
+      case "missing":
+        return "bg-red-100 text-red-800"
+      default:
+        return "bg-gray-100 text-gray-800"
+    }
+  }
+
+  const getProofStatusText = (status: FileInfo["proof_status"]) => {
+    switch (status) {
+      case "proving":
+        return "Proven"
+      case "pending":
+        return "Awaiting proof"
+      case "faulty":
+        return "Proof missed"
+      case "missing":
+        return "Root missing"
+      default:
+        return "Proof unknown"
+    }
+  }
+
   // Helper function to truncate the root string
   const truncateRoot = (root: string, startLength: number = 6, endLength: number = 6): string => {
     if (!root || root.length <= startLength + endLength) {
@@ -234,6 +266,15 @@ export function FileManagement() {
                       >
                         {getStatusText(file.status)}
                       </span>
+                      {file.proof_status && (
+                        <span
+                          className={`ml-2 inline-flex items-center px-2.5 py-0.5 rounded-full text-xs font-medium ${getProofStatusColor(
+                            file.proof_status
+                          )}`}
+                        >
+                          {getProofStatusText(file.proof_status)}
+                        </span>
+                      )}
                     </td>
                   </tr>
                 ))
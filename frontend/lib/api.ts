@@ -1,5 +1,5 @@
 import { config } from "./config"
-import type { FileInfo, UploadRequest, UploadResponse } from "@/types"
+import type { FileInfo, Job, UploadRequest, UploadResponse } from "@/types"
 
 class ApiService {
   private baseUrl: string
@@ -41,6 +41,16 @@ class ApiService {
       body: JSON.stringify(data),
     })
   }
+  async getJob(id: number): Promise<Job> {
+    return this.request<Job>(`${config.api.endpoints.jobs}/${id}`)
+  }
+
+  async retryJob(id: number): Promise<UploadResponse> {
+    return this.request<UploadResponse>(`${config.api.endpoints.jobs}/${id}/retry`, {
+      method: "POST",
+    })
+  }
+
   async downloadFile(userAddress: string, fileName: string): Promise<string> {
     const url = `${this.baseUrl}${config.api.endpoints.download}?user_address=${encodeURIComponent(userAddress)}&file_name=${encodeURIComponent(fileName)}`
 
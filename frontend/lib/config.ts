@@ -5,6 +5,7 @@ export const config = {
       files: "/files",
       upload: "/upload",
       download: "/download",
+      jobs: "/jobs",
     },
   },
   app: {
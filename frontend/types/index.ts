@@ -2,18 +2,60 @@ export interface FileInfo {
   file_name: string
   root: string
   size: string
+  format: string
+  profile: string
+  mime_type: string
+  original_name?: string
   upload_time: string
-  status: "completed" | "pending" | "failed"
+  status: "completed" | "pending" | "confirming" | "failed" | "removed"
+  last_error?: string
+  proof_status?: "pending" | "proving" | "faulty" | "missing" | "unknown"
 }
 
 export interface UploadRequest {
   user_address: string
   file_name: string
   resource_url: string
+  format?: "auto" | "raw" | "html" | "warc" | "singlefile" | "mhtml" | "wacz"
+  renditions?: ("png" | "pdf")[]
+  profile?: string
 }
 
 export interface UploadResponse {
   message: string
+  job_id: number
+}
+
+export type JobState = "queued" | "capturing" | "hashing" | "uploading" | "adding-roots" | "confirming" | "proving" | "failed"
+
+export interface JobPiece {
+  part: string
+  index: number
+  cid: string
+  size: number
+  state: "pending" | "uploaded"
+}
+
+export interface Job {
+  id: number
+  state: JobState
+  error?: string
+  user_address: string
+  file_name: string
+  resource_url: string
+  format: string
+  renditions: string[]
+  profile: string
+  root?: string
+  progress: {
+    uploaded_pieces: number
+    total_pieces: number
+    uploaded_bytes: number
+    total_bytes: number
+  }
+  pieces: JobPiece[]
+  created_at: string
+  updated_at: string
 }
 
 export interface ProofSet {
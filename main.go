@@ -2,16 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/urfave/cli/v3"
 
 	"github.com/ipfs-force-community/ark-eternal/database"
+	"github.com/ipfs-force-community/ark-eternal/pdp"
+	"github.com/ipfs-force-community/ark-eternal/pdp/pdptest"
 	"github.com/ipfs-force-community/ark-eternal/service"
 )
 
@@ -20,10 +27,12 @@ func main() {
 		Name:  "ark external",
 		Usage: "ark external service",
 		Commands: []*cli.Command{
+			proofSetCommand(),
 			{
 				Name:   "create-proof-set-id",
-				Usage:  "Create a proof set ID",
-				Action: createProofSetID,
+				Usage:  "Create a proof set, kept for scripts written before \"proof-set create\"",
+				Hidden: true,
+				Action: createProofSet,
 			},
 			{
 				Name:  "add-roots",
@@ -37,6 +46,47 @@ func main() {
 				},
 				Action: addRoots,
 			},
+			{
+				Name:  "fake-pdp",
+				Usage: "Run an in-memory PDP service for offline development. Point service_url at it and set proof_set_id to 0 so the service creates its own proof sets",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "listen",
+						Value: "127.0.0.1:4702",
+						Usage: "Address to listen on",
+					},
+					&cli.Float64Flag{
+						Name:  "error_rate",
+						Usage: "Probability that a request fails with 503",
+					},
+					&cli.DurationFlag{
+						Name:  "latency",
+						Usage: "Delay added to every request",
+					},
+					&cli.DurationFlag{
+						Name:  "creation_delay",
+						Usage: "Time until a proof set creation lands",
+					},
+					&cli.DurationFlag{
+						Name:  "confirmation_delay",
+						Usage: "Time until a root addition lands",
+					},
+					&cli.DurationFlag{
+						Name:  "epoch_duration",
+						Value: 30 * time.Second,
+						Usage: "Duration of an epoch of the fake chain",
+					},
+					&cli.BoolFlag{
+						Name:  "hide_proving",
+						Usage: "Omit the chain height, last proof and challenge window from proof sets",
+					},
+					&cli.BoolFlag{
+						Name:  "ignore_ranges",
+						Usage: "Send whole pieces whatever range is requested",
+					},
+				},
+				Action: fakePDP,
+			},
 			{
 				Name:  "export-public-key",
 				Usage: "Export the public key of the PDP service",
@@ -65,7 +115,27 @@ func main() {
 			&cli.IntFlag{
 				Name:  "proof_set_id",
 				Value: 390,
-				Usage: "ID of the proof set",
+				Usage: "ID of an existing proof set to add roots to, 0 lets the service create and rotate its own. The proof sets of files stored by earlier versions are adopted on start",
+			},
+			&cli.StringFlag{
+				Name:    "record_keeper",
+				Aliases: []string{"record-keeper"},
+				Value:   "0x6170dE2b09b404776197485F3dc6c968Ef948505",
+				Usage:   "Address of the record keeper contract of new proof sets",
+			},
+			&cli.IntFlag{
+				Name:  "proof_set_max_roots",
+				Value: 1000,
+				Usage: "Number of roots after which a new proof set is created, 0 disables the limit",
+			},
+			&cli.Uint64Flag{
+				Name:  "proof_set_max_bytes",
+				Usage: "Padded size of the roots after which a new proof set is created, 0 disables the limit",
+			},
+			&cli.IntFlag{
+				Name:  "add_roots_batch_size",
+				Value: 50,
+				Usage: "Maximum number of roots added to a proof set in a single message",
 			},
 			&cli.StringFlag{
 				Name:  "service_name",
@@ -76,6 +146,107 @@ func main() {
 				Value: "https://caliberation-pdp.infrafolio.com",
 				Usage: "URL of the service",
 			},
+			&cli.StringFlag{
+				Name:  "providers",
+				Usage: "Path to a JSON file with the list of PDP providers, the first one receives the uploads. Defaults to the provider given by service_url",
+			},
+			&cli.IntFlag{
+				Name:  "replicas",
+				Value: 1,
+				Usage: "Number of providers each archive is stored with",
+			},
+			&cli.DurationFlag{
+				Name:  "repair_interval",
+				Value: 10 * time.Minute,
+				Usage: "Interval at which the providers are checked for dropped roots",
+			},
+			&cli.DurationFlag{
+				Name:  "reap_interval",
+				Value: time.Minute,
+				Usage: "Interval at which files stuck in a status are retried or failed, 0 disables the reaper",
+			},
+			&cli.DurationFlag{
+				Name:  "pending_max_age",
+				Value: 24 * time.Hour,
+				Usage: "Time a file may wait for its root to be sent before it is retried, 0 waits forever",
+			},
+			&cli.DurationFlag{
+				Name:  "confirming_max_age",
+				Value: 2 * time.Hour,
+				Usage: "Time a file may wait for the message adding its root to land before it is retried, 0 waits forever",
+			},
+			&cli.IntFlag{
+				Name:  "max_retries",
+				Value: 3,
+				Usage: "Number of times a stuck file is retried before it is failed",
+			},
+			&cli.DurationFlag{
+				Name:  "failed_spool_max_age",
+				Value: 7 * 24 * time.Hour,
+				Usage: "Time the spool of a failed upload job is kept so the job can be retried from it, 0 keeps it forever",
+			},
+			&cli.DurationFlag{
+				Name:  "monitor_interval",
+				Value: time.Minute,
+				Usage: "Interval at which the proving state of the roots is checked, 0 disables the monitor",
+			},
+			&cli.StringFlag{
+				Name:  "alert_webhook",
+				Usage: "URL the alerts about missed proofs are posted to as JSON",
+			},
+			&cli.Int64Flag{
+				Name:  "chain_genesis",
+				Value: 1667326380,
+				Usage: "Unix time of the genesis of the chain, from which the chain height is computed for providers not reporting it. Defaults to the calibration network of the default service_url (mainnet: 1598306400)",
+			},
+			&cli.Int64Flag{
+				Name:  "challenge_window",
+				Value: 60,
+				Usage: "Number of epochs after a challenge within which its proof must land, for providers not reporting it",
+			},
+			&cli.DurationFlag{
+				Name:  "pdp_timeout",
+				Value: 5 * time.Minute,
+				Usage: "Timeout of a request to the PDP service, 0 disables it",
+			},
+			&cli.StringFlag{
+				Name:  "capture_profiles",
+				Usage: "Path to a JSON file with the list of capture profiles",
+			},
+			&cli.IntFlag{
+				Name:  "browser_pool_size",
+				Value: 2,
+				Usage: "Number of warm browsers shared by captures, 0 starts a browser per capture",
+			},
+			&cli.IntFlag{
+				Name:  "browser_max_tabs",
+				Value: 4,
+				Usage: "Maximum number of concurrent captures per pooled browser",
+			},
+			&cli.IntFlag{
+				Name:  "browser_max_captures",
+				Value: 100,
+				Usage: "Number of captures after which a pooled browser is restarted, 0 never restarts it",
+			},
+			&cli.IntFlag{
+				Name:  "upload_workers",
+				Value: 2,
+				Usage: "Number of upload jobs processed concurrently",
+			},
+			&cli.StringFlag{
+				Name:  "spool_dir",
+				Value: "./spool",
+				Usage: "Directory holding captures until their upload completes, so that interrupted uploads resume on restart",
+			},
+			&cli.Int64Flag{
+				Name:  "max_upload_size",
+				Value: 10 << 30,
+				Usage: "Maximum size in bytes of a file uploaded directly, 0 only limits it to the 40 GiB a root can hold",
+			},
+			&cli.BoolFlag{
+				Name:  "unverified_ranges",
+				Usage: "Serve byte ranges with ranged piece downloads, which cannot be checked against the piece CIDs, instead of verifying the whole pieces",
+			},
 			&cli.Int32Flag{
 				Name:  "port",
 				Value: 12345,
@@ -102,10 +273,34 @@ func action(ctx context.Context, cmd *cli.Command) error {
 		return fmt.Errorf("failed to load private key: %w", err)
 	}
 
+	profiles, err := service.LoadCaptureProfiles(cmd.String("capture_profiles"))
+	if err != nil {
+		return fmt.Errorf("failed to load capture profiles: %w", err)
+	}
+
+	if err := os.MkdirAll(cmd.String("spool_dir"), 0o755); err != nil {
+		return fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	ser := service.NewService(ctx, db, privateKey, cmd.Int("proof_set_id"), cmd.String("service_url"), cmd.String("service_name"))
+	var pool *service.BrowserPool
+	if size := cmd.Int("browser_pool_size"); size > 0 {
+		pool = service.NewBrowserPool(ctx, service.BrowserPoolConfig{
+			Size:        size,
+			MaxTabs:     cmd.Int("browser_max_tabs"),
+			MaxCaptures: cmd.Int("browser_max_captures"),
+		})
+		defer pool.Close()
+	}
+
+	providers, err := loadProviders(cmd, privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to load providers: %w", err)
+	}
+
+	ser := service.NewService(ctx, db, privateKey, providers, cmd.Int("replicas"), profiles, pool, cmd.String("spool_dir"), cmd.Int64("max_upload_size"), cmd.Bool("unverified_ranges"))
 
 	wg := &sync.WaitGroup{}
 	exit := make(chan struct{})
@@ -116,6 +311,50 @@ func action(ctx context.Context, cmd *cli.Command) error {
 		ser.Schedule()
 	}()
 
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ser.ProcessJobs(cmd.Int("upload_workers"))
+	}()
+
+	if interval := cmd.Duration("repair_interval"); interval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ser.Repair(interval)
+		}()
+	}
+
+	if interval := cmd.Duration("reap_interval"); interval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ser.Reap(interval, service.ReaperConfig{
+				MaxAge: map[database.Status]time.Duration{
+					database.StatusPending:    cmd.Duration("pending_max_age"),
+					database.StatusConfirming: cmd.Duration("confirming_max_age"),
+				},
+				MaxRetries:        cmd.Int("max_retries"),
+				FailedSpoolMaxAge: cmd.Duration("failed_spool_max_age"),
+			})
+		}()
+	}
+
+	if interval := cmd.Duration("monitor_interval"); interval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cfg := service.MonitorConfig{
+				AlertWebhook:    cmd.String("alert_webhook"),
+				ChallengeWindow: cmd.Int64("challenge_window"),
+			}
+			if genesis := cmd.Int64("chain_genesis"); genesis > 0 {
+				cfg.Genesis = time.Unix(genesis, 0)
+			}
+			ser.Monitor(interval, cfg)
+		}()
+	}
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -146,31 +385,147 @@ func action(ctx context.Context, cmd *cli.Command) error {
 	return nil
 }
 
-func createProofSetID(ctx context.Context, cmd *cli.Command) error {
-	jwtToken, err := service.GetJWTToken(cmd.String("service_name"), cmd.String("private_key_path"))
-	if err != nil {
-		return fmt.Errorf("failed to create JWT token: %w", err)
+// loadProviders returns the providers listed in the providers file, or the
+// single provider given by the service flags when there is none. Fields
+// missing from the file fall back to the service flags.
+func loadProviders(cmd *cli.Command, privateKey *ecdsa.PrivateKey) ([]*service.Provider, error) {
+	proofSets := service.ProofSetConfig{
+		ID:           cmd.Int("proof_set_id"),
+		RecordKeeper: cmd.String("record_keeper"),
+		MaxRoots:     cmd.Int("proof_set_max_roots"),
+		MaxBytes:     cmd.Uint64("proof_set_max_bytes"),
+		BatchRoots:   cmd.Int("add_roots_batch_size"),
 	}
 
-	txHash, err := service.CreateProofSet("0x6170dE2b09b404776197485F3dc6c968Ef948505", "", cmd.String("service_url"), jwtToken)
+	path := cmd.String("providers")
+	if path == "" {
+		return []*service.Provider{{
+			Name:      service.DefaultProvider,
+			Client:    newPDPClient(cmd, privateKey),
+			ProofSets: proofSets,
+		}}, nil
+	}
+
+	configs, err := service.LoadProviderConfigs(path)
 	if err != nil {
-		return fmt.Errorf("failed to create proof set: %w", err)
+		return nil, err
 	}
 
-	fmt.Printf("Proof set created successfully with transaction hash: %s\n", txHash)
-	return nil
+	providers := make([]*service.Provider, 0, len(configs))
+	for _, cfg := range configs {
+		key := privateKey
+		if cfg.PrivateKeyPath != "" {
+			key, err = service.LoadPrivateKey(cfg.PrivateKeyPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load private key of provider %s: %w", cfg.Name, err)
+			}
+		}
+
+		serviceName := cfg.ServiceName
+		if serviceName == "" {
+			serviceName = cmd.String("service_name")
+		}
+
+		ps := proofSets
+		ps.ID = cfg.ProofSetID
+		if cfg.RecordKeeper != "" {
+			ps.RecordKeeper = cfg.RecordKeeper
+		}
+
+		providers = append(providers, &service.Provider{
+			Name: cfg.Name,
+			Client: pdp.NewClient(pdp.Config{
+				URL:     cfg.URL,
+				Token:   service.TokenSource(serviceName, key),
+				Timeout: cmd.Duration("pdp_timeout"),
+			}),
+			ProofSets: ps,
+		})
+	}
+
+	return providers, nil
+}
+
+// newPDPClient creates a client of the PDP service authenticated with the
+// private key of the service.
+func newPDPClient(cmd *cli.Command, privateKey *ecdsa.PrivateKey) pdp.Client {
+	return pdp.NewClient(pdp.Config{
+		URL:     cmd.String("service_url"),
+		Token:   service.TokenSource(cmd.String("service_name"), privateKey),
+		Timeout: cmd.Duration("pdp_timeout"),
+	})
 }
 
 func addRoots(ctx context.Context, cmd *cli.Command) error {
-	jwtToken, err := service.GetJWTToken(cmd.String("service_name"), cmd.String("private_key_path"))
+	privateKey, err := service.LoadPrivateKey(cmd.String("private_key_path"))
 	if err != nil {
-		return fmt.Errorf("failed to create JWT token: %w", err)
+		return fmt.Errorf("failed to load private key: %w", err)
+	}
+
+	if cmd.Int("proof_set_id") == 0 {
+		return fmt.Errorf("proof_set_id is required")
 	}
 
-	if err := service.AddRoots("", cmd.String("service_url"), jwtToken, cmd.Int("proof_set_id"), cmd.StringSlice("root")); err != nil {
+	req := &pdp.AddRootsRequest{}
+	for _, input := range cmd.StringSlice("root") {
+		root, err := parseRootInput(input)
+		if err != nil {
+			return err
+		}
+		req.Roots = append(req.Roots, root)
+	}
+
+	res, err := newPDPClient(cmd, privateKey).AddRoots(ctx, uint64(cmd.Int("proof_set_id")), req)
+	if err != nil {
 		return fmt.Errorf("failed to add roots to proof set: %w", err)
 	}
 
 	fmt.Println("Roots added successfully to the proof set.")
+	if res.TxHash != "" {
+		fmt.Println("Transaction hash:", res.TxHash)
+	}
+	return nil
+}
+
+// parseRootInput parses a root given as rootCID:subrootCID1+subrootCID2.
+func parseRootInput(input string) (pdp.RootEntry, error) {
+	rootCID, subroots, ok := strings.Cut(input, ":")
+	if !ok || rootCID == "" || subroots == "" {
+		return pdp.RootEntry{}, fmt.Errorf("invalid root input format: %s", input)
+	}
+
+	root := pdp.RootEntry{RootCID: rootCID}
+	for _, subroot := range strings.Split(subroots, "+") {
+		root.Subroots = append(root.Subroots, pdp.SubrootEntry{SubrootCID: subroot})
+	}
+	return root, nil
+}
+
+func fakePDP(ctx context.Context, cmd *cli.Command) error {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{
+		Addr: cmd.String("listen"),
+		Handler: pdptest.NewServer(pdptest.Options{
+			ErrorRate:         cmd.Float64("error_rate"),
+			Latency:           cmd.Duration("latency"),
+			CreationDelay:     cmd.Duration("creation_delay"),
+			ConfirmationDelay: cmd.Duration("confirmation_delay"),
+			EpochDuration:     cmd.Duration("epoch_duration"),
+			HideProving:       cmd.Bool("hide_proving"),
+			IgnoreRanges:      cmd.Bool("ignore_ranges"),
+		}),
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+
+	slog.Info("fake PDP service listening", "address", srv.Addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to run fake PDP service: %w", err)
+	}
 	return nil
 }
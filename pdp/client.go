@@ -0,0 +1,345 @@
+package pdp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Client is the API of a PDP service.
+type Client interface {
+	// CreateProofSet starts the creation of a proof set.
+	CreateProofSet(ctx context.Context, req *CreateProofSetRequest) (*CreateProofSetResponse, error)
+	// GetProofSetCreateStatus retrieves the status of a proof set creation
+	// by the hash of its message.
+	GetProofSetCreateStatus(ctx context.Context, txHash string) (*ProofSetCreateStatus, error)
+	// GetProofSet retrieves a proof set and its roots.
+	GetProofSet(ctx context.Context, proofSetID uint64) (*ProofSet, error)
+	// AddRoots adds roots to a proof set in a single message. The roots are
+	// all added or none is.
+	AddRoots(ctx context.Context, proofSetID uint64, req *AddRootsRequest) (*AddRootsResponse, error)
+	// GetRootAdditionStatus retrieves the status of a root addition by the
+	// hash of its message.
+	GetRootAdditionStatus(ctx context.Context, proofSetID uint64, txHash string) (*RootAdditionStatus, error)
+	// DeleteRoot schedules the removal of a root from a proof set.
+	DeleteRoot(ctx context.Context, proofSetID, rootID uint64) error
+	// UploadPiece uploads the content of a piece, whose size is given by the
+	// check of req, unless the service already holds it.
+	UploadPiece(ctx context.Context, req *UploadPieceRequest, content io.Reader) (*UploadPieceResponse, error)
+	// DownloadPiece retrieves the content of a piece. The caller closes the
+	// returned reader.
+	DownloadPiece(ctx context.Context, pieceCID string) (io.ReadCloser, error)
+	// DownloadPieceRange retrieves length bytes of the content of a piece
+	// starting at offset. Services ignoring ranges send the whole piece, of
+	// which the range is cut. The caller closes the returned reader.
+	DownloadPieceRange(ctx context.Context, pieceCID string, offset, length int64) (io.ReadCloser, error)
+}
+
+// Config configures an HTTP client of a PDP service.
+type Config struct {
+	// URL is the base URL of the service.
+	URL string
+	// Token returns the JWT authenticating a request.
+	Token func() (string, error)
+	// Timeout bounds every request including the transfer of its body. Zero
+	// means no timeout.
+	Timeout time.Duration
+	// Transport is used to send requests, http.DefaultTransport if nil.
+	Transport http.RoundTripper
+}
+
+// HTTPClient is a Client talking to a PDP service over HTTP.
+type HTTPClient struct {
+	url    string
+	token  func() (string, error)
+	client *http.Client
+}
+
+var _ Client = (*HTTPClient)(nil)
+
+// NewClient creates an HTTP client of a PDP service.
+func NewClient(cfg Config) *HTTPClient {
+	return &HTTPClient{
+		url:   strings.TrimSuffix(cfg.URL, "/"),
+		token: cfg.Token,
+		client: &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: cfg.Transport,
+		},
+	}
+}
+
+// CreateProofSet implements Client.
+func (c *HTTPClient) CreateProofSet(ctx context.Context, req *CreateProofSetRequest) (*CreateProofSetResponse, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/pdp/proof-sets", req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("failed to create proof set: %w", newStatusError(resp))
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil, fmt.Errorf("service did not provide the creation status in Location header")
+	}
+
+	return &CreateProofSetResponse{
+		Location: location,
+		TxHash:   path.Base(location),
+	}, nil
+}
+
+// GetProofSetCreateStatus implements Client.
+func (c *HTTPClient) GetProofSetCreateStatus(ctx context.Context, txHash string) (*ProofSetCreateStatus, error) {
+	txHash = strings.ToLower(txHash)
+	if !strings.HasPrefix(txHash, "0x") {
+		txHash = "0x" + txHash
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, "/pdp/proof-sets/created/"+txHash, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get proof set status: %w", newStatusError(resp))
+	}
+
+	var status ProofSetCreateStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to parse proof set status: %v", err)
+	}
+
+	return &status, nil
+}
+
+// GetProofSet implements Client.
+func (c *HTTPClient) GetProofSet(ctx context.Context, proofSetID uint64) (*ProofSet, error) {
+	resp, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/pdp/proof-sets/%d", proofSetID), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get proof set %d: %w", proofSetID, newStatusError(resp))
+	}
+
+	var ps ProofSet
+	if err := json.NewDecoder(resp.Body).Decode(&ps); err != nil {
+		return nil, fmt.Errorf("failed to parse proof set: %v", err)
+	}
+
+	return &ps, nil
+}
+
+// AddRoots implements Client.
+func (c *HTTPClient) AddRoots(ctx context.Context, proofSetID uint64, req *AddRootsRequest) (*AddRootsResponse, error) {
+	resp, err := c.do(ctx, http.MethodPost, fmt.Sprintf("/pdp/proof-sets/%d/roots", proofSetID), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("failed to add roots: %w", newStatusError(resp))
+	}
+
+	res := &AddRootsResponse{Location: resp.Header.Get("Location")}
+	if res.Location != "" {
+		res.TxHash = path.Base(res.Location)
+	}
+	return res, nil
+}
+
+// GetRootAdditionStatus implements Client.
+func (c *HTTPClient) GetRootAdditionStatus(ctx context.Context, proofSetID uint64, txHash string) (*RootAdditionStatus, error) {
+	txHash = strings.ToLower(txHash)
+	if !strings.HasPrefix(txHash, "0x") {
+		txHash = "0x" + txHash
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/pdp/proof-sets/%d/roots/added/%s", proofSetID, txHash), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get root addition status: %w", newStatusError(resp))
+	}
+
+	var status RootAdditionStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to parse root addition status: %v", err)
+	}
+
+	return &status, nil
+}
+
+// DeleteRoot implements Client.
+func (c *HTTPClient) DeleteRoot(ctx context.Context, proofSetID, rootID uint64) error {
+	resp, err := c.do(ctx, http.MethodDelete, fmt.Sprintf("/pdp/proof-sets/%d/roots/%d", proofSetID, rootID), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to delete root %d: %w", rootID, newStatusError(resp))
+	}
+
+	return nil
+}
+
+// UploadPiece implements Client. The service answers the piece request with
+// 200 when it already holds the piece, or with 201 and the URL to send the
+// content to.
+func (c *HTTPClient) UploadPiece(ctx context.Context, req *UploadPieceRequest, content io.Reader) (*UploadPieceResponse, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/pdp/piece", req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		res := &UploadPieceResponse{Existed: true}
+		if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+			return nil, fmt.Errorf("failed to parse piece response: %v", err)
+		}
+		return res, nil
+	case http.StatusCreated:
+	default:
+		return nil, fmt.Errorf("failed to request piece upload: %w", newStatusError(resp))
+	}
+
+	uploadURL := resp.Header.Get("Location")
+	if uploadURL == "" {
+		return nil, fmt.Errorf("service did not provide upload URL in Location header")
+	}
+
+	uploadReq, err := http.NewRequestWithContext(ctx, http.MethodPut, c.url+uploadURL, content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload request: %v", err)
+	}
+	uploadReq.ContentLength = req.Check.Size
+	uploadReq.Header.Set("Content-Type", "application/octet-stream")
+
+	uploadResp, err := c.client.Do(uploadReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload piece data: %w", err)
+	}
+	defer uploadResp.Body.Close()
+
+	if uploadResp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("failed to upload piece data: %w", newStatusError(uploadResp))
+	}
+
+	return &UploadPieceResponse{}, nil
+}
+
+// DownloadPiece implements Client.
+func (c *HTTPClient) DownloadPiece(ctx context.Context, pieceCID string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/piece/"+pieceCID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("failed to download piece %s: %w", pieceCID, newStatusError(resp))
+	}
+
+	return resp.Body, nil
+}
+
+// DownloadPieceRange implements Client.
+func (c *HTTPClient) DownloadPieceRange(ctx context.Context, pieceCID string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length <= 0 {
+		return nil, fmt.Errorf("invalid range of %d bytes at offset %d", length, offset)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/piece/"+pieceCID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start, end int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/", &start, &end); err != nil || start != offset || end < offset+length-1 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to download piece %s: unexpected content range %q", pieceCID, resp.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to skip to offset %d of piece %s: %v", offset, pieceCID, err)
+		}
+	default:
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("failed to download piece %s: %w", pieceCID, newStatusError(resp))
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, length), resp.Body}, nil
+}
+
+// do sends an authenticated request with body encoded as JSON, if not nil.
+func (c *HTTPClient) do(ctx context.Context, method, p string, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request body: %v", err)
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.url+p, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if c.token != nil {
+		token, err := c.token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create JWT token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	return resp, nil
+}
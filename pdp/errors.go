@@ -0,0 +1,70 @@
+package pdp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrNotFound matches errors of requests answered with 404 Not Found.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict matches errors of requests answered with 409 Conflict.
+	ErrConflict = errors.New("conflict")
+	// ErrServer matches errors of requests answered with a 5xx status.
+	ErrServer = errors.New("server error")
+)
+
+// StatusError is returned when the PDP service answers with an unexpected
+// HTTP status. It matches ErrNotFound, ErrConflict or ErrServer according to
+// its status code.
+type StatusError struct {
+	StatusCode int
+	Body       string
+	// RetryAfter is the delay requested by the Retry-After header, if any.
+	RetryAfter time.Duration
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status code %d: %s", e.StatusCode, e.Body)
+}
+
+// Is reports whether the status of e is the one target stands for.
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrServer:
+		return e.StatusCode >= http.StatusInternalServerError
+	}
+	return false
+}
+
+// parseRetryAfter parses a Retry-After value given either in seconds or as
+// an HTTP date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
@@ -0,0 +1,55 @@
+package pdp
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: 0},
+		{value: "5", want: 5 * time.Second},
+		{value: "86400", want: 24 * time.Hour},
+		{value: "0", want: 0},
+		{value: "-3", want: 0},
+		{value: "soon", want: 0},
+		{value: time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), want: 0},
+	} {
+		if got := parseRetryAfter(tt.value); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	got := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if got < 59*time.Minute || got > time.Hour {
+		t.Errorf("parseRetryAfter of a date in an hour = %v", got)
+	}
+}
+
+func TestStatusErrorIs(t *testing.T) {
+	for _, tt := range []struct {
+		status int
+		want   error
+	}{
+		{status: http.StatusNotFound, want: ErrNotFound},
+		{status: http.StatusConflict, want: ErrConflict},
+		{status: http.StatusInternalServerError, want: ErrServer},
+		{status: http.StatusServiceUnavailable, want: ErrServer},
+	} {
+		if err := error(&StatusError{StatusCode: tt.status}); !errors.Is(err, tt.want) {
+			t.Errorf("status %d does not match %v", tt.status, tt.want)
+		}
+	}
+
+	for _, status := range []int{http.StatusBadRequest, http.StatusTooManyRequests} {
+		err := &StatusError{StatusCode: status}
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) || errors.Is(err, ErrServer) {
+			t.Errorf("status %d matches a sentinel error", status)
+		}
+	}
+}
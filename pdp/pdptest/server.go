@@ -0,0 +1,781 @@
+// Package pdptest provides an in-memory PDP service for tests and offline
+// development.
+package pdptest
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-commp-utils/nonffi"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+
+	"github.com/ipfs-force-community/ark-eternal/pdp"
+)
+
+// hashName is the only piece check supported, as by Curio.
+const hashName = "sha2-256-trunc254-padded"
+
+// maxPieceSize bounds the content of an uploaded piece.
+const maxPieceSize = 1 << 30
+
+const (
+	// epochDuration is the default duration of an epoch of the fake chain.
+	epochDuration = 30 * time.Second
+	// provingPeriod is the number of epochs between two challenges.
+	provingPeriod = 60
+	// challengeWindow is the number of epochs after a challenge within
+	// which its proof must land.
+	challengeWindow = 20
+	// proofDelay is the number of epochs after a challenge at which the
+	// fake provider proves it.
+	proofDelay = 5
+)
+
+// Options configures a Server.
+type Options struct {
+	// ErrorRate is the probability that a request fails with 503.
+	ErrorRate float64
+	// Latency delays every request.
+	Latency time.Duration
+	// CreationDelay is the time until a proof set creation lands on chain.
+	CreationDelay time.Duration
+	// ConfirmationDelay is the time until a root addition lands on chain.
+	ConfirmationDelay time.Duration
+	// Service is the service name reported in creation statuses.
+	Service string
+	// EpochDuration is the duration of an epoch of the fake chain, 30s if
+	// zero.
+	EpochDuration time.Duration
+	// HideProving omits the chain height, the last proof and the challenge
+	// window from proof sets, like providers not reporting them.
+	HideProving bool
+	// IgnoreRanges makes piece downloads send the whole piece whatever
+	// range is asked for, like providers not supporting ranges.
+	IgnoreRanges bool
+	// Now returns the current time, time.Now if nil. Tests pass a manual
+	// clock to move the fake chain forward without waiting.
+	Now func() time.Time
+	// Genesis is the time of the first epoch of the fake chain, the time
+	// the server is created if zero.
+	Genesis time.Time
+}
+
+// Fault makes matching requests fail.
+type Fault struct {
+	// Method and Path select the requests to fail. Path is matched as a
+	// prefix. Empty values match any request.
+	Method string
+	Path   string
+	// Body, if not empty, only selects the requests whose body contains
+	// it, such as the CID of one of the roots added by a request.
+	Body string
+	// Status is answered instead of handling the request, 500 if zero.
+	Status int
+	// RetryAfter is sent in the Retry-After header if not zero.
+	RetryAfter time.Duration
+	// Count is the number of requests to fail, all of them if zero.
+	Count int
+}
+
+// Root is a root added to a proof set.
+type Root struct {
+	ID       uint64
+	RootCID  string
+	Subroots []string
+	// TxHash is the hash of the message that added the root.
+	TxHash string
+}
+
+type piece struct {
+	data       []byte
+	paddedSize abi.PaddedPieceSize
+}
+
+type upload struct {
+	pieceCID cid.Cid
+	size     int64
+}
+
+// addition is a message adding roots to a proof set.
+type addition struct {
+	proofSetID  uint64
+	rootIDs     []uint64
+	submittedAt time.Time
+	epoch       int64
+	reverted    bool
+}
+
+type proofSet struct {
+	id           uint64
+	recordKeeper string
+	createdAt    time.Time
+	roots        []Root
+	nextRootID   uint64
+	// provingFrom is the epoch the first root was added at, from which the
+	// proof set is challenged.
+	provingFrom int64
+	// missFrom is the epoch from which proofs are missed, 0 while the
+	// proof set is proven.
+	missFrom int64
+}
+
+// Server is an in-memory PDP service. It verifies the commP of uploaded
+// pieces and the roots added to proof sets, and can inject faults. It
+// implements http.Handler.
+type Server struct {
+	opts Options
+	mux  *http.ServeMux
+
+	mu        sync.Mutex
+	faults    []*Fault
+	pieces    map[string]*piece
+	uploads   map[string]*upload
+	proofSets map[uint64]*proofSet
+	// creations maps the hash of a creation message to its proof set.
+	creations map[string]*proofSet
+	// additions maps the hash of a root addition message to it.
+	additions map[string]*addition
+	nextID    uint64
+}
+
+// NewServer creates an empty in-memory PDP service.
+func NewServer(opts Options) *Server {
+	if opts.Service == "" {
+		opts.Service = "fake-pdp"
+	}
+	if opts.EpochDuration <= 0 {
+		opts.EpochDuration = epochDuration
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	if opts.Genesis.IsZero() {
+		opts.Genesis = opts.Now()
+	}
+
+	s := &Server{
+		opts:      opts,
+		mux:       http.NewServeMux(),
+		pieces:    make(map[string]*piece),
+		uploads:   make(map[string]*upload),
+		proofSets: make(map[uint64]*proofSet),
+		creations: make(map[string]*proofSet),
+		additions: make(map[string]*addition),
+		nextID:    1,
+	}
+
+	s.mux.HandleFunc("POST /pdp/piece", s.auth(s.postPiece))
+	s.mux.HandleFunc("PUT /pdp/piece/upload/{id}", s.putPiece)
+	s.mux.HandleFunc("POST /pdp/proof-sets", s.auth(s.createProofSet))
+	s.mux.HandleFunc("GET /pdp/proof-sets/created/{tx}", s.auth(s.creationStatus))
+	s.mux.HandleFunc("GET /pdp/proof-sets/{id}", s.auth(s.getProofSet))
+	s.mux.HandleFunc("POST /pdp/proof-sets/{id}/roots", s.auth(s.addRoots))
+	s.mux.HandleFunc("GET /pdp/proof-sets/{id}/roots/added/{tx}", s.auth(s.additionStatus))
+	s.mux.HandleFunc("DELETE /pdp/proof-sets/{id}/roots/{root}", s.auth(s.deleteRoot))
+	s.mux.HandleFunc("GET /piece/{cid}", s.getPiece)
+
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Latency > 0 {
+		select {
+		case <-time.After(s.opts.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if f := s.fault(r); f != nil {
+		if f.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(f.RetryAfter.Seconds())))
+		}
+		http.Error(w, "injected fault", f.Status)
+		return
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// Inject makes the requests matching f fail.
+func (s *Server) Inject(f Fault) {
+	if f.Status == 0 {
+		f.Status = http.StatusInternalServerError
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes the injected faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// fault returns the fault failing r, if any.
+func (s *Server) fault(r *http.Request) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var body []byte
+	for i, f := range s.faults {
+		if f.Method != "" && f.Method != r.Method || !strings.HasPrefix(r.URL.Path, f.Path) {
+			continue
+		}
+		if f.Body != "" {
+			if body == nil {
+				body, _ = io.ReadAll(r.Body)
+				r.Body = io.NopCloser(bytes.NewReader(body))
+			}
+			if !bytes.Contains(body, []byte(f.Body)) {
+				continue
+			}
+		}
+		if f.Count > 0 {
+			if f.Count--; f.Count == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+
+	if s.opts.ErrorRate > 0 && rand.Float64() < s.opts.ErrorRate {
+		return &Fault{Status: http.StatusServiceUnavailable}
+	}
+	return nil
+}
+
+// Piece returns the content of a stored piece.
+func (s *Server) Piece(pieceCID string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pieces[pieceCID]
+	if !ok {
+		return nil, false
+	}
+	return bytes.Clone(p.data), true
+}
+
+// CorruptPiece flips a byte of a stored piece, as a provider losing data
+// would serve it.
+func (s *Server) CorruptPiece(pieceCID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pieces[pieceCID]
+	if !ok {
+		return fmt.Errorf("piece %s not found", pieceCID)
+	}
+	p.data[len(p.data)/2] ^= 0xff
+	return nil
+}
+
+// DeletePiece removes a stored piece.
+func (s *Server) DeletePiece(pieceCID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pieces, pieceCID)
+}
+
+// Roots returns the roots of a proof set.
+func (s *Server) Roots(proofSetID uint64) []Root {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ps, ok := s.proofSets[proofSetID]
+	if !ok {
+		return nil
+	}
+	return append([]Root(nil), ps.roots...)
+}
+
+// Revert makes a root addition fail on chain. Its roots are removed from the
+// proof set.
+func (s *Server) Revert(txHash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.additions[strings.ToLower(txHash)]
+	if !ok {
+		return
+	}
+	a.reverted = true
+
+	ps, ok := s.proofSets[a.proofSetID]
+	if !ok {
+		return
+	}
+	roots := ps.roots[:0]
+	for _, root := range ps.roots {
+		if root.TxHash != strings.ToLower(txHash) {
+			roots = append(roots, root)
+		}
+	}
+	ps.roots = roots
+}
+
+// MissProofs makes a proof set miss its proofs from now on, or be proven
+// again.
+func (s *Server) MissProofs(proofSetID uint64, miss bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ps, ok := s.proofSets[proofSetID]
+	if !ok {
+		return
+	}
+	if !miss {
+		ps.missFrom = 0
+	} else if ps.missFrom == 0 {
+		ps.missFrom = s.epoch()
+	}
+}
+
+// auth rejects requests without a bearer token. The token itself is not
+// verified.
+func (s *Server) auth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Server) postPiece(w http.ResponseWriter, r *http.Request) {
+	var req pdp.UploadPieceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if req.Check.Name != hashName {
+		http.Error(w, fmt.Sprintf("unsupported hash %q", req.Check.Name), http.StatusBadRequest)
+		return
+	}
+	if req.Check.Size <= 0 || req.Check.Size > maxPieceSize {
+		http.Error(w, fmt.Sprintf("invalid piece size %d", req.Check.Size), http.StatusBadRequest)
+		return
+	}
+	digest, err := hex.DecodeString(req.Check.Hash)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid hash: %v", err), http.StatusBadRequest)
+		return
+	}
+	pieceCID, err := commcid.DataCommitmentV1ToCID(digest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid hash: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.pieces[pieceCID.String()]; ok {
+		writeJSON(w, http.StatusOK, map[string]string{"pieceCID": pieceCID.String()})
+		return
+	}
+
+	id := randomHex(16)
+	s.uploads[id] = &upload{pieceCID: pieceCID, size: req.Check.Size}
+
+	w.Header().Set("Location", "/pdp/piece/upload/"+id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) putPiece(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	up, ok := s.uploads[r.PathValue("id")]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, up.size+1))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read piece: %v", err), http.StatusBadRequest)
+		return
+	}
+	if int64(len(data)) != up.size {
+		http.Error(w, fmt.Sprintf("piece size mismatch: expected %d bytes", up.size), http.StatusBadRequest)
+		return
+	}
+
+	cp := &commp.Calc{}
+	if _, err := cp.Write(data); err != nil {
+		http.Error(w, fmt.Sprintf("failed to compute commP: %v", err), http.StatusBadRequest)
+		return
+	}
+	digest, paddedSize, err := cp.Digest()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to compute commP: %v", err), http.StatusBadRequest)
+		return
+	}
+	pieceCID, err := commcid.DataCommitmentV1ToCID(digest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to compute commP: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !pieceCID.Equals(up.pieceCID) {
+		http.Error(w, fmt.Sprintf("commP mismatch: expected %s, got %s", up.pieceCID, pieceCID), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, r.PathValue("id"))
+	s.pieces[pieceCID.String()] = &piece{data: data, paddedSize: abi.PaddedPieceSize(paddedSize)}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) createProofSet(w http.ResponseWriter, r *http.Request) {
+	var req pdp.CreateProofSetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.RecordKeeper == "" {
+		http.Error(w, "recordKeeper is required", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ps := &proofSet{
+		id:           s.nextID,
+		recordKeeper: req.RecordKeeper,
+		createdAt:    s.opts.Now(),
+		nextRootID:   1,
+	}
+	s.nextID++
+	s.proofSets[ps.id] = ps
+
+	txHash := "0x" + randomHex(32)
+	s.creations[txHash] = ps
+
+	w.Header().Set("Location", "/pdp/proof-sets/created/"+txHash)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) creationStatus(w http.ResponseWriter, r *http.Request) {
+	txHash := strings.ToLower(r.PathValue("tx"))
+
+	s.mu.Lock()
+	ps, ok := s.creations[txHash]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "proof set creation not found", http.StatusNotFound)
+		return
+	}
+
+	status := pdp.ProofSetCreateStatus{
+		CreateMessageHash: txHash,
+		Service:           s.opts.Service,
+		TxStatus:          "pending",
+	}
+	if s.since(ps.createdAt) >= s.opts.CreationDelay {
+		ok := true
+		id := ps.id
+		status.TxStatus = "confirmed"
+		status.OK = &ok
+		status.ProofSetCreated = true
+		status.ProofSetID = &id
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// since returns the time elapsed since t on the clock of the server.
+func (s *Server) since(t time.Time) time.Duration {
+	return s.opts.Now().Sub(t)
+}
+
+// epoch returns the current epoch of the fake chain.
+func (s *Server) epoch() int64 {
+	return int64(s.since(s.opts.Genesis) / s.opts.EpochDuration)
+}
+
+// lastProven returns the epoch of the last challenge of a proof set that was
+// proven, or 0 if none was. Challenges fall on multiples of the proving
+// period and are proven proofDelay epochs later. The caller holds the lock.
+func (s *Server) lastProven(ps *proofSet) int64 {
+	if len(ps.roots) == 0 {
+		return 0
+	}
+
+	until := s.epoch() - proofDelay
+	if ps.missFrom > 0 {
+		until = min(until, ps.missFrom-1-proofDelay)
+	}
+	challenge := until - until%provingPeriod
+	if until < 0 || challenge <= ps.provingFrom {
+		return 0
+	}
+	return challenge
+}
+
+// nextChallenge returns the challenge a proof set has to prove next, the one
+// following its last proven challenge. Like with real providers, it stops
+// advancing while proofs are missed. The caller holds the lock.
+func (s *Server) nextChallenge(ps *proofSet) int64 {
+	last := s.lastProven(ps)
+	if last == 0 {
+		last = ps.provingFrom - ps.provingFrom%provingPeriod
+	}
+	return last + provingPeriod
+}
+
+// proofSet returns the proof set of a request, or answers 404 if there is
+// none. Proof sets are only visible once their creation landed. The caller
+// holds the lock.
+func (s *Server) proofSet(w http.ResponseWriter, r *http.Request) *proofSet {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid proof set ID", http.StatusBadRequest)
+		return nil
+	}
+
+	ps, ok := s.proofSets[id]
+	if !ok || s.since(ps.createdAt) < s.opts.CreationDelay {
+		http.Error(w, fmt.Sprintf("proof set %d not found", id), http.StatusNotFound)
+		return nil
+	}
+	return ps
+}
+
+func (s *Server) getProofSet(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ps := s.proofSet(w, r)
+	if ps == nil {
+		return
+	}
+
+	epoch := s.epoch()
+	res := pdp.ProofSet{
+		ID:              ps.id,
+		Roots:           []pdp.RootInfo{},
+		CurrentEpoch:    epoch,
+		LastProvenEpoch: s.lastProven(ps),
+		ChallengeWindow: challengeWindow,
+	}
+	if len(ps.roots) > 0 {
+		res.NextChallengeEpoch = s.nextChallenge(ps)
+	}
+	if s.opts.HideProving {
+		res.CurrentEpoch, res.LastProvenEpoch, res.ChallengeWindow = 0, 0, 0
+	}
+	for _, root := range ps.roots {
+		var offset int64
+		for _, subroot := range root.Subroots {
+			res.Roots = append(res.Roots, pdp.RootInfo{
+				RootID:        root.ID,
+				RootCID:       root.RootCID,
+				SubrootCID:    subroot,
+				SubrootOffset: offset,
+			})
+			if p, ok := s.pieces[subroot]; ok {
+				offset += int64(p.paddedSize)
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) deleteRoot(w http.ResponseWriter, r *http.Request) {
+	rootID, err := strconv.ParseUint(r.PathValue("root"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid root ID", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ps := s.proofSet(w, r)
+	if ps == nil {
+		return
+	}
+
+	for i, root := range ps.roots {
+		if root.ID == rootID {
+			ps.roots = append(ps.roots[:i], ps.roots[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	http.Error(w, fmt.Sprintf("root %d not found", rootID), http.StatusNotFound)
+}
+
+func (s *Server) addRoots(w http.ResponseWriter, r *http.Request) {
+	var req pdp.AddRootsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Roots) == 0 {
+		http.Error(w, "at least one root is required", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ps := s.proofSet(w, r)
+	if ps == nil {
+		return
+	}
+
+	// Every root is checked before any is added, so a request adds all of
+	// its roots or none.
+	for _, root := range req.Roots {
+		if status, err := s.checkRoot(root); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	if len(ps.roots) == 0 {
+		ps.provingFrom = s.epoch()
+	}
+	txHash := "0x" + randomHex(32)
+	a := &addition{
+		proofSetID:  ps.id,
+		submittedAt: s.opts.Now(),
+		epoch:       s.epoch() + int64(s.opts.ConfirmationDelay/s.opts.EpochDuration),
+	}
+	s.additions[txHash] = a
+	for _, root := range req.Roots {
+		a.rootIDs = append(a.rootIDs, ps.nextRootID)
+		added := Root{ID: ps.nextRootID, RootCID: root.RootCID, TxHash: txHash}
+		for _, subroot := range root.Subroots {
+			added.Subroots = append(added.Subroots, subroot.SubrootCID)
+		}
+		ps.nextRootID++
+		ps.roots = append(ps.roots, added)
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/pdp/proof-sets/%d/roots/added/%s", ps.id, txHash))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) additionStatus(w http.ResponseWriter, r *http.Request) {
+	txHash := strings.ToLower(r.PathValue("tx"))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.additions[txHash]
+	if !ok || strconv.FormatUint(a.proofSetID, 10) != r.PathValue("id") {
+		http.Error(w, "root addition not found", http.StatusNotFound)
+		return
+	}
+
+	status := pdp.RootAdditionStatus{
+		TxHash:     txHash,
+		TxStatus:   "pending",
+		ProofSetID: a.proofSetID,
+		RootCount:  len(a.rootIDs),
+	}
+	if s.since(a.submittedAt) >= s.opts.ConfirmationDelay {
+		ok := !a.reverted
+		status.TxStatus = "confirmed"
+		status.AddMessageOK = &ok
+		status.Epoch = a.epoch
+		if ok {
+			status.ConfirmedRootIDs = a.rootIDs
+		}
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// checkRoot verifies that the subroots of root are stored and aggregate to
+// its CID. It returns the status to answer if not.
+func (s *Server) checkRoot(root pdp.RootEntry) (int, error) {
+	if len(root.Subroots) == 0 {
+		return http.StatusBadRequest, fmt.Errorf("root %s has no subroots", root.RootCID)
+	}
+
+	pieces := make([]abi.PieceInfo, 0, len(root.Subroots))
+	for _, subroot := range root.Subroots {
+		p, ok := s.pieces[subroot.SubrootCID]
+		if !ok {
+			return http.StatusNotFound, fmt.Errorf("subroot %s not found", subroot.SubrootCID)
+		}
+		c, err := cid.Decode(subroot.SubrootCID)
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("invalid subroot CID %s: %v", subroot.SubrootCID, err)
+		}
+		pieces = append(pieces, abi.PieceInfo{Size: p.paddedSize, PieceCID: c})
+	}
+
+	rootCID, err := nonffi.GenerateUnsealedCID(abi.RegisteredSealProof_StackedDrg64GiBV1_1, pieces)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("failed to compute root of %s: %v", root.RootCID, err)
+	}
+	if rootCID.String() != root.RootCID {
+		return http.StatusBadRequest, fmt.Errorf("root mismatch: subroots aggregate to %s, not %s", rootCID, root.RootCID)
+	}
+
+	return 0, nil
+}
+
+func (s *Server) getPiece(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	p, ok := s.pieces[r.PathValue("cid")]
+	var data []byte
+	if ok {
+		data = bytes.Clone(p.data)
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "piece not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if s.opts.IgnoreRanges {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,129 @@
+package pdp
+
+// CreateProofSetRequest is the request to create a proof set.
+type CreateProofSetRequest struct {
+	// RecordKeeper is the address of the contract keeping the records of the
+	// proof set.
+	RecordKeeper string `json:"recordKeeper"`
+	// ExtraData is passed to the record keeper as a 0x-prefixed hex string.
+	ExtraData string `json:"extraData,omitempty"`
+}
+
+// CreateProofSetResponse is the answer to a proof set creation.
+type CreateProofSetResponse struct {
+	// Location is the URL path to poll for the creation status.
+	Location string
+	// TxHash is the hash of the creation message.
+	TxHash string
+}
+
+// ProofSetCreateStatus is the status of a proof set creation.
+type ProofSetCreateStatus struct {
+	CreateMessageHash string `json:"createMessageHash"`
+	ProofSetCreated   bool   `json:"proofsetCreated"`
+	Service           string `json:"service"`
+	TxStatus          string `json:"txStatus"`
+	// OK is nil while the message is pending and reports its success once
+	// it landed on chain.
+	OK *bool `json:"ok"`
+	// ProofSetID is set once the proof set is created.
+	ProofSetID *uint64 `json:"proofSetId,omitempty"`
+}
+
+// SubrootEntry is a piece aggregated into a root.
+type SubrootEntry struct {
+	SubrootCID string `json:"subrootCid"`
+}
+
+// RootEntry is a root to add to a proof set together with its subroots.
+type RootEntry struct {
+	RootCID  string         `json:"rootCid"`
+	Subroots []SubrootEntry `json:"subroots"`
+}
+
+// AddRootsRequest is the request to add roots to a proof set.
+type AddRootsRequest struct {
+	Roots []RootEntry `json:"roots"`
+	// ExtraData is passed to the record keeper as a 0x-prefixed hex string.
+	ExtraData string `json:"extraData,omitempty"`
+}
+
+// AddRootsResponse is the answer to a root addition.
+type AddRootsResponse struct {
+	// Location is the URL path to poll for the addition status, empty if
+	// the service does not provide one.
+	Location string
+	// TxHash is the hash of the message adding the roots, empty if the
+	// service does not report it.
+	TxHash string
+}
+
+// RootAdditionStatus is the status of a root addition.
+type RootAdditionStatus struct {
+	TxHash     string `json:"txHash"`
+	TxStatus   string `json:"txStatus"`
+	ProofSetID uint64 `json:"proofSetId"`
+	RootCount  int    `json:"rootCount"`
+	// AddMessageOK is nil while the message is pending and reports its
+	// success once it landed on chain.
+	AddMessageOK *bool `json:"addMessageOk"`
+	// ConfirmedRootIDs are the IDs assigned to the roots in the order they
+	// were sent, once the addition is confirmed.
+	ConfirmedRootIDs []uint64 `json:"confirmedRootIds,omitempty"`
+	// Epoch is the epoch the message landed at, 0 if the service does not
+	// report it.
+	Epoch int64 `json:"epoch,omitempty"`
+}
+
+// PieceCheck identifies a piece by the hash of its content.
+type PieceCheck struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// UploadPieceRequest is the request to upload a piece.
+type UploadPieceRequest struct {
+	Check PieceCheck `json:"check"`
+	// Notify is an optional URL notified once the piece is stored.
+	Notify string `json:"notify,omitempty"`
+}
+
+// UploadPieceResponse is the outcome of a piece upload.
+type UploadPieceResponse struct {
+	// Existed reports that the service already held the piece, in which
+	// case its content was not sent again.
+	Existed bool
+	// PieceCID is the CID of an existing piece.
+	PieceCID string `json:"pieceCID"`
+}
+
+// ProofSet is a proof set and its roots.
+type ProofSet struct {
+	ID uint64 `json:"id"`
+	// NextChallengeEpoch is the epoch of the next proof, or 0 when the proof
+	// set has no roots to prove.
+	NextChallengeEpoch int64 `json:"nextChallengeEpoch"`
+	// Roots holds an entry per subroot of every root.
+	Roots []RootInfo `json:"roots"`
+
+	// The proving state below is only reported by providers exposing it,
+	// and is zero otherwise.
+
+	// CurrentEpoch is the chain head seen by the provider.
+	CurrentEpoch int64 `json:"currentEpoch,omitempty"`
+	// LastProvenEpoch is the challenge epoch of the last accepted proof, 0
+	// if none was accepted yet.
+	LastProvenEpoch int64 `json:"lastProvenEpoch,omitempty"`
+	// ChallengeWindow is the number of epochs after a challenge within
+	// which its proof must land.
+	ChallengeWindow int64 `json:"challengeWindow,omitempty"`
+}
+
+// RootInfo is a subroot of a root in a proof set.
+type RootInfo struct {
+	RootID        uint64 `json:"rootId"`
+	RootCID       string `json:"rootCid"`
+	SubrootCID    string `json:"subrootCid"`
+	SubrootOffset int64  `json:"subrootOffset"`
+}
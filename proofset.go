@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v3"
+
+	"github.com/ipfs-force-community/ark-eternal/database"
+	"github.com/ipfs-force-community/ark-eternal/pdp"
+	"github.com/ipfs-force-community/ark-eternal/service"
+)
+
+func proofSetCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "proof-set",
+		Usage: "Manage proof sets on the PDP service",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "provider",
+				Usage: "Name of the provider in the providers file, the first one if empty",
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "create",
+				Usage: "Create a proof set and print the hash of its creation message",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "extra_data",
+						Usage: "Hex encoded data passed to the record keeper",
+					},
+				},
+				Action: createProofSet,
+			},
+			{
+				Name:      "status",
+				Usage:     "Show the status of a proof set creation",
+				ArgsUsage: "<txHash>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "wait",
+						Usage: "Poll until the proof set ID is known",
+					},
+					&cli.DurationFlag{
+						Name:  "interval",
+						Value: 5 * time.Second,
+						Usage: "Polling interval of --wait",
+					},
+				},
+				Action: proofSetStatus,
+			},
+			{
+				Name:      "show",
+				Usage:     "Show the roots and proving status of a proof set",
+				ArgsUsage: "<id>",
+				Action:    showProofSet,
+			},
+			{
+				Name:      "remove-roots",
+				Usage:     "Remove roots from a proof set of the provider and mark their files as removed once no other provider holds them",
+				ArgsUsage: "<id> <rootID>...",
+				Action:    removeRoots,
+			},
+		},
+	}
+}
+
+// proofSetProvider returns the provider the proof-set commands act on, given
+// by --provider, along with the name of the primary provider.
+func proofSetProvider(cmd *cli.Command) (*service.Provider, string, error) {
+	privateKey, err := service.LoadPrivateKey(cmd.String("private_key_path"))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load private key: %w", err)
+	}
+
+	providers, err := loadProviders(cmd, privateKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load providers: %w", err)
+	}
+
+	name := cmd.String("provider")
+	if name == "" {
+		return providers[0], providers[0].Name, nil
+	}
+	for _, p := range providers {
+		if p.Name == name {
+			return p, providers[0].Name, nil
+		}
+	}
+	return nil, "", fmt.Errorf("unknown provider: %q", name)
+}
+
+func createProofSet(ctx context.Context, cmd *cli.Command) error {
+	p, _, err := proofSetProvider(cmd)
+	if err != nil {
+		return err
+	}
+
+	res, err := p.Client.CreateProofSet(ctx, &pdp.CreateProofSetRequest{
+		RecordKeeper: p.ProofSets.RecordKeeper,
+		ExtraData:    cmd.String("extra_data"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create proof set: %w", err)
+	}
+
+	fmt.Printf("Proof set creation initiated with transaction hash: %s\n", res.TxHash)
+	fmt.Printf("Run \"proof-set status %s --wait\" to wait for its ID.\n", res.TxHash)
+	return nil
+}
+
+func proofSetStatus(ctx context.Context, cmd *cli.Command) error {
+	txHash := cmd.Args().First()
+	if txHash == "" {
+		return fmt.Errorf("transaction hash is required")
+	}
+
+	p, _, err := proofSetProvider(cmd)
+	if err != nil {
+		return err
+	}
+
+	for {
+		status, err := p.Client.GetProofSetCreateStatus(ctx, txHash)
+		if err != nil {
+			return fmt.Errorf("failed to get proof set status: %w", err)
+		}
+
+		fmt.Printf("Transaction status: %s\n", status.TxStatus)
+		if status.OK != nil && !*status.OK {
+			return fmt.Errorf("proof set creation failed")
+		}
+		if status.ProofSetID != nil {
+			fmt.Printf("Proof set ID: %d\n", *status.ProofSetID)
+			return nil
+		}
+		if !cmd.Bool("wait") {
+			fmt.Println("Proof set is not created yet.")
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(cmd.Duration("interval")):
+		}
+	}
+}
+
+func showProofSet(ctx context.Context, cmd *cli.Command) error {
+	id, err := strconv.ParseUint(cmd.Args().First(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid proof set ID: %q", cmd.Args().First())
+	}
+
+	p, _, err := proofSetProvider(cmd)
+	if err != nil {
+		return err
+	}
+
+	ps, err := p.Client.GetProofSet(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to get proof set: %w", err)
+	}
+
+	// The files of the roots are looked up in the local database, if any, to
+	// show what each root holds.
+	files := make(map[string]database.FileInfo)
+	if _, err := os.Stat(cmd.String("db_path")); err == nil {
+		db, err := database.InitDB(cmd.String("db_path"))
+		if err != nil {
+			return fmt.Errorf("failed to initialize database: %w", err)
+		}
+		fileInfos, err := database.QueryFilesByProofSet(db, p.Name, int(id))
+		if err != nil {
+			return fmt.Errorf("failed to query files: %w", err)
+		}
+		for _, fileInfo := range fileInfos {
+			files[fileInfo.Root] = fileInfo
+		}
+	}
+
+	fmt.Printf("Proof set ID: %d\n", ps.ID)
+	if ps.NextChallengeEpoch > 0 {
+		fmt.Printf("Next challenge epoch: %d\n", ps.NextChallengeEpoch)
+	} else {
+		fmt.Println("Next challenge epoch: none, the proof set is not proving")
+	}
+
+	var rootIDs []uint64
+	subroots := make(map[uint64][]pdp.RootInfo)
+	for _, root := range ps.Roots {
+		if _, ok := subroots[root.RootID]; !ok {
+			rootIDs = append(rootIDs, root.RootID)
+		}
+		subroots[root.RootID] = append(subroots[root.RootID], root)
+	}
+
+	fmt.Printf("Roots: %d\n", len(rootIDs))
+	for _, rootID := range rootIDs {
+		root := subroots[rootID][0]
+		fmt.Printf("  %d  %s", rootID, root.RootCID)
+		if fileInfo, ok := files[root.RootCID]; ok {
+			fmt.Printf("  %s (%s)", fileInfo.FileName, fileInfo.Status)
+		}
+		fmt.Println()
+		for _, subroot := range subroots[rootID] {
+			fmt.Printf("      %s @ %d\n", subroot.SubrootCID, subroot.SubrootOffset)
+		}
+	}
+
+	return nil
+}
+
+func removeRoots(ctx context.Context, cmd *cli.Command) error {
+	args := cmd.Args().Slice()
+	if len(args) < 2 {
+		return fmt.Errorf("a proof set ID and at least one root ID are required")
+	}
+
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid proof set ID: %q", args[0])
+	}
+
+	var rootIDs []uint64
+	for _, arg := range args[1:] {
+		for _, s := range strings.Split(arg, ",") {
+			rootID, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid root ID: %q", s)
+			}
+			rootIDs = append(rootIDs, rootID)
+		}
+	}
+
+	db, err := database.InitDB(cmd.String("db_path"))
+	if err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+
+	p, primary, err := proofSetProvider(cmd)
+	if err != nil {
+		return err
+	}
+
+	// Files stored before replicas were recorded are held by the primary
+	// provider, and their replicas are needed to mark them.
+	if _, err := database.BackfillReplicas(db, primary); err != nil {
+		return fmt.Errorf("failed to record replicas of existing files: %w", err)
+	}
+
+	// The root CIDs are needed to find the files, and cannot be retrieved
+	// once the roots are removed.
+	ps, err := p.Client.GetProofSet(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to get proof set: %w", err)
+	}
+	rootCIDs := make(map[uint64]string)
+	for _, root := range ps.Roots {
+		rootCIDs[root.RootID] = root.RootCID
+	}
+
+	for _, rootID := range rootIDs {
+		if _, ok := rootCIDs[rootID]; !ok {
+			return fmt.Errorf("root %d is not in proof set %d", rootID, id)
+		}
+	}
+
+	for _, rootID := range rootIDs {
+		if err := p.Client.DeleteRoot(ctx, id, rootID); err != nil {
+			return fmt.Errorf("failed to remove root %d: %w", rootID, err)
+		}
+
+		replicas, files, err := database.MarkRootsRemoved(db, p.Name, int(id), []string{rootCIDs[rootID]})
+		if err != nil {
+			return fmt.Errorf("failed to mark files of root %d as removed: %w", rootID, err)
+		}
+		fmt.Printf("Removed root %d (%s) from %s, %d replicas and %d files marked as removed\n", rootID, rootCIDs[rootID], p.Name, replicas, files)
+	}
+
+	return nil
+}
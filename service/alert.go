@@ -0,0 +1,76 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// alertTimeout bounds the delivery of an alert to the webhook.
+const alertTimeout = 10 * time.Second
+
+// Alert reports a proof set of a provider missing a proof.
+type Alert struct {
+	Provider       string    `json:"provider"`
+	ProofSetID     int       `json:"proof_set_id"`
+	ChallengeEpoch int64     `json:"challenge_epoch"`
+	CurrentEpoch   int64     `json:"current_epoch"`
+	Faults         int       `json:"faults"`
+	Roots          []string  `json:"roots"`
+	Message        string    `json:"message"`
+	Time           time.Time `json:"time"`
+}
+
+// alerter logs alerts and posts them as JSON to a webhook, if one is
+// configured.
+type alerter struct {
+	webhook string
+	client  *http.Client
+}
+
+func newAlerter(webhook string) *alerter {
+	return &alerter{
+		webhook: webhook,
+		client:  &http.Client{Timeout: alertTimeout},
+	}
+}
+
+func (a *alerter) alert(ctx context.Context, alert *Alert) {
+	slog.Error("proof missed", "provider", alert.Provider, "proof_set_id", alert.ProofSetID,
+		"challenge_epoch", alert.ChallengeEpoch, "faults", alert.Faults, "roots", len(alert.Roots))
+
+	if a.webhook == "" {
+		return
+	}
+	if err := a.post(ctx, alert); err != nil {
+		slog.Error("failed to deliver alert", "webhook", a.webhook, "error", err)
+	}
+}
+
+func (a *alerter) post(ctx context.Context, alert *Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.webhook, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
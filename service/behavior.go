@@ -0,0 +1,343 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+)
+
+// Behavior is a step run on a loaded page before it is serialised, such as
+// scrolling to trigger lazy loading or dismissing a cookie banner.
+//
+// Run is called with a chromedp executor context, so chromedp actions can be
+// executed directly with their Do method.
+type Behavior interface {
+	Run(ctx context.Context) error
+}
+
+// BehaviorFactory builds a behavior from its JSON parameters.
+type BehaviorFactory func(params json.RawMessage) (Behavior, error)
+
+var (
+	behaviorsMu sync.RWMutex
+	behaviors   = map[string]BehaviorFactory{
+		"scroll":  newScrollBehavior,
+		"click":   newClickBehavior,
+		"consent": newConsentBehavior,
+		"script":  newScriptBehavior,
+	}
+)
+
+// RegisterBehavior makes a behavior available to capture profiles under the
+// given type name. Registering an existing name replaces it.
+func RegisterBehavior(name string, factory BehaviorFactory) {
+	behaviorsMu.Lock()
+	defer behaviorsMu.Unlock()
+
+	behaviors[name] = factory
+}
+
+// BehaviorConfig selects a behavior in a capture profile.
+type BehaviorConfig struct {
+	Type string `json:"type"`
+	// Match restricts the behavior to resource URLs matching the regular
+	// expression, which allows site-specific behaviors.
+	Match  string          `json:"match,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+
+	behavior Behavior
+	match    *regexp.Regexp
+}
+
+// build resolves the behavior type and parses its parameters.
+func (bc *BehaviorConfig) build() error {
+	behaviorsMu.RLock()
+	factory, ok := behaviors[bc.Type]
+	behaviorsMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown behavior: %s", bc.Type)
+	}
+
+	if bc.Match != "" {
+		match, err := regexp.Compile(bc.Match)
+		if err != nil {
+			return fmt.Errorf("invalid match of behavior %s: %v", bc.Type, err)
+		}
+		bc.match = match
+	}
+
+	b, err := factory(bc.Params)
+	if err != nil {
+		return fmt.Errorf("invalid params of behavior %s: %v", bc.Type, err)
+	}
+	bc.behavior = b
+
+	return nil
+}
+
+type activityKey struct{}
+
+// WaitForNetworkIdle blocks until the page has had no request in flight for
+// the quiet period, or until timeout has passed. Reaching the timeout is not
+// an error, as pages with long-polling connections never become idle.
+func WaitForNetworkIdle(ctx context.Context, quiet, timeout time.Duration) error {
+	activity, ok := ctx.Value(activityKey{}).(*networkActivity)
+	if !ok {
+		return chromedp.Sleep(quiet).Do(ctx)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := activity.waitIdle(waitCtx, quiet)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil
+	}
+	return err
+}
+
+// runBehaviors returns the action that runs the profile's behaviors matching
+// the resource URL in order. A failing behavior is logged and skipped so that
+// the page can still be captured.
+func (cs *captureSession) runBehaviors() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		ctx = context.WithValue(ctx, activityKey{}, cs.activity)
+		for _, bc := range cs.profile.Behaviors {
+			if bc.match != nil && !bc.match.MatchString(cs.resourceURL) {
+				continue
+			}
+
+			if err := bc.behavior.Run(ctx); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				slog.Warn("capture behavior failed", "behavior", bc.Type, "url", cs.resourceURL, "error", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func decodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 {
+		return nil
+	}
+	return json.Unmarshal(params, v)
+}
+
+// scrollBehavior scrolls to the bottom of the page in steps so that lazy
+// loaded content and infinite feeds are fetched.
+type scrollBehavior struct {
+	Step     int64    `json:"step"`
+	Delay    Duration `json:"delay"`
+	MaxSteps int      `json:"max_steps"`
+	// Idle is the network quiet period awaited after every step.
+	Idle Duration `json:"idle"`
+	// IdleTimeout bounds the wait for network quiescence after every step.
+	IdleTimeout Duration `json:"idle_timeout"`
+	// ScrollBack scrolls back to the top once the bottom has been reached.
+	ScrollBack *bool `json:"scroll_back"`
+}
+
+func newScrollBehavior(params json.RawMessage) (Behavior, error) {
+	b := &scrollBehavior{
+		Delay:       Duration(250 * time.Millisecond),
+		MaxSteps:    100,
+		Idle:        Duration(defaultNetworkIdle),
+		IdleTimeout: Duration(5 * time.Second),
+	}
+	if err := decodeParams(params, b); err != nil {
+		return nil, err
+	}
+	if b.MaxSteps <= 0 {
+		return nil, fmt.Errorf("max_steps must be positive")
+	}
+	return b, nil
+}
+
+// Run implements Behavior.
+func (b *scrollBehavior) Run(ctx context.Context) error {
+	// A step of zero scrolls by one viewport height.
+	script := fmt.Sprintf(`(() => {
+		const el = document.scrollingElement || document.documentElement;
+		window.scrollBy(0, %d || window.innerHeight);
+		return { bottom: window.scrollY + window.innerHeight, height: el.scrollHeight };
+	})()`, b.Step)
+
+	var res struct {
+		Bottom float64 `json:"bottom"`
+		Height float64 `json:"height"`
+	}
+	stable := 0
+	for step := 0; step < b.MaxSteps; step++ {
+		prevHeight := res.Height
+		if err := chromedp.Evaluate(script, &res).Do(ctx); err != nil {
+			return fmt.Errorf("failed to scroll: %v", err)
+		}
+
+		if err := chromedp.Sleep(time.Duration(b.Delay)).Do(ctx); err != nil {
+			return err
+		}
+		if err := WaitForNetworkIdle(ctx, time.Duration(b.Idle), time.Duration(b.IdleTimeout)); err != nil {
+			return err
+		}
+
+		// The bottom is only final once loading more content stops
+		// growing the page.
+		if res.Bottom >= res.Height && res.Height == prevHeight {
+			stable++
+			if stable >= 2 {
+				break
+			}
+		} else {
+			stable = 0
+		}
+	}
+
+	if b.ScrollBack == nil || *b.ScrollBack {
+		return chromedp.Evaluate(`window.scrollTo(0, 0)`, nil).Do(ctx)
+	}
+	return nil
+}
+
+// clickBehavior clicks the elements matching the configured selectors, e.g.
+// "show more" buttons, until they disappear or the click limit is reached.
+type clickBehavior struct {
+	Selectors []string `json:"selectors"`
+	MaxClicks int      `json:"max_clicks"`
+	Idle      Duration `json:"idle"`
+	// IdleTimeout bounds the wait for network quiescence after every click.
+	IdleTimeout Duration `json:"idle_timeout"`
+}
+
+func newClickBehavior(params json.RawMessage) (Behavior, error) {
+	b := &clickBehavior{
+		MaxClicks:   1,
+		Idle:        Duration(defaultNetworkIdle),
+		IdleTimeout: Duration(5 * time.Second),
+	}
+	if err := decodeParams(params, b); err != nil {
+		return nil, err
+	}
+	if len(b.Selectors) == 0 {
+		return nil, fmt.Errorf("at least one selector is required")
+	}
+	return b, nil
+}
+
+// Run implements Behavior.
+func (b *clickBehavior) Run(ctx context.Context) error {
+	for _, selector := range b.Selectors {
+		for i := 0; i < b.MaxClicks; i++ {
+			clicked, err := clickVisible(ctx, selector)
+			if err != nil {
+				return err
+			}
+			if !clicked {
+				break
+			}
+
+			if err := WaitForNetworkIdle(ctx, time.Duration(b.Idle), time.Duration(b.IdleTimeout)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// clickVisible clicks the first visible element matching selector and
+// reports whether one was found.
+func clickVisible(ctx context.Context, selector string) (bool, error) {
+	sel, err := json.Marshal(selector)
+	if err != nil {
+		return false, err
+	}
+
+	script := fmt.Sprintf(`(() => {
+		const el = Array.from(document.querySelectorAll(%s))
+			.find(e => e.offsetParent !== null || e.getClientRects().length > 0);
+		if (!el) return false;
+		el.scrollIntoView({ block: "center" });
+		el.click();
+		return true;
+	})()`, sel)
+
+	var clicked bool
+	if err := chromedp.Evaluate(script, &clicked).Do(ctx); err != nil {
+		return false, fmt.Errorf("failed to click %s: %v", selector, err)
+	}
+	return clicked, nil
+}
+
+// defaultConsentSelectors match the accept buttons of widespread cookie
+// consent managers.
+var defaultConsentSelectors = []string{
+	"#onetrust-accept-btn-handler",
+	"#CybotCookiebotDialogBodyLevelButtonLevelOptinAllowAll",
+	"#didomi-notice-agree-button",
+	".qc-cmp2-summary-buttons button[mode='primary']",
+	"button.fc-cta-consent",
+	"button[data-testid='uc-accept-all-button']",
+	"#truste-consent-button",
+	".cc-btn.cc-allow",
+}
+
+// newConsentBehavior builds a click behavior that dismisses cookie consent
+// banners. Configured selectors are tried before the built-in ones.
+func newConsentBehavior(params json.RawMessage) (Behavior, error) {
+	b := &clickBehavior{
+		MaxClicks:   1,
+		Idle:        Duration(defaultNetworkIdle),
+		IdleTimeout: Duration(3 * time.Second),
+	}
+	if err := decodeParams(params, b); err != nil {
+		return nil, err
+	}
+	b.Selectors = append(b.Selectors, defaultConsentSelectors...)
+	return b, nil
+}
+
+// scriptBehavior evaluates a site-specific JavaScript snippet. A snippet
+// returning a promise is awaited.
+type scriptBehavior struct {
+	Source string   `json:"source"`
+	Idle   Duration `json:"idle"`
+	// IdleTimeout bounds the wait for network quiescence after the script.
+	IdleTimeout Duration `json:"idle_timeout"`
+}
+
+func newScriptBehavior(params json.RawMessage) (Behavior, error) {
+	b := &scriptBehavior{
+		Idle:        Duration(defaultNetworkIdle),
+		IdleTimeout: Duration(5 * time.Second),
+	}
+	if err := decodeParams(params, b); err != nil {
+		return nil, err
+	}
+	if b.Source == "" {
+		return nil, fmt.Errorf("source is required")
+	}
+	return b, nil
+}
+
+// Run implements Behavior.
+func (b *scriptBehavior) Run(ctx context.Context) error {
+	err := chromedp.Evaluate(b.Source, nil, func(p *runtime.EvaluateParams) *runtime.EvaluateParams {
+		return p.WithAwaitPromise(true)
+	}).Do(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to run script: %v", err)
+	}
+
+	return WaitForNetworkIdle(ctx, time.Duration(b.Idle), time.Duration(b.IdleTimeout))
+}
@@ -0,0 +1,422 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+)
+
+// captureFormat selects how a resource is serialised before it is stored.
+type captureFormat string
+
+const (
+	// formatAuto fetches the resource verbatim over HTTP unless it is an HTML
+	// document, which is rendered and stored as formatHTML.
+	formatAuto captureFormat = "auto"
+	// formatRaw stores the bytes of the resource verbatim, fetched without a
+	// browser.
+	formatRaw captureFormat = "raw"
+	// formatHTML stores the rendered HTML of the page.
+	formatHTML captureFormat = "html"
+	// formatWARC stores every network exchange of the capture as WARC/1.1 records.
+	formatWARC captureFormat = "warc"
+	// formatSingleFile stores the rendered HTML with every subresource inlined.
+	formatSingleFile captureFormat = "singlefile"
+	// formatMHTML stores the page and its resources as a MHTML archive.
+	formatMHTML captureFormat = "mhtml"
+	// formatWACZ stores a WARC capture packaged as a signed WACZ collection.
+	formatWACZ captureFormat = "wacz"
+)
+
+func parseCaptureFormat(s string) (captureFormat, error) {
+	switch f := captureFormat(strings.ToLower(s)); f {
+	case "":
+		return formatAuto, nil
+	case formatAuto, formatRaw, formatHTML, formatWARC, formatSingleFile, formatMHTML, formatWACZ:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unsupported capture format: %s", s)
+	}
+}
+
+// contentType returns the MIME type a capture in this format is served with.
+func (f captureFormat) contentType() string {
+	switch f {
+	case formatWARC:
+		return warcContentType
+	case formatMHTML:
+		return "multipart/related"
+	case formatWACZ:
+		return waczContentType
+	case formatRaw:
+		return "application/octet-stream"
+	default:
+		return "text/html"
+	}
+}
+
+// renditionFormat selects an additional visual rendition produced alongside
+// the primary capture.
+type renditionFormat string
+
+const (
+	// renditionPNG is a full-page PNG screenshot.
+	renditionPNG renditionFormat = "png"
+	// renditionPDF is a print-to-PDF rendition of the page.
+	renditionPDF renditionFormat = "pdf"
+)
+
+func parseRenditions(ss []string) ([]renditionFormat, error) {
+	renditions := make([]renditionFormat, 0, len(ss))
+	seen := make(map[renditionFormat]bool)
+	for _, s := range ss {
+		r := renditionFormat(strings.ToLower(s))
+		switch r {
+		case renditionPNG, renditionPDF:
+		default:
+			return nil, fmt.Errorf("unsupported rendition: %s", s)
+		}
+
+		if !seen[r] {
+			seen[r] = true
+			renditions = append(renditions, r)
+		}
+	}
+
+	return renditions, nil
+}
+
+// renditionContentType returns the MIME type a rendition is served with.
+func renditionContentType(r renditionFormat) string {
+	switch r {
+	case renditionPNG:
+		return "image/png"
+	case renditionPDF:
+		return "application/pdf"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// captureResult is the output of a single capture session. It must be closed
+// to release the spooled content.
+type captureResult struct {
+	// format is the format the content was stored in, which is only known
+	// after sniffing for formatAuto.
+	format     captureFormat
+	content    contentSource
+	mimeType   string
+	headers    http.Header
+	renditions map[renditionFormat][]byte
+}
+
+// Close releases the content of the result.
+func (r *captureResult) Close() error {
+	if c, ok := r.content.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// captureSession is a single page load in a browser tab.
+type captureSession struct {
+	// ctx bounds the whole capture, including requests made outside the browser.
+	ctx         context.Context
+	chromeCtx   context.Context
+	resourceURL string
+	profile     *CaptureProfile
+	activity    *networkActivity
+}
+
+// load returns the actions that emulate the profile's device, navigate to the
+// resource, wait until the page is ready according to the profile and run the
+// profile's behaviors.
+func (cs *captureSession) load() chromedp.Action {
+	return chromedp.Tasks{
+		cs.profile.emulate(),
+		chromedp.Navigate(cs.resourceURL),
+		cs.profile.wait(cs.activity),
+		cs.runBehaviors(),
+	}
+}
+
+func (s *Service) downloadContent(ctx context.Context, resourceURL, fileName string, format captureFormat, renditions []renditionFormat, profile *CaptureProfile) (*captureResult, error) {
+	slog.Info("Downloading content from resource URL", "url", resourceURL, "format", format, "profile", profile.Name)
+	// 1. Create Chromedp context with timeout
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(profile.Timeout))
+	defer cancel()
+
+	if format == formatAuto || format == formatRaw {
+		res, isHTML, err := fetchRaw(ctx, resourceURL, profile, format == formatAuto)
+		if err != nil {
+			return nil, err
+		}
+		if !isHTML {
+			if len(renditions) > 0 {
+				res.body.Close()
+				return nil, fmt.Errorf("renditions are not supported for %s resources", res.mimeType)
+			}
+			return &captureResult{
+				format:   formatRaw,
+				content:  res.body,
+				mimeType: res.mimeType,
+				headers:  res.headers,
+			}, nil
+		}
+		format = formatHTML
+	}
+
+	chromeCtx, release, err := s.browserTab(ctx, profile)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	cs := &captureSession{
+		ctx:         ctx,
+		chromeCtx:   chromeCtx,
+		resourceURL: resourceURL,
+		profile:     profile,
+		activity:    newNetworkActivity(),
+	}
+	cs.activity.listen(chromeCtx)
+
+	var content []byte
+	switch format {
+	case formatWARC:
+		content, err = captureWARC(cs, fileName)
+	case formatSingleFile:
+		content, err = captureSingleFile(cs)
+	case formatMHTML:
+		content, err = captureMHTML(cs)
+	case formatWACZ:
+		content, err = captureWACZ(cs, s.privateKey)
+	default:
+		content, err = captureHTML(cs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &captureResult{
+		format:     format,
+		content:    bytes.NewReader(content),
+		mimeType:   format.contentType(),
+		renditions: make(map[renditionFormat][]byte, len(renditions)),
+	}
+	// Renditions reuse the page that is still loaded in the same session, so
+	// they show exactly the state that was serialised above.
+	for _, r := range renditions {
+		data, err := captureRendition(chromeCtx, r)
+		if err != nil {
+			return nil, err
+		}
+		result.renditions[r] = data
+	}
+
+	slog.Info("Content downloaded successfully", "length", len(content), "format", format, "renditions", len(renditions))
+	return result, nil
+}
+
+// browserTab returns a chromedp context for the capture. Profiles that can
+// share a browser borrow a tab from the pool, the others get a dedicated
+// browser process configured for them.
+func (s *Service) browserTab(ctx context.Context, profile *CaptureProfile) (context.Context, func(), error) {
+	if s.pool != nil && !profile.needsDedicatedBrowser() {
+		return s.pool.acquire(ctx)
+	}
+
+	allocCtx, allocCancel := chromedp.NewExecAllocator(ctx, profile.allocatorOptions()...)
+	chromeCtx, chromeCancel := chromedp.NewContext(allocCtx)
+	return chromeCtx, func() {
+		chromeCancel()
+		allocCancel()
+	}, nil
+}
+
+func captureRendition(chromeCtx context.Context, r renditionFormat) ([]byte, error) {
+	var data []byte
+	var action chromedp.Action
+	switch r {
+	case renditionPNG:
+		// A quality of 100 makes chromedp capture a PNG instead of a JPEG.
+		action = chromedp.FullScreenshot(&data, 100)
+	case renditionPDF:
+		action = chromedp.ActionFunc(func(ctx context.Context) error {
+			var err error
+			data, _, err = page.PrintToPDF().WithPrintBackground(true).Do(ctx)
+			return err
+		})
+	default:
+		return nil, fmt.Errorf("unsupported rendition: %s", r)
+	}
+
+	if err := chromedp.Run(chromeCtx, action); err != nil {
+		return nil, fmt.Errorf("failed to capture %s rendition: %v", r, err)
+	}
+
+	return data, nil
+}
+
+func captureHTML(cs *captureSession) ([]byte, error) {
+	// 2. Use Chromedp to fetch rendered HTML
+	var htmlContent string
+	err := chromedp.Run(cs.chromeCtx,
+		cs.load(),                                // Wait for page load
+		chromedp.OuterHTML("html", &htmlContent), // Get full HTML
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render page with chromedp: %v", err)
+	}
+
+	return normalizeHTML(htmlContent)
+}
+
+// normalizeHTML re-serialises rendered HTML through goquery.
+func normalizeHTML(htmlContent string) ([]byte, error) {
+	// 4. Use goquery to parse HTML (since Colly doesn't have ParseHTML)
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(htmlContent))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HTML with goquery: %v", err)
+	}
+
+	// 5. Save HTML to file
+	html, err := doc.Html()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get HTML content: %v", err)
+	}
+
+	return []byte(html), nil
+}
+
+// warcCapture is a WARC file produced by a capture together with the data
+// needed to package it.
+type warcCapture struct {
+	warc      []byte
+	index     []warcIndexEntry
+	pageURL   string
+	title     string
+	startedAt time.Time
+}
+
+// captureWARC renders the page while recording every network exchange the
+// browser makes, and serialises them together with the rendered DOM as a
+// WARC/1.1 file named fileName.
+func captureWARC(cs *captureSession, fileName string) ([]byte, error) {
+	wc, err := recordWARC(cs, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return wc.warc, nil
+}
+
+// recordWARC loads the page and records it as a WARC file. fileName is the
+// name the warcinfo record gives the file.
+func recordWARC(cs *captureSession, fileName string) (*warcCapture, error) {
+	resourceURL := cs.resourceURL
+	recorder := newNetworkRecorder()
+	recorder.listen(cs.chromeCtx)
+
+	wc := &warcCapture{startedAt: time.Now().UTC()}
+	var htmlContent string
+	err := chromedp.Run(cs.chromeCtx,
+		cs.load(),
+		chromedp.OuterHTML("html", &htmlContent),
+		chromedp.Location(&wc.pageURL),
+		chromedp.Title(&wc.title),
+		recorder.fetchBodies(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to capture page with chromedp: %v", err)
+	}
+
+	exchanges := recorder.snapshot()
+	if err := wc.write(fileName, resourceURL, exchanges, htmlContent); err != nil {
+		return nil, err
+	}
+
+	slog.Info("WARC capture completed", "url", resourceURL, "exchanges", len(exchanges))
+	return wc, nil
+}
+
+// write serialises the recorded exchanges and the rendered DOM of
+// resourceURL into wc.warc and indexes the replayable records.
+func (wc *warcCapture) write(fileName, resourceURL string, exchanges []networkExchange, htmlContent string) error {
+	var buf bytes.Buffer
+	ww := newWARCWriter(&buf)
+	if err := ww.writeWarcinfo(fileName, []warcField{{"isPartOf", resourceURL}}); err != nil {
+		return err
+	}
+
+	for i := range exchanges {
+		if err := ww.writeExchange(&exchanges[i]); err != nil {
+			return fmt.Errorf("failed to write WARC records for %s: %v", exchanges[i].url, err)
+		}
+	}
+
+	if err := ww.writeResource("urn:dom:"+resourceURL, "text/html", []byte(htmlContent)); err != nil {
+		return fmt.Errorf("failed to write rendered DOM record: %v", err)
+	}
+
+	wc.warc = buf.Bytes()
+	wc.index = ww.index
+	return nil
+}
+
+// captureSingleFile renders the page and produces a self-contained HTML
+// document whose subresources are embedded, so the snapshot renders offline.
+func captureSingleFile(cs *captureSession) ([]byte, error) {
+	recorder := newNetworkRecorder()
+	recorder.listen(cs.chromeCtx)
+
+	var (
+		htmlContent string
+		pageURL     string
+	)
+	err := chromedp.Run(cs.chromeCtx,
+		cs.load(),
+		chromedp.OuterHTML("html", &htmlContent),
+		chromedp.Location(&pageURL),
+		recorder.fetchBodies(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to capture page with chromedp: %v", err)
+	}
+
+	inliner := newResourceInliner(cs.ctx, recorder.snapshot())
+	content, err := inliner.inlineDocument(pageURL, htmlContent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inline subresources: %v", err)
+	}
+
+	return content, nil
+}
+
+// captureMHTML renders the page and serialises it with all of its resources
+// through the DevTools Page.captureSnapshot command.
+func captureMHTML(cs *captureSession) ([]byte, error) {
+	var snapshot string
+	err := chromedp.Run(cs.chromeCtx,
+		cs.load(),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			var err error
+			snapshot, err = page.CaptureSnapshot().WithFormat(page.CaptureSnapshotFormatMhtml).Do(ctx)
+			return err
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to capture MHTML snapshot with chromedp: %v", err)
+	}
+
+	return []byte(snapshot), nil
+}
@@ -2,9 +2,14 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/gin-gonic/gin"
@@ -12,6 +17,39 @@ import (
 	"github.com/ipfs-force-community/ark-eternal/database"
 )
 
+// pieceReadAhead is the number of pieces downloaded ahead of the one being
+// written to the client.
+const pieceReadAhead = 4
+
+// immutableCacheControl is sent with archived content, which never changes
+// once stored under its root.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// errRangeNotSatisfiable is returned when the range asked for starts past
+// the end of the content.
+var errRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+// archivedContent is content stored as consecutive pieces.
+type archivedContent struct {
+	cids []string
+	// size is the size of the content before padding, 0 for content stored
+	// before it was recorded, in which case it is computed and passed to
+	// saveSize.
+	size        int64
+	saveSize    func(size int64) error
+	contentType string
+	etag        string
+}
+
+// pieceRange is the part of a piece sent to the client.
+type pieceRange struct {
+	cid string
+	// offset and length select the part of the piece, length is 0 for the
+	// whole piece.
+	offset int64
+	length int64
+}
+
 func (s *Service) downloadFile(c *gin.Context) error {
 	userAddress := c.Query("user_address")
 	if userAddress == "" {
@@ -23,12 +61,44 @@ func (s *Service) downloadFile(c *gin.Context) error {
 		return fmt.Errorf("file_name is required")
 	}
 
-	cids, err := database.QueryCIDs(s.db, userAddress, fileName, database.StatusCompleted)
+	fileInfo, err := database.QueryFileInfo(s.db, userAddress, fileName, database.StatusCompleted)
+	if err != nil {
+		return fmt.Errorf("failed to get file %s: %v", fileName, err)
+	}
+
+	// "html" keeps selecting the primary capture whatever its format is.
+	format := c.DefaultQuery("format", string(formatHTML))
+	if format == string(formatHTML) || format == fileInfo.Format {
+		if verifyMode(c) {
+			return s.serveVerification(c, fileInfo, fileInfo.Format, strings.Fields(fileInfo.CIDs))
+		}
+		setContentDisposition(c, fileInfo)
+		return s.serveContent(c, s.replicaProviders(fileInfo.ID), s.fileContent(fileInfo))
+	}
+
+	renditions, err := parseRenditions([]string{format})
 	if err != nil {
 		return err
 	}
 
-	return s.fetchFileByCIDS(c, cids)
+	rendition, err := database.QueryRendition(s.db, fileInfo.ID, string(renditions[0]))
+	if err != nil {
+		return fmt.Errorf("failed to get %s rendition of file %s: %v", renditions[0], fileName, err)
+	}
+
+	cids := strings.Fields(rendition.CIDs)
+	if verifyMode(c) {
+		return s.serveVerification(c, fileInfo, string(renditions[0]), cids)
+	}
+	return s.serveContent(c, s.replicaProviders(fileInfo.ID), archivedContent{
+		cids: cids,
+		size: rendition.ContentSize,
+		saveSize: func(size int64) error {
+			return database.UpdateRenditionContentSize(s.db, rendition.ID, size)
+		},
+		contentType: renditionContentType(renditions[0]),
+		etag:        strconv.Quote(fileInfo.Root),
+	})
 }
 
 func (s *Service) fetchFileByRootCID(c *gin.Context) error {
@@ -37,112 +107,408 @@ func (s *Service) fetchFileByRootCID(c *gin.Context) error {
 		return fmt.Errorf("root CID is required")
 	}
 
-	cids, err := database.QueryCIDsByRoot(s.db, rootCID, database.StatusCompleted)
+	fileInfo, err := database.QueryFileInfoByRoot(s.db, rootCID, database.StatusCompleted)
 	if err != nil {
 		return fmt.Errorf("failed to get file data for CID %s: %v", rootCID, err)
 	}
 
-	return s.fetchFileByCIDS(c, cids)
+	if verifyMode(c) {
+		return s.serveVerification(c, fileInfo, fileInfo.Format, strings.Fields(fileInfo.CIDs))
+	}
+	setContentDisposition(c, fileInfo)
+	return s.serveContent(c, s.replicaProviders(fileInfo.ID), s.fileContent(fileInfo))
 }
 
-func (s *Service) fetchFileByCIDS(c *gin.Context, cids []string) error {
-	// Create HTTP client
-	client := &http.Client{}
-
-	// Create a context to manage cancellation
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// fileContent returns the primary content of a file.
+func (s *Service) fileContent(fileInfo *database.FileInfo) archivedContent {
+	return archivedContent{
+		cids: strings.Fields(fileInfo.CIDs),
+		size: fileInfo.ContentSize,
+		saveSize: func(size int64) error {
+			return database.UpdateFileContentSize(s.db, fileInfo.ID, size)
+		},
+		contentType: fileContentType(fileInfo),
+		etag:        strconv.Quote(fileInfo.Root),
+	}
+}
 
-	// Channel to collect results
-	type downloadResult struct {
-		index int
-		data  []byte
-		err   error
+// serveContent answers a GET or HEAD request for content. A single byte
+// range is served from the pieces it overlaps only, other ranges are ignored
+// and the whole content is sent.
+func (s *Service) serveContent(c *gin.Context, providers []*Provider, content archivedContent) error {
+	// The validators and caching headers are only set along with the
+	// content, so that errors are neither cached nor matched.
+	writeStatus := func(status int) {
+		c.Header("ETag", content.etag)
+		c.Header("Cache-Control", immutableCacheControl)
+		c.Header("Accept-Ranges", "bytes")
+		if status != http.StatusNotModified {
+			c.Header("Content-Type", content.contentType)
+		}
+		c.Status(status)
+		c.Writer.WriteHeaderNow()
 	}
-	results := make(chan downloadResult, len(cids))
 
-	// WaitGroup to wait for all downloads to complete
-	var wg sync.WaitGroup
+	if etagMatches(c.GetHeader("If-None-Match"), content.etag) {
+		writeStatus(http.StatusNotModified)
+		return nil
+	}
 
-	// Semaphore to limit concurrency
-	concurrencyLimit := 10
-	semaphore := make(chan struct{}, concurrencyLimit)
+	if content.size == 0 {
+		size, err := s.storedContentSize(c.Request.Context(), providers, content.cids)
+		if err != nil {
+			return err
+		}
+		if err := content.saveSize(size); err != nil {
+			return fmt.Errorf("failed to record content size: %v", err)
+		}
+		content.size = size
+	}
 
-	for i, cidString := range cids {
-		wg.Add(1)
-		go func(ctx context.Context, index int, cid string) {
-			defer wg.Done()
+	bounds, err := chunkBounds(content.size)
+	if err != nil {
+		return fmt.Errorf("invalid content size: %v", err)
+	}
+	if len(bounds) != len(content.cids) {
+		return fmt.Errorf("%d pieces were recorded for %d chunks", len(content.cids), len(bounds))
+	}
 
-			// Acquire semaphore
-			select {
-			case semaphore <- struct{}{}:
-				defer func() { <-semaphore }()
-			case <-ctx.Done():
-				// Exit if context is canceled
-				return
+	status := http.StatusOK
+	start, length := int64(0), content.size
+	if rangeHeader := c.GetHeader("Range"); rangeHeader != "" {
+		if ifRange := c.GetHeader("If-Range"); ifRange == "" || ifRange == content.etag {
+			var ok bool
+			start, length, ok, err = parseRange(rangeHeader, content.size)
+			if err != nil {
+				c.Header("Content-Range", fmt.Sprintf("bytes */%d", content.size))
+				return err
+			}
+			if ok {
+				status = http.StatusPartialContent
+			} else {
+				start, length = 0, content.size
 			}
+		}
+	}
 
-			downloadURL := fmt.Sprintf("%s/piece/%s", s.serviceURL, cid)
+	writeHeader := func() {
+		c.Header("Content-Length", strconv.FormatInt(length, 10))
+		if status == http.StatusPartialContent {
+			c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, content.size))
+		}
+		writeStatus(status)
+	}
 
-			// Create the GET request
-			req, err := http.NewRequestWithContext(ctx, "GET", downloadURL, nil)
-			if err != nil {
-				results <- downloadResult{index: index, err: fmt.Errorf("failed to create request for CID %s: %v", cid, err)}
-				cancel() // Cancel all other tasks
-				return
-			}
+	if c.Request.Method == http.MethodHead {
+		writeHeader()
+		return nil
+	}
 
-			// Send the request
-			resp, err := client.Do(req)
-			if err != nil {
-				results <- downloadResult{index: index, err: fmt.Errorf("failed to download piece %s: %v", cid, err)}
-				cancel() // Cancel all other tasks
-				return
-			}
-			defer resp.Body.Close()
+	return s.fetchPieces(c, providers, contentRanges(content.cids, bounds, start, length), writeHeader)
+}
 
-			// Check response status
-			if resp.StatusCode != http.StatusOK {
-				results <- downloadResult{index: index, err: fmt.Errorf("failed to download piece %s: status code %d", cid, resp.StatusCode)}
-				cancel() // Cancel all other tasks
-				return
-			}
+// storedContentSize computes the size of content stored before sizes were
+// recorded. Every piece but the last one holds a full chunk, so only the
+// last piece is downloaded.
+func (s *Service) storedContentSize(ctx context.Context, providers []*Provider, cids []string) (int64, error) {
+	if len(cids) == 0 {
+		return 0, fmt.Errorf("content has no pieces")
+	}
 
-			// Read the response body
-			data, err := io.ReadAll(resp.Body)
-			if err != nil {
-				results <- downloadResult{index: index, err: fmt.Errorf("failed to read piece %s: %v", cid, err)}
-				cancel() // Cancel all other tasks
-				return
-			}
+	data, err := s.downloadPiece(ctx, providers, cids[len(cids)-1])
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(cids)-1)*chunkSize + int64(len(data)), nil
+}
 
-			results <- downloadResult{index: index, data: data}
-		}(ctx, i, cidString)
+// contentRanges returns the parts of the pieces holding length bytes of
+// content from start.
+func contentRanges(cids []string, bounds [][2]int64, start, length int64) []pieceRange {
+	end := start + length
+	var ranges []pieceRange
+	for i, b := range bounds {
+		offset, size := b[0], b[1]
+		if offset+size <= start || offset >= end {
+			continue
+		}
+
+		r := pieceRange{cid: cids[i]}
+		from, to := max(start, offset), min(end, offset+size)
+		if from != offset || to != offset+size {
+			r.offset, r.length = from-offset, to-from
+		}
+		ranges = append(ranges, r)
 	}
+	return ranges
+}
 
-	// Close the results channel once all downloads are done
-	go func() {
+// parseRange parses a Range header asking for a single range of content of
+// the given size and returns its first byte and length. ok is false for
+// headers that are not understood or ask for several ranges, which are
+// ignored. Ranges starting past the end of the content are
+// errRangeNotSatisfiable.
+func parseRange(header string, size int64) (start, length int64, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+
+	if first == "" {
+		// A suffix range selects the last bytes of the content.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 {
+			return 0, 0, false, errRangeNotSatisfiable
+		}
+		n = min(n, size)
+		return size - n, n, true, nil
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, nil
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+
+	return start, end - start + 1, true, nil
+}
+
+// etagMatches reports whether an If-None-Match header lists etag.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// abortStream closes the connection of a response whose content is already
+// being streamed, so that the client sees the transfer fail instead of a
+// truncated content. Connections that cannot be taken over are left as is.
+func abortStream(c *gin.Context) {
+	w := http.ResponseWriter(c.Writer)
+	if u, ok := w.(interface{ Unwrap() http.ResponseWriter }); ok {
+		w = u.Unwrap()
+	}
+
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	conn.Close()
+}
+
+// verifyMode reports whether a download asks for the verification report of
+// the content instead of the content itself.
+func verifyMode(c *gin.Context) bool {
+	verify, _ := strconv.ParseBool(c.Query("verify"))
+	return verify
+}
+
+// fileContentType returns the MIME type the primary content of a file is
+// served with. Files stored before the MIME type was recorded fall back to
+// the type of their format.
+func fileContentType(fileInfo *database.FileInfo) string {
+	if fileInfo.MimeType != "" {
+		return fileInfo.MimeType
+	}
+	return captureFormat(fileInfo.Format).contentType()
+}
+
+// setContentDisposition suggests the original name of directly uploaded
+// files to the client.
+func setContentDisposition(c *gin.Context, fileInfo *database.FileInfo) {
+	if fileInfo.OriginalName != "" {
+		c.Header("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": fileInfo.OriginalName}))
+	}
+}
+
+// fetchPieces streams the piece ranges to the client in order. Pieces are
+// downloaded concurrently, but at most pieceReadAhead of them are held in
+// memory ahead of the one being written. Each piece is fetched from the
+// first of the providers that serves it. writeHeader is called before the
+// first piece is written.
+func (s *Service) fetchPieces(c *gin.Context, providers []*Provider, ranges []pieceRange, writeHeader func()) error {
+	// Create a context to manage cancellation
+	ctx, cancel := context.WithCancel(c.Request.Context())
+
+	type downloadResult struct {
+		data []byte
+		err  error
+	}
+	results := make([]chan downloadResult, len(ranges))
+	for i := range results {
+		results[i] = make(chan downloadResult, 1)
+	}
+
+	// A slot is taken before a piece is downloaded and given back once the
+	// piece has been written, which bounds the read-ahead.
+	slots := make(chan struct{}, pieceReadAhead)
+
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
 		wg.Wait()
-		close(results)
 	}()
 
-	// Collect and write results in order
-	downloadedPieces := make([][]byte, len(cids))
-	for result := range results {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, r := range ranges {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				data, err := s.downloadPieceRange(ctx, providers, r)
+				results[i] <- downloadResult{data: data, err: err}
+			}()
+		}
+	}()
+
+	for i := range ranges {
+		var result downloadResult
+		select {
+		case result = <-results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 		if result.err != nil {
 			return result.err
 		}
-		downloadedPieces[result.index] = result.data
-	}
-	c.Header("Content-Type", "text/html")
 
-	// Write all pieces to the client in order
-	for _, piece := range downloadedPieces {
-		_, err := c.Writer.Write(piece)
-		if err != nil {
+		// The headers are only written once the download is known to
+		// start, so that errors are still reported as JSON.
+		if i == 0 {
+			writeHeader()
+		}
+		if _, err := c.Writer.Write(result.data); err != nil {
 			return fmt.Errorf("failed to write piece to client: %v", err)
 		}
+		c.Writer.Flush()
+
+		<-slots
 	}
 
 	return nil
 }
+
+// downloadPiece fetches a piece from the first of the providers that serves
+// it intact. Content that does not hash to the piece CID is never returned.
+func (s *Service) downloadPiece(ctx context.Context, providers []*Provider, cid string) ([]byte, error) {
+	if len(providers) == 0 {
+		providers = []*Provider{s.primary()}
+	}
+
+	var errs []error
+	for _, p := range providers {
+		data, err := downloadPieceFrom(ctx, p, cid)
+		if err == nil {
+			if err = verifyPiece(p, cid, data); err == nil {
+				return data, nil
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		slog.Warn("failed to download piece", "provider", p.Name, "cid", cid, "error", err)
+		errs = append(errs, err)
+	}
+
+	return nil, fmt.Errorf("none of %s serves piece %s: %w", pieceSources(providers), cid, errors.Join(errs...))
+}
+
+// downloadPieceRange fetches a piece range from the first of the providers
+// that serves it. A part of a piece cannot be checked against the piece CID,
+// so the whole piece is downloaded and verified like by downloadPiece and the
+// range is cut from it, unless the service was configured to trust ranged
+// downloads.
+func (s *Service) downloadPieceRange(ctx context.Context, providers []*Provider, r pieceRange) ([]byte, error) {
+	if r.length == 0 || !s.unverifiedRanges {
+		data, err := s.downloadPiece(ctx, providers, r.cid)
+		if err != nil || r.length == 0 {
+			return data, err
+		}
+		if int64(len(data)) < r.offset+r.length {
+			return nil, fmt.Errorf("piece %s has %d bytes, short of %d bytes at offset %d", r.cid, len(data), r.length, r.offset)
+		}
+		return data[r.offset : r.offset+r.length], nil
+	}
+
+	if len(providers) == 0 {
+		providers = []*Provider{s.primary()}
+	}
+
+	var errs []error
+	for _, p := range providers {
+		data, err := downloadPieceRangeFrom(ctx, p, r)
+		if err == nil {
+			return data, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		slog.Warn("failed to download piece range", "provider", p.Name, "cid", r.cid, "offset", r.offset, "length", r.length, "error", err)
+		errs = append(errs, err)
+	}
+
+	return nil, fmt.Errorf("none of %s serves %d bytes at offset %d of piece %s: %w", pieceSources(providers), r.length, r.offset, r.cid, errors.Join(errs...))
+}
+
+func downloadPieceRangeFrom(ctx context.Context, p *Provider, r pieceRange) ([]byte, error) {
+	body, err := p.Client.DownloadPieceRange(ctx, r.cid, r.offset, r.length)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read piece %s: %v", r.cid, err)
+	}
+	if int64(len(data)) != r.length {
+		return nil, fmt.Errorf("piece %s has %d bytes at offset %d instead of %d", r.cid, len(data), r.offset, r.length)
+	}
+
+	return data, nil
+}
+
+func downloadPieceFrom(ctx context.Context, p *Provider, cid string) ([]byte, error) {
+	body, err := p.Client.DownloadPiece(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read piece %s: %v", cid, err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/ipfs-force-community/ark-eternal/database"
+	"github.com/ipfs-force-community/ark-eternal/pdp/pdptest"
+)
+
+func TestParseRange(t *testing.T) {
+	const size = 1000
+	for _, tt := range []struct {
+		header        string
+		start, length int64
+		ok            bool
+		unsatisfiable bool
+	}{
+		{header: "bytes=0-99", start: 0, length: 100, ok: true},
+		{header: "bytes=100-199", start: 100, length: 100, ok: true},
+		{header: "bytes=900-", start: 900, length: 100, ok: true},
+		{header: "bytes=900-5000", start: 900, length: 100, ok: true},
+		{header: "bytes=999-999", start: 999, length: 1, ok: true},
+		{header: "bytes=-100", start: 900, length: 100, ok: true},
+		{header: "bytes=-5000", start: 0, length: size, ok: true},
+		{header: "bytes= 0-9", start: 0, length: 10, ok: true},
+		{header: "bytes=-0", unsatisfiable: true},
+		{header: "bytes=1000-", unsatisfiable: true},
+		{header: "bytes=1000-1100", unsatisfiable: true},
+		{header: "bytes=0-9,20-29"},
+		{header: "bytes=-10,0-9"},
+		{header: "items=0-9"},
+		{header: "bytes=9-0"},
+		{header: "bytes=a-9"},
+		{header: "bytes=0-b"},
+		{header: "bytes=-a"},
+		{header: "bytes=10"},
+		{header: "bytes=-1-9"},
+	} {
+		t.Run(tt.header, func(t *testing.T) {
+			start, length, ok, err := parseRange(tt.header, size)
+			if tt.unsatisfiable {
+				if err != errRangeNotSatisfiable {
+					t.Fatalf("error: %v, want %v", err, errRangeNotSatisfiable)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.ok || start != tt.start || length != tt.length {
+				t.Fatalf("got %d+%d %v, want %d+%d %v", start, length, ok, tt.start, tt.length, tt.ok)
+			}
+		})
+	}
+}
+
+func TestContentRanges(t *testing.T) {
+	cids := []string{"a", "b", "c"}
+	bounds := [][2]int64{{0, 10}, {10, 10}, {20, 5}}
+	for _, tt := range []struct {
+		name          string
+		start, length int64
+		want          []pieceRange
+	}{
+		{
+			name:   "whole content",
+			start:  0,
+			length: 25,
+			want:   []pieceRange{{cid: "a"}, {cid: "b"}, {cid: "c"}},
+		},
+		{
+			name:   "whole piece",
+			start:  10,
+			length: 10,
+			want:   []pieceRange{{cid: "b"}},
+		},
+		{
+			name:   "within a piece",
+			start:  12,
+			length: 3,
+			want:   []pieceRange{{cid: "b", offset: 2, length: 3}},
+		},
+		{
+			name:   "across pieces",
+			start:  5,
+			length: 17,
+			want:   []pieceRange{{cid: "a", offset: 5, length: 5}, {cid: "b"}, {cid: "c", offset: 0, length: 2}},
+		},
+		{
+			name:   "last bytes",
+			start:  24,
+			length: 1,
+			want:   []pieceRange{{cid: "c", offset: 4, length: 1}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := contentRanges(cids, bounds, tt.start, tt.length)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `"root"`
+	for _, tt := range []struct {
+		header string
+		want   bool
+	}{
+		{header: `"root"`, want: true},
+		{header: `W/"root"`, want: true},
+		{header: `"other", "root"`, want: true},
+		{header: `"other",W/"root"`, want: true},
+		{header: `*`, want: true},
+		{header: `"other"`},
+		{header: `root`},
+		{header: ``},
+	} {
+		if got := etagMatches(tt.header, etag); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestServeContent(t *testing.T) {
+	env := newTestEnv(t, pdptest.Options{})
+	content := randomContent(2*chunkSize + 1000)
+	fileInfo := env.store("archive", content)
+	size := len(content)
+
+	t.Run("range", func(t *testing.T) {
+		start, end := chunkSize-10, chunkSize+9
+		resp, data := env.do(http.MethodGet, "/"+fileInfo.Root, nil, map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", start, end)})
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Fatalf("range: %d %s", resp.StatusCode, data)
+		}
+		if got, want := resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/%d", start, end, size); got != want {
+			t.Fatalf("Content-Range: %q, want %q", got, want)
+		}
+		if !bytes.Equal(data, content[start:end+1]) {
+			t.Fatal("range content does not match")
+		}
+
+		resp, data = env.do(http.MethodGet, "/"+fileInfo.Root, nil, map[string]string{"Range": "bytes=-100"})
+		if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(data, content[size-100:]) {
+			t.Fatalf("suffix range: %d, %d bytes", resp.StatusCode, len(data))
+		}
+
+		resp, _ = env.do(http.MethodGet, "/"+fileInfo.Root, nil, map[string]string{"Range": fmt.Sprintf("bytes=%d-", size)})
+		if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Fatalf("unsatisfiable range: %d", resp.StatusCode)
+		}
+		if got, want := resp.Header.Get("Content-Range"), fmt.Sprintf("bytes */%d", size); got != want {
+			t.Fatalf("Content-Range: %q, want %q", got, want)
+		}
+	})
+
+	t.Run("head", func(t *testing.T) {
+		resp, data := env.do(http.MethodHead, "/"+fileInfo.Root, nil, nil)
+		if resp.StatusCode != http.StatusOK || len(data) != 0 {
+			t.Fatalf("head: %d, %d bytes", resp.StatusCode, len(data))
+		}
+		if resp.ContentLength != int64(size) {
+			t.Fatalf("Content-Length: %d, want %d", resp.ContentLength, size)
+		}
+		if etag := resp.Header.Get("ETag"); etag != `"`+fileInfo.Root+`"` {
+			t.Fatalf("ETag: %q", etag)
+		}
+		if cc := resp.Header.Get("Cache-Control"); cc != immutableCacheControl {
+			t.Fatalf("Cache-Control: %q", cc)
+		}
+
+		resp, _ = env.do(http.MethodGet, "/"+fileInfo.Root, nil, map[string]string{"If-None-Match": `"` + fileInfo.Root + `"`})
+		if resp.StatusCode != http.StatusNotModified {
+			t.Fatalf("If-None-Match: %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("legacy size", func(t *testing.T) {
+		if err := env.svc.db.Model(&database.FileInfo{}).Where("id = ?", fileInfo.ID).Update("content_size", 0).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		resp, _ := env.do(http.MethodHead, "/"+fileInfo.Root, nil, nil)
+		if resp.ContentLength != int64(size) {
+			t.Fatalf("Content-Length: %d, want %d", resp.ContentLength, size)
+		}
+		stored, err := database.QueryFileInfoByRoot(env.svc.db, fileInfo.Root, database.StatusCompleted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.ContentSize != int64(size) {
+			t.Fatalf("stored content size: %d, want %d", stored.ContentSize, size)
+		}
+	})
+
+	t.Run("several ranges", func(t *testing.T) {
+		resp, data := env.do(http.MethodGet, "/"+fileInfo.Root, nil, map[string]string{"Range": "bytes=0-9,20-29"})
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(data, content) {
+			t.Fatalf("several ranges: %d, %d bytes", resp.StatusCode, len(data))
+		}
+	})
+
+	t.Run("if range", func(t *testing.T) {
+		resp, data := env.do(http.MethodGet, "/"+fileInfo.Root, nil, map[string]string{"Range": "bytes=0-9", "If-Range": `"other"`})
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(data, content) {
+			t.Fatalf("stale If-Range: %d, %d bytes", resp.StatusCode, len(data))
+		}
+	})
+
+	t.Run("weak etag list", func(t *testing.T) {
+		resp, _ := env.do(http.MethodGet, "/"+fileInfo.Root, nil, map[string]string{"If-None-Match": `"other", W/"` + fileInfo.Root + `"`})
+		if resp.StatusCode != http.StatusNotModified {
+			t.Fatalf("If-None-Match: %d", resp.StatusCode)
+		}
+	})
+}
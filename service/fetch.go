@@ -0,0 +1,130 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+)
+
+// sniffLen is the number of leading bytes http.DetectContentType looks at.
+const sniffLen = 512
+
+// rawResource is a resource fetched verbatim over plain HTTP. Its body is
+// spooled to disk so that large resources are not held in memory.
+type rawResource struct {
+	body     *spooledFile
+	mimeType string
+	headers  http.Header
+}
+
+// fetchRaw downloads resourceURL without a browser. With sniff set, an HTML
+// document is reported through isHTML so that the page is rendered instead.
+// Its type is probed with a HEAD request first, so that the page is not
+// fetched before it is rendered, and only sniffed from the leading bytes of
+// the download when the HEAD request tells nothing.
+func fetchRaw(ctx context.Context, resourceURL string, profile *CaptureProfile, sniff bool) (res *rawResource, isHTML bool, err error) {
+	if sniff && isHTMLMediaType(probeMediaType(ctx, resourceURL, profile)) {
+		return nil, true, nil
+	}
+
+	req, err := newFetchRequest(ctx, http.MethodGet, resourceURL, profile)
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to fetch %s: %v", resourceURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("failed to fetch %s: status code %d", resourceURL, resp.StatusCode)
+	}
+
+	br := bufio.NewReaderSize(resp.Body, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, false, fmt.Errorf("failed to read %s: %v", resourceURL, err)
+	}
+
+	mimeType := sniffContentType(resp.Header.Get("Content-Type"), head)
+	if sniff && isHTMLMediaType(mediaType(mimeType)) {
+		return nil, true, nil
+	}
+
+	body, err := spool(br)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read %s: %v", resourceURL, err)
+	}
+
+	slog.Info("Resource fetched without browser", "url", resourceURL, "mime_type", mimeType, "length", body.Size())
+	return &rawResource{
+		body:     body,
+		mimeType: mimeType,
+		headers:  resp.Header.Clone(),
+	}, false, nil
+}
+
+// probeMediaType returns the media type a HEAD request declares for
+// resourceURL, or an empty string when it cannot be told, such as when the
+// server rejects HEAD requests or declares a generic type.
+func probeMediaType(ctx context.Context, resourceURL string, profile *CaptureProfile) string {
+	req, err := newFetchRequest(ctx, http.MethodHead, resourceURL, profile)
+	if err != nil {
+		return ""
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ""
+	}
+	resp.Body.Close()
+
+	mt := mediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusOK || mt == "application/octet-stream" {
+		return ""
+	}
+	return mt
+}
+
+// newFetchRequest creates a request for resourceURL sent as the profile's
+// user agent.
+func newFetchRequest(ctx context.Context, method, resourceURL string, profile *CaptureProfile) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, resourceURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	if profile.UserAgent != "" {
+		req.Header.Set("User-Agent", profile.UserAgent)
+	}
+	return req, nil
+}
+
+// sniffContentType returns the declared Content-Type, or the type detected
+// from the leading bytes when none or only a generic one was declared.
+func sniffContentType(declared string, head []byte) string {
+	if declared == "" || mediaType(declared) == "application/octet-stream" {
+		return http.DetectContentType(head)
+	}
+	return declared
+}
+
+// mediaType returns the lower-cased media type of a Content-Type value
+// without its parameters.
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+func isHTMLMediaType(mt string) bool {
+	return mt == "text/html" || mt == "application/xhtml+xml"
+}
@@ -21,11 +21,20 @@ const (
 
 // FileInfo represents the information of a file in the list response.
 type FileInfo struct {
-	Name       string `json:"file_name"`
-	Root       string `json:"root"`
-	Size       string `json:"size"`
-	UploadTime string `json:"upload_time"`
-	Status     string `json:"status"`
+	Name         string `json:"file_name"`
+	Root         string `json:"root"`
+	Size         string `json:"size"`
+	Format       string `json:"format"`
+	Profile      string `json:"profile"`
+	MimeType     string `json:"mime_type"`
+	OriginalName string `json:"original_name,omitempty"`
+	UploadTime   string `json:"upload_time"`
+	Status       string `json:"status"`
+	// LastError is the error of the last failed attempt to store the file.
+	LastError string `json:"last_error,omitempty"`
+	// ProofStatus is the proving state of the root of a completed file,
+	// empty until it is first checked.
+	ProofStatus string `json:"proof_status,omitempty"`
 }
 
 func (s *Service) listFiles(c *gin.Context) (any, error) {
@@ -39,14 +48,33 @@ func (s *Service) listFiles(c *gin.Context) (any, error) {
 		return nil, err
 	}
 
+	fileIDs := make([]uint, 0, len(files))
+	for _, file := range files {
+		fileIDs = append(fileIDs, file.ID)
+	}
+	replicas, err := database.QueryFilesReplicas(s.db, fileIDs)
+	if err != nil {
+		return nil, err
+	}
+	fileReplicas := make(map[uint][]database.Replica, len(files))
+	for _, replica := range replicas {
+		fileReplicas[replica.FileID] = append(fileReplicas[replica.FileID], replica)
+	}
+
 	var fileInfos []FileInfo
 	for _, file := range files {
 		fileInfos = append(fileInfos, FileInfo{
-			Name:       file.FileName,
-			Root:       file.Root,
-			Size:       humanReadableSize(file.Size),
-			UploadTime: file.CreatedAt.Format("2006-01-02 15:04"),
-			Status:     string(file.Status),
+			Name:         file.FileName,
+			Root:         file.Root,
+			Size:         humanReadableSize(file.Size),
+			Format:       file.Format,
+			Profile:      file.Profile,
+			MimeType:     file.MimeType,
+			OriginalName: file.OriginalName,
+			UploadTime:   file.CreatedAt.Format("2006-01-02 15:04"),
+			Status:       string(file.Status),
+			LastError:    file.LastError,
+			ProofStatus:  string(fileProofStatus(fileReplicas[file.ID])),
 		})
 
 	}
@@ -0,0 +1,357 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+const (
+	// maxInlineResourceSize bounds a single subresource embedded into a snapshot.
+	maxInlineResourceSize = 50 << 20
+	// maxCSSImportDepth bounds nested @import resolution.
+	maxCSSImportDepth = 5
+	// maxRedirectHops bounds redirect chains followed in recorded exchanges.
+	maxRedirectHops = 10
+)
+
+var (
+	cssURLPattern    = regexp.MustCompile(`url\(\s*(['"]?)([^'")]*?)(['"]?)\s*\)`)
+	cssImportPattern = regexp.MustCompile(`@import\s+(?:url\(\s*)?(['"]?)([^'")\s;]+)(['"]?)\s*\)?\s*([^;]*);`)
+	srcsetSeparator  = regexp.MustCompile(`,\s+`)
+	rawTextEndTags   = map[string]*regexp.Regexp{
+		"script": regexp.MustCompile(`(?i)</(script)`),
+		"style":  regexp.MustCompile(`(?i)</(style)`),
+	}
+)
+
+// inlineResource is a subresource body together with its MIME type.
+type inlineResource struct {
+	mimeType string
+	body     []byte
+}
+
+// resourceInliner rewrites a rendered document so that every subresource it
+// references is embedded into the document itself.
+type resourceInliner struct {
+	ctx       context.Context
+	client    *http.Client
+	resources map[string]*inlineResource
+	redirects map[string]string
+	missing   map[string]bool
+}
+
+// newResourceInliner seeds the inliner with the bodies the browser fetched
+// during the capture, so that most subresources never hit the network again.
+func newResourceInliner(ctx context.Context, exchanges []networkExchange) *resourceInliner {
+	in := &resourceInliner{
+		ctx:       ctx,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		resources: make(map[string]*inlineResource),
+		redirects: make(map[string]string),
+		missing:   make(map[string]bool),
+	}
+
+	for _, ex := range exchanges {
+		if ex.response == nil {
+			continue
+		}
+
+		if ex.redirected {
+			if location, ok := lookupHeader(ex.response.Headers, "location"); ok {
+				in.redirects[ex.url] = resolveURL(ex.url, location)
+			}
+			continue
+		}
+
+		if ex.body == nil || ex.response.Status < 200 || ex.response.Status >= 300 {
+			continue
+		}
+
+		mimeType := ex.response.MimeType
+		if mimeType == "" {
+			mimeType = http.DetectContentType(ex.body)
+		}
+		in.resources[ex.url] = &inlineResource{
+			mimeType: mimeType,
+			body:     ex.body,
+		}
+	}
+
+	return in
+}
+
+// inlineDocument returns htmlContent with stylesheets and scripts inlined and
+// every other referenced subresource replaced by a data URI.
+func (in *resourceInliner) inlineDocument(pageURL, htmlContent string) ([]byte, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(htmlContent))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HTML with goquery: %v", err)
+	}
+
+	baseURL := pageURL
+	if href, ok := doc.Find("base[href]").First().Attr("href"); ok {
+		baseURL = resolveURL(pageURL, href)
+	}
+
+	// The snapshot embeds everything, so policies restricting data: sources
+	// or integrity checks on the original files would only break it.
+	doc.Find("meta[http-equiv]").FilterFunction(func(_ int, sel *goquery.Selection) bool {
+		return strings.EqualFold(sel.AttrOr("http-equiv", ""), "Content-Security-Policy")
+	}).Remove()
+
+	doc.Find("style").Each(func(_ int, sel *goquery.Selection) {
+		sel.SetHtml(escapeRawText(in.inlineCSS(baseURL, sel.Text(), 0), "style"))
+	})
+
+	doc.Find("[style]").Each(func(_ int, sel *goquery.Selection) {
+		sel.SetAttr("style", in.inlineCSS(baseURL, sel.AttrOr("style", ""), maxCSSImportDepth))
+	})
+
+	doc.Find("link[href]").Each(func(_ int, sel *goquery.Selection) {
+		rel := strings.ToLower(sel.AttrOr("rel", ""))
+		href := resolveURL(baseURL, sel.AttrOr("href", ""))
+
+		switch {
+		case hasToken(rel, "stylesheet"):
+			res := in.fetch(href)
+			if res == nil {
+				return
+			}
+
+			style := "<style"
+			if media, ok := sel.Attr("media"); ok {
+				style += fmt.Sprintf(` media="%s"`, escapeAttr(media))
+			}
+			style += ">" + escapeRawText(in.inlineCSS(href, string(res.body), 0), "style") + "</style>"
+			sel.ReplaceWithHtml(style)
+		case hasToken(rel, "icon") || hasToken(rel, "apple-touch-icon"):
+			if dataURI := in.dataURI(href); dataURI != "" {
+				sel.SetAttr("href", dataURI)
+			}
+		case hasToken(rel, "preload") || hasToken(rel, "prefetch") || hasToken(rel, "modulepreload"):
+			sel.Remove()
+		}
+	})
+
+	doc.Find("script[src]").Each(func(_ int, sel *goquery.Selection) {
+		src := resolveURL(baseURL, sel.AttrOr("src", ""))
+		res := in.fetch(src)
+		if res == nil {
+			return
+		}
+
+		sel.RemoveAttr("src")
+		sel.RemoveAttr("integrity")
+		sel.RemoveAttr("crossorigin")
+		sel.SetHtml(escapeRawText(string(res.body), "script"))
+	})
+
+	for _, attr := range []struct{ selector, name string }{
+		{"img[src]", "src"},
+		{"input[src]", "src"},
+		{"source[src]", "src"},
+		{"video[src]", "src"},
+		{"audio[src]", "src"},
+		{"track[src]", "src"},
+		{"embed[src]", "src"},
+		{"video[poster]", "poster"},
+		{"object[data]", "data"},
+		{"image[href]", "href"},
+	} {
+		doc.Find(attr.selector).Each(func(_ int, sel *goquery.Selection) {
+			ref := resolveURL(baseURL, sel.AttrOr(attr.name, ""))
+			if dataURI := in.dataURI(ref); dataURI != "" {
+				sel.SetAttr(attr.name, dataURI)
+			}
+		})
+	}
+
+	doc.Find("img[srcset], source[srcset]").Each(func(_ int, sel *goquery.Selection) {
+		candidates := srcsetSeparator.Split(strings.TrimSpace(sel.AttrOr("srcset", "")), -1)
+		for i, candidate := range candidates {
+			parts := strings.Fields(candidate)
+			if len(parts) == 0 {
+				continue
+			}
+			if dataURI := in.dataURI(resolveURL(baseURL, parts[0])); dataURI != "" {
+				parts[0] = dataURI
+			}
+			candidates[i] = strings.Join(parts, " ")
+		}
+		sel.SetAttr("srcset", strings.Join(candidates, ", "))
+	})
+
+	doc.Find("[integrity]").RemoveAttr("integrity")
+
+	html, err := doc.Html()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get HTML content: %v", err)
+	}
+
+	if len(in.missing) > 0 {
+		slog.Warn("some subresources could not be inlined", "url", pageURL, "missing", len(in.missing))
+	}
+
+	return []byte(html), nil
+}
+
+// inlineCSS resolves @import rules and url() references in css relative to
+// cssURL. Imports are expanded in place up to maxCSSImportDepth.
+func (in *resourceInliner) inlineCSS(cssURL, css string, depth int) string {
+	if depth < maxCSSImportDepth {
+		css = cssImportPattern.ReplaceAllStringFunc(css, func(m string) string {
+			sub := cssImportPattern.FindStringSubmatch(m)
+			importURL := resolveURL(cssURL, sub[2])
+			res := in.fetch(importURL)
+			if res == nil {
+				return m
+			}
+
+			imported := in.inlineCSS(importURL, string(res.body), depth+1)
+			if media := strings.TrimSpace(sub[4]); media != "" {
+				return fmt.Sprintf("@media %s {\n%s\n}", media, imported)
+			}
+			return imported
+		})
+	}
+
+	return cssURLPattern.ReplaceAllStringFunc(css, func(m string) string {
+		sub := cssURLPattern.FindStringSubmatch(m)
+		ref := strings.TrimSpace(sub[2])
+		if ref == "" || strings.HasPrefix(ref, "#") {
+			return m
+		}
+
+		if dataURI := in.dataURI(resolveURL(cssURL, ref)); dataURI != "" {
+			return fmt.Sprintf(`url("%s")`, dataURI)
+		}
+		return m
+	})
+}
+
+func (in *resourceInliner) dataURI(ref string) string {
+	if strings.HasPrefix(ref, "data:") {
+		return ""
+	}
+
+	res := in.fetch(ref)
+	if res == nil {
+		return ""
+	}
+
+	return "data:" + res.mimeType + ";base64," + base64.StdEncoding.EncodeToString(res.body)
+}
+
+// fetch returns the resource for ref, preferring the body recorded by the
+// browser and falling back to a direct request for anything the page did not
+// load itself, such as lazy images that were never scrolled into view.
+func (in *resourceInliner) fetch(ref string) *inlineResource {
+	u, err := url.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+	u.Fragment = ""
+	ref = u.String()
+
+	for hops := 0; hops < maxRedirectHops; hops++ {
+		next, ok := in.redirects[ref]
+		if !ok {
+			break
+		}
+		ref = next
+	}
+
+	if res, ok := in.resources[ref]; ok {
+		return res
+	}
+	if in.missing[ref] {
+		return nil
+	}
+
+	res, err := in.download(ref)
+	if err != nil {
+		slog.Warn("failed to fetch subresource", "url", ref, "error", err)
+		in.missing[ref] = true
+		return nil
+	}
+
+	in.resources[ref] = res
+	return res
+}
+
+func (in *resourceInliner) download(ref string) (*inlineResource, error) {
+	req, err := http.NewRequestWithContext(in.ctx, "GET", ref, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	resp, err := in.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxInlineResourceSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+	if len(body) > maxInlineResourceSize {
+		return nil, fmt.Errorf("resource exceeds %d bytes", maxInlineResourceSize)
+	}
+
+	mimeType := resp.Header.Get("Content-Type")
+	if mt, _, err := mime.ParseMediaType(mimeType); err == nil {
+		mimeType = mt
+	} else {
+		mimeType = http.DetectContentType(body)
+	}
+
+	return &inlineResource{mimeType: mimeType, body: body}, nil
+}
+
+func resolveURL(base, ref string) string {
+	ref = strings.TrimSpace(ref)
+	b, err := url.Parse(base)
+	if err != nil {
+		return ref
+	}
+	r, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return b.ResolveReference(r).String()
+}
+
+func hasToken(list, token string) bool {
+	for _, t := range strings.Fields(list) {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeRawText prevents inlined content from terminating its raw text
+// element early.
+func escapeRawText(s, tag string) string {
+	return rawTextEndTags[tag].ReplaceAllString(s, `<\/$1`)
+}
+
+func escapeAttr(s string) string {
+	return strings.NewReplacer(`&`, "&amp;", `"`, "&quot;", `<`, "&lt;").Replace(s)
+}
@@ -0,0 +1,436 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/gin-gonic/gin"
+	"github.com/ipfs/go-cid"
+	"gorm.io/gorm"
+
+	"github.com/ipfs-force-community/ark-eternal/database"
+)
+
+// contentPart is the name of the primary content in the pieces of a job.
+const contentPart = "content"
+
+// JobPieceInfo represents a piece in the job status response.
+type JobPieceInfo struct {
+	Part  string `json:"part"`
+	Index int    `json:"index"`
+	CID   string `json:"cid"`
+	Size  int64  `json:"size"`
+	State string `json:"state"`
+}
+
+// JobProgress summarises the upload progress of a job.
+type JobProgress struct {
+	UploadedPieces int   `json:"uploaded_pieces"`
+	TotalPieces    int   `json:"total_pieces"`
+	UploadedBytes  int64 `json:"uploaded_bytes"`
+	TotalBytes     int64 `json:"total_bytes"`
+}
+
+// JobInfo represents an upload job in the job status response.
+type JobInfo struct {
+	ID          uint           `json:"id"`
+	State       string         `json:"state"`
+	Error       string         `json:"error,omitempty"`
+	UserAddress string         `json:"user_address"`
+	FileName    string         `json:"file_name"`
+	ResourceURL string         `json:"resource_url"`
+	Format      string         `json:"format"`
+	Renditions  []string       `json:"renditions"`
+	Profile     string         `json:"profile"`
+	Root        string         `json:"root,omitempty"`
+	Progress    JobProgress    `json:"progress"`
+	Pieces      []JobPieceInfo `json:"pieces"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+}
+
+func (s *Service) jobStatus(c *gin.Context) (any, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid job ID: %s", c.Param("id"))
+	}
+
+	job, err := database.QueryJob(s.db, uint(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job %d: %v", id, err)
+	}
+
+	pieces, err := database.QueryJobPieces(s.db, job.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pieces of job %d: %v", id, err)
+	}
+
+	info := &JobInfo{
+		ID:          job.ID,
+		State:       string(job.State),
+		Error:       job.Error,
+		UserAddress: job.UserAddress,
+		FileName:    job.FileName,
+		ResourceURL: job.ResourceURL,
+		Format:      job.Format,
+		Renditions:  strings.Fields(job.Renditions),
+		Profile:     job.Profile,
+		Pieces:      make([]JobPieceInfo, 0, len(pieces)),
+		CreatedAt:   job.CreatedAt,
+		UpdatedAt:   job.UpdatedAt,
+	}
+	for _, piece := range pieces {
+		info.Pieces = append(info.Pieces, JobPieceInfo{
+			Part:  piece.Part,
+			Index: piece.Index,
+			CID:   piece.CID,
+			Size:  piece.Size,
+			State: string(piece.State),
+		})
+
+		info.Progress.TotalPieces++
+		info.Progress.TotalBytes += piece.Size
+		if piece.State == database.PieceUploaded {
+			info.Progress.UploadedPieces++
+			info.Progress.UploadedBytes += piece.Size
+		}
+	}
+
+	if job.FileID != 0 {
+		fileInfo, err := database.QueryFileInfoByID(s.db, job.FileID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get file of job %d: %v", id, err)
+		}
+		info.Root = fileInfo.Root
+	}
+
+	return info, nil
+}
+
+// retryJob queues a failed job again. Only jobs that failed before their file
+// was recorded can be retried.
+func (s *Service) retryJob(c *gin.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid job ID: %s", c.Param("id"))
+	}
+
+	if err := database.RequeueJob(s.db, uint(id)); err != nil {
+		return fmt.Errorf("failed to retry job %d: %v", id, err)
+	}
+
+	s.notifyJobs()
+	return nil
+}
+
+// notifyJobs wakes up an idle worker to pick up a queued job.
+func (s *Service) notifyJobs() {
+	select {
+	case s.jobNotify <- struct{}{}:
+	default:
+	}
+}
+
+// ProcessJobs runs the given number of upload workers until the service
+// context is done. Jobs that were interrupted by a previous shutdown are
+// queued again first and resume from their spool.
+func (s *Service) ProcessJobs(workers int) {
+	n, err := database.ResumeInterruptedJobs(s.db)
+	if err != nil {
+		slog.Error("failed to resume interrupted jobs", "error", err)
+	} else if n > 0 {
+		slog.Info("resuming interrupted upload jobs", "count", n)
+	}
+
+	slog.Info("upload workers started", "workers", workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < max(workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.jobWorker()
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Service) jobWorker() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		s.claimMu.Lock()
+		job, err := database.ClaimQueuedJob(s.db)
+		s.claimMu.Unlock()
+		if err != nil {
+			slog.Error("failed to claim upload job", "error", err)
+		}
+
+		if job != nil {
+			// Another idle worker may pick up the next queued job.
+			s.notifyJobs()
+			s.runJob(job)
+			continue
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.jobNotify:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Service) runJob(job *database.Job) {
+	slog.Info("processing upload job", "job_id", job.ID, "file_name", job.FileName, "url", job.ResourceURL)
+
+	if err := s.processJob(job); err != nil {
+		// Jobs cut short by a shutdown are resumed on the next start.
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		slog.Error("upload job failed", "job_id", job.ID, "file_name", job.FileName, "error", err)
+		if err := database.UpdateJobState(s.db, job.ID, database.JobFailed, err.Error()); err != nil {
+			slog.Error("failed to update job state", "job_id", job.ID, "error", err)
+		}
+		return
+	}
+
+	slog.Info("upload job is waiting for its root to be added", "job_id", job.ID, "file_name", job.FileName)
+}
+
+// jobSource is a part of a capture and its pieces.
+type jobSource struct {
+	part   string
+	src    contentSource
+	pieces []contentPiece
+	rows   []database.JobPiece
+}
+
+// processJob captures the resource of a job, computes and uploads its pieces
+// and records the file, which is then picked up by the scheduler to add its
+// root to the proof set. The capture is spooled and every piece is recorded
+// as soon as it is computed and uploaded, so an interrupted job resumes where
+// it stopped.
+func (s *Service) processJob(job *database.Job) error {
+	renditions, err := parseRenditions(strings.Fields(job.Renditions))
+	if err != nil {
+		return err
+	}
+
+	parts := []string{contentPart}
+	for _, r := range renditions {
+		parts = append(parts, string(r))
+	}
+
+	// The pieces of a previous capture that were uploaded do not need to be
+	// uploaded again if they did not change.
+	var uploaded []string
+	if job.Spool == "" {
+		uploaded, err = s.captureJob(job, renditions)
+		if err != nil {
+			return err
+		}
+	} else {
+		slog.Info("upload job starts from its spool", "job_id", job.ID, "spool", job.Spool)
+	}
+
+	if err := database.UpdateJobState(s.db, job.ID, database.JobHashing, ""); err != nil {
+		return fmt.Errorf("failed to update job state: %v", err)
+	}
+
+	rows, err := database.QueryJobPieces(s.db, job.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get pieces: %v", err)
+	}
+
+	have := make(map[string]bool, len(uploaded))
+	for _, c := range uploaded {
+		have[c] = true
+	}
+
+	// Captures that do not fit in a root are failed before they are hashed.
+	srcs := make([]*spoolSource, 0, len(parts))
+	sizes := make([]int64, 0, len(parts))
+	for _, part := range parts {
+		src, err := s.openSpool(job.Spool, part)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		srcs = append(srcs, src)
+		sizes = append(sizes, src.Size())
+	}
+	if err := checkRootSize(sizes...); err != nil {
+		return err
+	}
+
+	sources := make([]*jobSource, 0, len(parts))
+	for i, part := range parts {
+		src := srcs[i]
+		source := &jobSource{part: part, src: src}
+		var done []contentPiece
+		for _, row := range rows {
+			if row.Part != part {
+				continue
+			}
+			piece, err := pieceFromRow(row)
+			if err != nil {
+				return err
+			}
+			done = append(done, piece)
+			source.rows = append(source.rows, row)
+		}
+
+		source.pieces, err = hashPieces(src, done, func(piece contentPiece) error {
+			row := database.JobPiece{
+				JobID:      job.ID,
+				Part:       part,
+				Index:      len(source.rows),
+				Offset:     piece.offset,
+				Size:       piece.size,
+				PaddedSize: uint64(piece.info.Size),
+				CID:        piece.info.PieceCID.String(),
+				State:      database.PiecePending,
+			}
+			if have[row.CID] {
+				row.State = database.PieceUploaded
+			}
+			if err := database.InsertJobPiece(s.db, &row); err != nil {
+				return fmt.Errorf("failed to record piece: %v", err)
+			}
+			source.rows = append(source.rows, row)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to hash %s: %w", part, err)
+		}
+		sources = append(sources, source)
+	}
+
+	if err := database.UpdateJobState(s.db, job.ID, database.JobUploading, ""); err != nil {
+		return fmt.Errorf("failed to update job state: %v", err)
+	}
+
+	for _, source := range sources {
+		skip := func(i int) bool {
+			return source.rows[i].State == database.PieceUploaded
+		}
+		uploaded := func(i int) error {
+			if err := database.UpdateJobPieceState(s.db, source.rows[i].ID, database.PieceUploaded); err != nil {
+				return fmt.Errorf("failed to update piece state: %v", err)
+			}
+			return nil
+		}
+
+		if err := s.uploadPieces(s.ctx, source.src, source.pieces, skip, uploaded); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", source.part, err)
+		}
+	}
+
+	renditionPieces := make(map[renditionFormat][]contentPiece, len(renditions))
+	for _, source := range sources[1:] {
+		renditionPieces[renditionFormat(source.part)] = source.pieces
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		fileID, err := s.saveFile(tx, &database.FileInfo{
+			UserAddress:  job.UserAddress,
+			FileName:     job.FileName,
+			OriginalName: job.OriginalName,
+			Format:       job.CaptureFormat,
+			Profile:      job.Profile,
+			MimeType:     job.MimeType,
+			Headers:      job.Headers,
+		}, sources[0].pieces, renditions, renditionPieces)
+		if err != nil {
+			return err
+		}
+
+		return database.CompleteJobUpload(tx, job.ID, fileID)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.removeSpool(job.Spool, parts)
+	return nil
+}
+
+// captureJob captures the resource of a job and spools the capture. It
+// returns the CIDs of the pieces of a previous capture that were uploaded.
+func (s *Service) captureJob(job *database.Job, renditions []renditionFormat) ([]string, error) {
+	format, err := parseCaptureFormat(job.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := s.captureProfile(job.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.downloadContent(s.ctx, job.ResourceURL, job.FileName, format, renditions, profile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download content: %w", err)
+	}
+	defer result.Close()
+
+	headers, err := encodeHeaders(result.headers)
+	if err != nil {
+		return nil, err
+	}
+
+	spool := fmt.Sprintf("job-%d", job.ID)
+	if err := s.writeSpool(spool, contentPart, io.NewSectionReader(result.content, 0, result.content.Size())); err != nil {
+		return nil, err
+	}
+	for _, r := range renditions {
+		if err := s.writeSpool(spool, string(r), bytes.NewReader(result.renditions[r])); err != nil {
+			return nil, err
+		}
+	}
+
+	job.Spool = spool
+	job.CaptureFormat = string(result.format)
+	job.MimeType = result.mimeType
+	job.Headers = headers
+
+	uploaded, err := database.RecordJobCapture(s.db, job)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record capture: %v", err)
+	}
+
+	return uploaded, nil
+}
+
+// pieceFromRow restores a piece recorded by a previous attempt.
+func pieceFromRow(row database.JobPiece) (contentPiece, error) {
+	pieceCID, err := cid.Decode(row.CID)
+	if err != nil {
+		return contentPiece{}, fmt.Errorf("invalid CID of recorded piece %d: %v", row.ID, err)
+	}
+
+	digest, err := commcid.CIDToDataCommitmentV1(pieceCID)
+	if err != nil {
+		return contentPiece{}, fmt.Errorf("invalid CID of recorded piece %d: %v", row.ID, err)
+	}
+
+	return contentPiece{
+		offset: row.Offset,
+		size:   row.Size,
+		info:   abi.PieceInfo{Size: abi.PaddedPieceSize(row.PaddedSize), PieceCID: pieceCID},
+		digest: digest,
+	}, nil
+}
@@ -0,0 +1,292 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ipfs-force-community/ark-eternal/database"
+	"github.com/ipfs-force-community/ark-eternal/pdp"
+)
+
+// MonitorConfig configures the proof monitor.
+type MonitorConfig struct {
+	// AlertWebhook is the URL the alerts are posted to, if not empty.
+	AlertWebhook string
+	// Genesis is the time of the genesis of the chain, from which the chain
+	// height is computed for providers not reporting it. Zero if unknown.
+	Genesis time.Time
+	// EpochDuration is the duration of an epoch of the chain, 30s if zero.
+	EpochDuration time.Duration
+	// ChallengeWindow is the number of epochs after a challenge within
+	// which its proof must land, for providers not reporting it.
+	ChallengeWindow int64
+
+	// now returns the current time, time.Now if nil.
+	now func() time.Time
+}
+
+// chainHeight returns the chain height reported by a provider, or the one
+// expected at the current time.
+func (c MonitorConfig) chainHeight(ps *pdp.ProofSet) int64 {
+	if ps.CurrentEpoch > 0 || c.Genesis.IsZero() {
+		return ps.CurrentEpoch
+	}
+	epoch := c.EpochDuration
+	if epoch == 0 {
+		epoch = 30 * time.Second
+	}
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+	return int64(now().Sub(c.Genesis) / epoch)
+}
+
+// challengeWindow returns the challenge window reported by a provider, or
+// the configured one.
+func (c MonitorConfig) challengeWindow(ps *pdp.ProofSet) int64 {
+	if ps.ChallengeWindow > 0 {
+		return ps.ChallengeWindow
+	}
+	return c.ChallengeWindow
+}
+
+// Monitor periodically records the proving state of the roots of the
+// completed replicas, and raises an alert when a proof set misses a proof.
+// Missed proofs are only noticed if the interval is shorter than the
+// challenge window of the providers.
+func (s *Service) Monitor(interval time.Duration, cfg MonitorConfig) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	alerts := newAlerter(cfg.AlertWebhook)
+
+	if cfg.Genesis.IsZero() || cfg.ChallengeWindow <= 0 {
+		slog.Error("chain genesis or challenge window is not configured, missed proofs are only detected with providers reporting their proving state")
+	}
+
+	slog.Info("proof monitor started", "interval", interval)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			for _, p := range s.providers {
+				sets, err := database.QueryProvingProofSets(s.db, p.Name)
+				if err != nil {
+					slog.Error("failed to query proof sets", "provider", p.Name, "error", err)
+					continue
+				}
+				for i := range sets {
+					if err := s.monitorProofSet(p, &sets[i], cfg, alerts); err != nil {
+						slog.Error("failed to monitor proof set", "provider", p.Name, "proof_set_id", sets[i].ProofSetID, "error", err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// monitorProofSet records the proving state of a proof set and of the roots
+// of the completed replicas in it.
+func (s *Service) monitorProofSet(p *Provider, set *database.ProofSet, cfg MonitorConfig, alerts *alerter) error {
+	ps, err := p.Client.GetProofSet(s.ctx, uint64(set.ProofSetID))
+	if errors.Is(err, pdp.ErrNotFound) {
+		// The roots are reported missing, the repair loop takes care of
+		// the proof set.
+		ps = &pdp.ProofSet{}
+	} else if err != nil {
+		return fmt.Errorf("failed to get proof set %d: %w", set.ProofSetID, err)
+	}
+
+	head, window := cfg.chainHeight(ps), cfg.challengeWindow(ps)
+	missed := trackChallenge(set, ps, head, window)
+	if err := database.UpdateProofSetProving(s.db, set); err != nil {
+		return fmt.Errorf("failed to update proof set: %v", err)
+	}
+
+	roots := make(map[string]uint64, len(ps.Roots))
+	for _, root := range ps.Roots {
+		roots[root.RootCID] = root.RootID
+	}
+
+	replicas, err := database.QueryCompletedReplicas(s.db, p.Name, set.ProofSetID)
+	if err != nil {
+		return fmt.Errorf("failed to query replicas: %v", err)
+	}
+
+	var faulted []string
+	for _, replica := range replicas {
+		fileInfo, err := database.QueryFileInfoByID(s.db, replica.FileID)
+		if err != nil {
+			slog.Error("failed to query file", "file_id", replica.FileID, "error", err)
+			continue
+		}
+
+		rootID, ok := roots[fileInfo.Root]
+		record := &database.ProofRecord{
+			ProofSetID:         set.ProofSetID,
+			RootID:             rootID,
+			Status:             proofSetStatus(set, head, window),
+			CurrentEpoch:       head,
+			NextChallengeEpoch: set.NextChallengeEpoch,
+			LastProvenEpoch:    set.LastProvenEpoch,
+			Faults:             replica.Faults,
+		}
+		switch {
+		case !ok:
+			record.Status = database.ProofMissing
+		case missed:
+			record.Faults++
+			faulted = append(faulted, fileInfo.Root)
+		}
+
+		if err := database.RecordRootProof(s.db, &replica, record); err != nil {
+			slog.Error("failed to record root proof", "replica_id", replica.ID, "error", err)
+		}
+	}
+
+	if missed {
+		alerts.alert(s.ctx, &Alert{
+			Provider:       p.Name,
+			ProofSetID:     set.ProofSetID,
+			ChallengeEpoch: set.MissedEpoch,
+			CurrentEpoch:   head,
+			Faults:         set.Faults,
+			Roots:          faulted,
+			Message:        fmt.Sprintf("proof set %d of %s missed the proof of the challenge at epoch %d", set.ProofSetID, p.Name, set.MissedEpoch),
+			Time:           time.Now(),
+		})
+	}
+
+	return nil
+}
+
+// trackChallenge updates the proving state of a proof set from the one
+// reported by its provider at chain height head, and returns whether the
+// proof of the awaited challenge was missed. A challenge is proven once the
+// provider reports a later proof or, for providers not reporting their
+// proofs, once the next challenge moved past it. It is missed once its
+// window passed otherwise.
+func trackChallenge(set *database.ProofSet, ps *pdp.ProofSet, head, window int64) bool {
+	set.NextChallengeEpoch = ps.NextChallengeEpoch
+	if ps.LastProvenEpoch > 0 {
+		set.LastProvenEpoch = ps.LastProvenEpoch
+	}
+	if window <= 0 || head == 0 {
+		return false
+	}
+
+	if set.ChallengeEpoch > 0 && ps.ChallengeWindow == 0 && ps.NextChallengeEpoch > set.ChallengeEpoch {
+		set.LastProvenEpoch = max(set.LastProvenEpoch, set.ChallengeEpoch)
+	}
+
+	missed := false
+	if set.ChallengeEpoch > 0 {
+		switch {
+		case set.LastProvenEpoch >= set.ChallengeEpoch:
+			set.ChallengeEpoch = 0
+		case head > set.ChallengeEpoch+window:
+			set.MissedEpoch = set.ChallengeEpoch
+			set.Faults++
+			set.ChallengeEpoch = 0
+			missed = true
+		}
+	}
+	if set.ChallengeEpoch == 0 && ps.NextChallengeEpoch > max(set.LastProvenEpoch, set.MissedEpoch) {
+		set.ChallengeEpoch = ps.NextChallengeEpoch
+	}
+
+	return missed
+}
+
+// proofSetStatus returns the proving state of the roots of a proof set. It
+// is unknown only when the chain height or the challenge window is.
+func proofSetStatus(set *database.ProofSet, head, window int64) database.ProofStatus {
+	switch {
+	case window <= 0 || head == 0:
+		return database.ProofUnknown
+	case set.MissedEpoch > set.LastProvenEpoch:
+		return database.ProofFaulty
+	case set.LastProvenEpoch > 0:
+		return database.ProofProving
+	default:
+		return database.ProofPending
+	}
+}
+
+// proofStatuses are the proving states reported for a file, the first one
+// held by one of its replicas winning.
+var proofStatuses = []database.ProofStatus{
+	database.ProofFaulty,
+	database.ProofProving,
+	database.ProofPending,
+	database.ProofUnknown,
+	database.ProofMissing,
+}
+
+// fileProofStatus returns the proving state of a file from those of its
+// completed replicas, or an empty string if none was checked yet.
+func fileProofStatus(replicas []database.Replica) database.ProofStatus {
+	held := make(map[database.ProofStatus]bool)
+	for _, replica := range replicas {
+		if replica.State == database.ReplicaCompleted && replica.ProofStatus != "" {
+			held[replica.ProofStatus] = true
+		}
+	}
+
+	for _, status := range proofStatuses {
+		if held[status] {
+			return status
+		}
+	}
+	return ""
+}
+
+// ProofRecordInfo represents a change of the proving state of a root in the
+// proof history response.
+type ProofRecordInfo struct {
+	Provider           string    `json:"provider"`
+	ProofSetID         int       `json:"proof_set_id"`
+	RootID             uint64    `json:"root_id"`
+	Status             string    `json:"status"`
+	CurrentEpoch       int64     `json:"current_epoch"`
+	NextChallengeEpoch int64     `json:"next_challenge_epoch"`
+	LastProvenEpoch    int64     `json:"last_proven_epoch"`
+	Faults             int       `json:"faults"`
+	Time               time.Time `json:"time"`
+}
+
+// proofHistory returns the proving history of a root with every provider.
+func (s *Service) proofHistory(c *gin.Context) (any, error) {
+	rootCID := c.Param("cid")
+	fileInfo, err := database.QueryFileInfoByRoot(s.db, rootCID, database.StatusCompleted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file data for CID %s: %v", rootCID, err)
+	}
+
+	records, err := database.QueryProofRecords(s.db, fileInfo.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get proof history of %s: %v", rootCID, err)
+	}
+
+	history := make([]ProofRecordInfo, 0, len(records))
+	for _, record := range records {
+		history = append(history, ProofRecordInfo{
+			Provider:           record.Provider,
+			ProofSetID:         record.ProofSetID,
+			RootID:             record.RootID,
+			Status:             string(record.Status),
+			CurrentEpoch:       record.CurrentEpoch,
+			NextChallengeEpoch: record.NextChallengeEpoch,
+			LastProvenEpoch:    record.LastProvenEpoch,
+			Faults:             record.Faults,
+			Time:               record.CreatedAt,
+		})
+	}
+	return history, nil
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs-force-community/ark-eternal/database"
+	"github.com/ipfs-force-community/ark-eternal/pdp/pdptest"
+)
+
+// calibrationGenesis is the genesis of the calibration network.
+var calibrationGenesis = time.Unix(1667326380, 0)
+
+// testClock is a clock that only moves when told to.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// advance moves the clock forward by the given number of epochs.
+func (c *testClock) advance(epochs int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(time.Duration(epochs) * 30 * time.Second)
+}
+
+func TestMonitorDetectsMissedProofs(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		hideProving bool
+	}{
+		{name: "reported proving state", hideProving: false},
+		{name: "without proving state", hideProving: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// The chain is at a realistic calibration height, which the
+			// monitor computes from the genesis for providers not
+			// reporting it.
+			clock := &testClock{now: calibrationGenesis.Add(2_500_000 * 30 * time.Second)}
+			env := newTestEnv(t, pdptest.Options{Now: clock.Now, Genesis: calibrationGenesis, HideProving: tt.hideProving})
+			fileInfo := env.store("proven", randomContent(1<<20))
+
+			var mu sync.Mutex
+			var alerts []Alert
+			webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var alert Alert
+				json.NewDecoder(r.Body).Decode(&alert)
+				mu.Lock()
+				alerts = append(alerts, alert)
+				mu.Unlock()
+			}))
+			defer webhook.Close()
+
+			cfg := MonitorConfig{AlertWebhook: webhook.URL, Genesis: calibrationGenesis, ChallengeWindow: 20, now: clock.Now}
+			alerter := newAlerter(cfg.AlertWebhook)
+			p := env.svc.primary()
+			sets, err := database.QueryProvingProofSets(env.svc.db, p.Name)
+			if err != nil || len(sets) != 1 {
+				t.Fatalf("proof sets: %v %v", sets, err)
+			}
+			proofSetID := sets[0].ProofSetID
+
+			// monitor advances the chain by the given number of epochs,
+			// checking the proof set every 10 epochs, and returns the
+			// proof status of the file.
+			monitor := func(epochs int) database.ProofStatus {
+				t.Helper()
+				for i := 0; i < epochs; i += 10 {
+					clock.advance(10)
+					sets, err := database.QueryProvingProofSets(env.svc.db, p.Name)
+					if err != nil || len(sets) != 1 {
+						t.Fatalf("proof sets: %v %v", sets, err)
+					}
+					if err := env.svc.monitorProofSet(p, &sets[0], cfg, alerter); err != nil {
+						t.Fatal(err)
+					}
+				}
+				replicas, err := database.QueryFilesReplicas(env.svc.db, []uint{fileInfo.ID})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return fileProofStatus(replicas)
+			}
+
+			if status := monitor(10); status != database.ProofPending {
+				t.Fatalf("status before the first challenge: %s", status)
+			}
+			// Several proving periods pass without any proof being missed.
+			if status := monitor(300); status != database.ProofProving {
+				t.Fatalf("status of a proven proof set: %s", status)
+			}
+
+			env.pdp.MissProofs(uint64(proofSetID), true)
+			if status := monitor(150); status != database.ProofFaulty {
+				t.Fatalf("status after missed proofs: %s", status)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(alerts) != 1 || alerts[0].Roots[0] != fileInfo.Root {
+				t.Fatalf("alerts: %+v", alerts)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+// networkExchange is a single HTTP request/response pair observed by the browser.
+type networkExchange struct {
+	requestID      network.RequestID
+	resourceType   network.ResourceType
+	method         string
+	url            string
+	requestHeaders network.Headers
+	hasPostData    bool
+	postData       []byte
+	response       *network.Response
+	body           []byte
+	finished       bool
+	redirected     bool
+	errorText      string
+	startedAt      time.Time
+}
+
+// networkRecorder collects every network exchange made by a chromedp target.
+type networkRecorder struct {
+	mu        sync.Mutex
+	exchanges []*networkExchange
+	active    map[network.RequestID]*networkExchange
+}
+
+func newNetworkRecorder() *networkRecorder {
+	return &networkRecorder{
+		active: make(map[network.RequestID]*networkExchange),
+	}
+}
+
+// listen registers the recorder on the chromedp context. It must be called
+// before the page is navigated.
+func (r *networkRecorder) listen(ctx context.Context) {
+	chromedp.ListenTarget(ctx, r.onEvent)
+}
+
+func (r *networkRecorder) onEvent(ev any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch ev := ev.(type) {
+	case *network.EventRequestWillBeSent:
+		// A redirect reuses the request ID, so the previous hop is closed
+		// with the redirect response before the new hop is recorded.
+		if prev, ok := r.active[ev.RequestID]; ok && ev.RedirectResponse != nil {
+			prev.response = ev.RedirectResponse
+			prev.redirected = true
+			prev.finished = true
+		}
+
+		ex := &networkExchange{
+			requestID:      ev.RequestID,
+			resourceType:   ev.Type,
+			method:         ev.Request.Method,
+			url:            ev.Request.URL,
+			requestHeaders: ev.Request.Headers,
+			hasPostData:    ev.Request.HasPostData,
+			startedAt:      time.Now().UTC(),
+		}
+		if ev.WallTime != nil {
+			ex.startedAt = ev.WallTime.Time().UTC()
+		}
+		r.exchanges = append(r.exchanges, ex)
+		r.active[ev.RequestID] = ex
+	case *network.EventResponseReceived:
+		if ex, ok := r.active[ev.RequestID]; ok {
+			ex.response = ev.Response
+		}
+	case *network.EventLoadingFinished:
+		if ex, ok := r.active[ev.RequestID]; ok {
+			ex.finished = true
+		}
+	case *network.EventLoadingFailed:
+		if ex, ok := r.active[ev.RequestID]; ok {
+			ex.errorText = ev.ErrorText
+		}
+	}
+}
+
+// fetchBodies returns an action that retrieves the request and response
+// bodies of every finished exchange from the browser.
+func (r *networkRecorder) fetchBodies() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		r.mu.Lock()
+		var needPostData, needBody []*networkExchange
+		for _, ex := range r.exchanges {
+			if ex.hasPostData && ex.postData == nil {
+				needPostData = append(needPostData, ex)
+			}
+			if ex.finished && !ex.redirected && ex.response != nil && ex.body == nil {
+				needBody = append(needBody, ex)
+			}
+		}
+		r.mu.Unlock()
+
+		for _, ex := range needPostData {
+			postData, err := network.GetRequestPostData(ex.requestID).Do(ctx)
+			if err != nil {
+				slog.Warn("failed to get request post data", "url", ex.url, "error", err)
+				continue
+			}
+
+			r.mu.Lock()
+			ex.postData = []byte(postData)
+			r.mu.Unlock()
+		}
+
+		for _, ex := range needBody {
+			body, err := network.GetResponseBody(ex.requestID).Do(ctx)
+			if err != nil {
+				// Bodies can be evicted from the browser buffer or be unavailable
+				// for some resource types; the exchange is kept without a payload.
+				slog.Warn("failed to get response body", "url", ex.url, "error", err)
+				continue
+			}
+
+			r.mu.Lock()
+			ex.body = body
+			r.mu.Unlock()
+		}
+
+		return nil
+	})
+}
+
+// snapshot returns a copy of the exchanges recorded so far in the order
+// they started.
+func (r *networkRecorder) snapshot() []networkExchange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	exchanges := make([]networkExchange, 0, len(r.exchanges))
+	for _, ex := range r.exchanges {
+		exchanges = append(exchanges, *ex)
+	}
+	return exchanges
+}
+
+// headerValue converts a CDP header value to its string form.
+func headerValue(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// networkActivity tracks the requests a chromedp target has in flight so
+// that captures can wait for the network to become quiet.
+type networkActivity struct {
+	mu           sync.Mutex
+	inflight     map[network.RequestID]struct{}
+	lastActivity time.Time
+}
+
+func newNetworkActivity() *networkActivity {
+	return &networkActivity{
+		inflight:     make(map[network.RequestID]struct{}),
+		lastActivity: time.Now(),
+	}
+}
+
+// listen registers the tracker on the chromedp context. It must be called
+// before the page is navigated.
+func (a *networkActivity) listen(ctx context.Context) {
+	chromedp.ListenTarget(ctx, a.onEvent)
+}
+
+func (a *networkActivity) onEvent(ev any) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch ev := ev.(type) {
+	case *network.EventRequestWillBeSent:
+		a.inflight[ev.RequestID] = struct{}{}
+	case *network.EventLoadingFinished:
+		delete(a.inflight, ev.RequestID)
+	case *network.EventLoadingFailed:
+		delete(a.inflight, ev.RequestID)
+	default:
+		return
+	}
+	a.lastActivity = time.Now()
+}
+
+// waitIdle blocks until no request has been in flight for the quiet period.
+func (a *networkActivity) waitIdle(ctx context.Context, quiet time.Duration) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		a.mu.Lock()
+		idle := len(a.inflight) == 0 && time.Since(a.lastActivity) >= quiet
+		a.mu.Unlock()
+		if idle {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/chromedp"
+)
+
+// BrowserPoolConfig configures a BrowserPool.
+type BrowserPoolConfig struct {
+	// Size is the number of warm browser processes.
+	Size int
+	// MaxTabs bounds the captures running concurrently in one browser.
+	MaxTabs int
+	// MaxCaptures recycles a browser after it served that many captures, to
+	// bound the memory a long-lived process accumulates. Zero disables it.
+	MaxCaptures int
+	// HealthCheckInterval is how often idle browsers are probed.
+	HealthCheckInterval time.Duration
+}
+
+// BrowserStats describes one browser of the pool.
+type BrowserStats struct {
+	ID        int       `json:"id"`
+	Healthy   bool      `json:"healthy"`
+	Active    int       `json:"active"`
+	Captures  uint64    `json:"captures"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// BrowserPoolStats describes the state of the pool.
+type BrowserPoolStats struct {
+	Size      int            `json:"size"`
+	MaxTabs   int            `json:"max_tabs"`
+	Waiting   int            `json:"waiting"`
+	Acquired  uint64         `json:"acquired"`
+	Recycled  uint64         `json:"recycled"`
+	Failures  uint64         `json:"failures"`
+	Browsers  []BrowserStats `json:"browsers"`
+	CheckedAt time.Time      `json:"checked_at"`
+}
+
+// pooledBrowser is a single warm browser process.
+type pooledBrowser struct {
+	id        int
+	ctx       context.Context
+	cancel    context.CancelFunc
+	starting  bool
+	healthy   bool
+	retiring  bool
+	active    int
+	captures  uint64
+	startedAt time.Time
+}
+
+// BrowserPool keeps warm headless browser processes. Every capture borrows
+// an isolated incognito target from one of them instead of starting its own
+// browser.
+type BrowserPool struct {
+	ctx  context.Context
+	cfg  BrowserPoolConfig
+	opts []chromedp.ExecAllocatorOption
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	browsers  []*pooledBrowser
+	nextID    int
+	waiting   int
+	acquired  uint64
+	recycled  uint64
+	failures  uint64
+	checkedAt time.Time
+	closed    bool
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewBrowserPool starts the browsers of the pool and its health checker. A
+// browser that fails to start is retried by the health checker, so the pool
+// is usable even if the browser binary is temporarily unavailable.
+func NewBrowserPool(ctx context.Context, cfg BrowserPoolConfig) *BrowserPool {
+	if cfg.Size <= 0 {
+		cfg.Size = 1
+	}
+	if cfg.MaxTabs <= 0 {
+		cfg.MaxTabs = 1
+	}
+	if cfg.HealthCheckInterval <= 0 {
+		cfg.HealthCheckInterval = 30 * time.Second
+	}
+
+	p := &BrowserPool{
+		ctx:  ctx,
+		cfg:  cfg,
+		opts: chromedp.DefaultExecAllocatorOptions[:],
+		done: make(chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	p.mu.Lock()
+	for i := 0; i < cfg.Size; i++ {
+		p.browsers = append(p.browsers, nil)
+		p.startLocked(i)
+	}
+	p.mu.Unlock()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.healthLoop()
+	}()
+
+	return p
+}
+
+// startLocked launches a browser process into slot i in the background. A
+// browser that fails to start stays unhealthy until the health checker
+// replaces it.
+func (p *BrowserPool) startLocked(i int) {
+	p.nextID++
+	b := &pooledBrowser{
+		id:        p.nextID,
+		starting:  true,
+		startedAt: time.Now(),
+		cancel:    func() {},
+	}
+	p.browsers[i] = b
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		allocCtx, allocCancel := chromedp.NewExecAllocator(p.ctx, p.opts...)
+		browserCtx, browserCancel := chromedp.NewContext(allocCtx)
+		cancel := func() {
+			browserCancel()
+			allocCancel()
+		}
+
+		// Running an empty task list launches the process.
+		err := chromedp.Run(browserCtx)
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		b.starting = false
+		b.ctx = browserCtx
+		b.cancel = cancel
+		switch {
+		case p.closed:
+			cancel()
+		case err != nil:
+			slog.Error("failed to start pooled browser", "browser", b.id, "error", err)
+			cancel()
+			p.failures++
+		default:
+			b.healthy = true
+			slog.Info("pooled browser started", "browser", b.id)
+		}
+		p.cond.Broadcast()
+	}()
+}
+
+// acquire returns a chromedp context for a new incognito target in a pooled
+// browser. The target is closed and the slot is returned when release is
+// called or ctx is done.
+func (p *BrowserPool) acquire(ctx context.Context) (context.Context, func(), error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Wake the waiters up when ctx is done so that they can give up.
+	stop := context.AfterFunc(ctx, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.cond.Broadcast()
+	})
+	defer stop()
+
+	p.waiting++
+	defer func() { p.waiting-- }()
+
+	for {
+		if p.closed {
+			return nil, nil, errors.New("browser pool is closed")
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, nil, fmt.Errorf("failed to acquire browser: %w", err)
+		}
+
+		b, ok := p.pickLocked()
+		if !ok {
+			return nil, nil, errors.New("no healthy browser available")
+		}
+		if b != nil {
+			b.active++
+			b.captures++
+			p.acquired++
+
+			tabCtx, tabCancel := chromedp.NewContext(b.ctx, chromedp.WithNewBrowserContext())
+			// The tab belongs to the browser context, so the capture deadline
+			// is propagated explicitly.
+			stopTab := context.AfterFunc(ctx, tabCancel)
+
+			var once sync.Once
+			release := func() {
+				once.Do(func() {
+					stopTab()
+					tabCancel()
+					p.releaseBrowser(b)
+				})
+			}
+			return tabCtx, release, nil
+		}
+
+		p.cond.Wait()
+	}
+}
+
+// pickLocked returns the healthy browser with the fewest active targets that
+// still has a free slot. It reports false when no browser is healthy or
+// starting, in which case waiting would not help.
+func (p *BrowserPool) pickLocked() (*pooledBrowser, bool) {
+	var best *pooledBrowser
+	usable := false
+	for _, b := range p.browsers {
+		if b.starting || (b.healthy && !b.retiring) {
+			usable = true
+		}
+		if !b.healthy || b.retiring || b.active >= p.cfg.MaxTabs {
+			continue
+		}
+		if best == nil || b.active < best.active {
+			best = b
+		}
+	}
+	return best, usable || best != nil
+}
+
+func (p *BrowserPool) releaseBrowser(b *pooledBrowser) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b.active--
+	if p.cfg.MaxCaptures > 0 && b.captures >= uint64(p.cfg.MaxCaptures) {
+		b.retiring = true
+	}
+	switch {
+	case b.active > 0:
+	case !b.healthy:
+		p.replaceLocked(b, "health check failed")
+	case b.retiring:
+		p.replaceLocked(b, "capture limit reached")
+	}
+
+	p.cond.Broadcast()
+}
+
+// replaceLocked shuts b down and starts a replacement in its slot.
+func (p *BrowserPool) replaceLocked(b *pooledBrowser, reason string) {
+	if p.closed {
+		return
+	}
+
+	slog.Info("recycling pooled browser", "browser", b.id, "reason", reason)
+	b.cancel()
+	p.recycled++
+
+	for i, cur := range p.browsers {
+		if cur == b {
+			p.startLocked(i)
+			break
+		}
+	}
+}
+
+func (p *BrowserPool) healthLoop() {
+	ticker := time.NewTicker(p.cfg.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.checkHealth()
+		}
+	}
+}
+
+// checkHealth probes every browser and recycles the ones that crashed or
+// stopped responding. Browsers with active captures are only replaced once
+// they become idle, since their targets fail on their own.
+func (p *BrowserPool) checkHealth() {
+	p.mu.Lock()
+	browsers := append([]*pooledBrowser{}, p.browsers...)
+	p.mu.Unlock()
+
+	for _, b := range browsers {
+		p.mu.Lock()
+		starting, ctx := b.starting, b.ctx
+		p.mu.Unlock()
+		if starting {
+			continue
+		}
+
+		healthy := probeBrowser(ctx) == nil
+
+		p.mu.Lock()
+		if !healthy && !b.starting {
+			b.healthy = false
+			if b.active == 0 {
+				p.failures++
+				p.replaceLocked(b, "health check failed")
+				p.cond.Broadcast()
+			}
+		}
+		p.mu.Unlock()
+	}
+
+	p.mu.Lock()
+	p.checkedAt = time.Now()
+	p.mu.Unlock()
+}
+
+func probeBrowser(browserCtx context.Context) error {
+	if err := browserCtx.Err(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(browserCtx, 5*time.Second)
+	defer cancel()
+
+	return chromedp.Run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
+		_, _, _, _, _, err := browser.GetVersion().Do(ctx)
+		return err
+	}))
+}
+
+// Stats returns a snapshot of the pool state.
+func (p *BrowserPool) Stats() BrowserPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := BrowserPoolStats{
+		Size:      p.cfg.Size,
+		MaxTabs:   p.cfg.MaxTabs,
+		Waiting:   p.waiting,
+		Acquired:  p.acquired,
+		Recycled:  p.recycled,
+		Failures:  p.failures,
+		CheckedAt: p.checkedAt,
+	}
+	for _, b := range p.browsers {
+		stats.Browsers = append(stats.Browsers, BrowserStats{
+			ID:        b.id,
+			Healthy:   b.healthy,
+			Active:    b.active,
+			Captures:  b.captures,
+			StartedAt: b.startedAt,
+		})
+	}
+
+	return stats
+}
+
+// Close shuts down every browser of the pool.
+func (p *BrowserPool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	for _, b := range p.browsers {
+		b.cancel()
+	}
+	close(p.done)
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
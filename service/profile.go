@@ -0,0 +1,283 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/chromedp"
+)
+
+// DefaultCaptureProfile is the name of the profile used when an upload
+// request does not select one.
+const DefaultCaptureProfile = "default"
+
+// WaitType selects the condition a capture waits for before serialising the page.
+type WaitType string
+
+const (
+	// WaitVisible waits until the element matched by the selector, "body" by
+	// default, is visible.
+	WaitVisible WaitType = "visible"
+	// WaitNetworkIdle waits until no request has been in flight for the idle period.
+	WaitNetworkIdle WaitType = "network-idle"
+	// WaitSelector waits until the selector matches an element in the DOM.
+	WaitSelector WaitType = "selector"
+	// WaitDelay waits for a fixed delay after navigation.
+	WaitDelay WaitType = "delay"
+	// WaitExpression waits until the JavaScript expression evaluates to a truthy value.
+	WaitExpression WaitType = "expression"
+)
+
+const defaultNetworkIdle = 500 * time.Millisecond
+
+// Duration is a time.Duration that is encoded as a string such as "30s" in JSON.
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %v", err)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+// WaitCondition describes when a page is considered ready to be captured.
+type WaitCondition struct {
+	Type       WaitType `json:"type"`
+	Selector   string   `json:"selector,omitempty"`
+	Expression string   `json:"expression,omitempty"`
+	// Delay is the fixed delay for WaitDelay and the required quiet period
+	// for WaitNetworkIdle.
+	Delay Duration `json:"delay,omitempty"`
+}
+
+// Viewport describes the emulated screen of a capture.
+type Viewport struct {
+	Width     int64   `json:"width"`
+	Height    int64   `json:"height"`
+	Scale     float64 `json:"scale,omitempty"`
+	Mobile    bool    `json:"mobile,omitempty"`
+	Touch     bool    `json:"touch,omitempty"`
+	Landscape bool    `json:"landscape,omitempty"`
+}
+
+// CaptureProfile configures how a page is rendered before it is captured.
+type CaptureProfile struct {
+	Name      string        `json:"name"`
+	Wait      WaitCondition `json:"wait"`
+	Viewport  *Viewport     `json:"viewport,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+	Headless  *bool         `json:"headless,omitempty"`
+	// ChromeFlags are extra command line flags passed to the browser, e.g.
+	// {"disable-web-security": true, "lang": "en-US"}.
+	ChromeFlags map[string]any `json:"chrome_flags,omitempty"`
+	// Behaviors run in order once the wait condition is met.
+	Behaviors []BehaviorConfig `json:"behaviors,omitempty"`
+	Timeout   Duration         `json:"timeout,omitempty"`
+}
+
+// defaultCaptureProfile mirrors the behaviour captures had before profiles
+// were configurable.
+func defaultCaptureProfile() *CaptureProfile {
+	return &CaptureProfile{
+		Name:    DefaultCaptureProfile,
+		Wait:    WaitCondition{Type: WaitVisible, Selector: "body"},
+		Timeout: Duration(30 * time.Second),
+	}
+}
+
+// LoadCaptureProfiles loads capture profiles from a JSON file containing a
+// list of profiles. The built-in default profile is always present and can
+// be overridden by a profile named "default". An empty path only yields the
+// built-in profile.
+func LoadCaptureProfiles(path string) (map[string]*CaptureProfile, error) {
+	profiles := map[string]*CaptureProfile{
+		DefaultCaptureProfile: defaultCaptureProfile(),
+	}
+	if path == "" {
+		return profiles, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capture profiles: %v", err)
+	}
+
+	var list []*CaptureProfile
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse capture profiles: %v", err)
+	}
+
+	for _, p := range list {
+		if err := p.normalize(); err != nil {
+			return nil, fmt.Errorf("invalid capture profile %q: %v", p.Name, err)
+		}
+		profiles[p.Name] = p
+	}
+
+	return profiles, nil
+}
+
+// normalize validates the profile and fills in defaults.
+func (p *CaptureProfile) normalize() error {
+	if p.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	if p.Timeout <= 0 {
+		p.Timeout = Duration(30 * time.Second)
+	}
+
+	switch p.Wait.Type {
+	case "", WaitVisible:
+		p.Wait.Type = WaitVisible
+		if p.Wait.Selector == "" {
+			p.Wait.Selector = "body"
+		}
+	case WaitNetworkIdle:
+		if p.Wait.Delay <= 0 {
+			p.Wait.Delay = Duration(defaultNetworkIdle)
+		}
+	case WaitSelector:
+		if p.Wait.Selector == "" {
+			return fmt.Errorf("wait type %s requires a selector", p.Wait.Type)
+		}
+	case WaitDelay:
+		if p.Wait.Delay <= 0 {
+			return fmt.Errorf("wait type %s requires a delay", p.Wait.Type)
+		}
+	case WaitExpression:
+		if p.Wait.Expression == "" {
+			return fmt.Errorf("wait type %s requires an expression", p.Wait.Type)
+		}
+	default:
+		return fmt.Errorf("unsupported wait type: %s", p.Wait.Type)
+	}
+
+	if p.Viewport != nil && (p.Viewport.Width <= 0 || p.Viewport.Height <= 0) {
+		return fmt.Errorf("viewport width and height must be positive")
+	}
+
+	for i := range p.Behaviors {
+		if err := p.Behaviors[i].build(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// allocatorOptions returns the browser process options of the profile.
+func (p *CaptureProfile) allocatorOptions() []chromedp.ExecAllocatorOption {
+	opts := append([]chromedp.ExecAllocatorOption{}, chromedp.DefaultExecAllocatorOptions[:]...)
+	if p.Headless != nil && !*p.Headless {
+		opts = append(opts, chromedp.Flag("headless", false))
+	}
+	if p.UserAgent != "" {
+		opts = append(opts, chromedp.UserAgent(p.UserAgent))
+	}
+	if p.Viewport != nil {
+		opts = append(opts, chromedp.WindowSize(int(p.Viewport.Width), int(p.Viewport.Height)))
+	}
+	for name, value := range p.ChromeFlags {
+		opts = append(opts, chromedp.Flag(strings.TrimPrefix(name, "--"), value))
+	}
+
+	return opts
+}
+
+// needsDedicatedBrowser reports whether the profile changes the browser
+// process itself, so that it cannot borrow a tab from the browser pool.
+func (p *CaptureProfile) needsDedicatedBrowser() bool {
+	return (p.Headless != nil && !*p.Headless) || len(p.ChromeFlags) > 0
+}
+
+// emulate returns the tab level emulation of the profile, which also applies
+// when the tab is borrowed from a pooled browser.
+func (p *CaptureProfile) emulate() chromedp.Action {
+	var tasks chromedp.Tasks
+	if p.UserAgent != "" {
+		tasks = append(tasks, emulation.SetUserAgentOverride(p.UserAgent))
+	}
+	if p.Viewport == nil {
+		return tasks
+	}
+
+	scale := p.Viewport.Scale
+	if scale <= 0 {
+		scale = 1
+	}
+
+	var angle int64
+	orientation := emulation.OrientationTypePortraitPrimary
+	if p.Viewport.Landscape {
+		orientation, angle = emulation.OrientationTypeLandscapePrimary, 90
+	}
+
+	return append(tasks,
+		emulation.SetDeviceMetricsOverride(p.Viewport.Width, p.Viewport.Height, scale, p.Viewport.Mobile).
+			WithScreenOrientation(&emulation.ScreenOrientation{
+				Type:  orientation,
+				Angle: angle,
+			}),
+		emulation.SetTouchEmulationEnabled(p.Viewport.Touch),
+	)
+}
+
+// wait returns the action that blocks until the page is ready to be captured.
+func (p *CaptureProfile) wait(activity *networkActivity) chromedp.Action {
+	switch p.Wait.Type {
+	case WaitNetworkIdle:
+		return chromedp.ActionFunc(func(ctx context.Context) error {
+			return activity.waitIdle(ctx, time.Duration(p.Wait.Delay))
+		})
+	case WaitSelector:
+		return chromedp.WaitReady(p.Wait.Selector, chromedp.ByQuery)
+	case WaitDelay:
+		return chromedp.Sleep(time.Duration(p.Wait.Delay))
+	case WaitExpression:
+		var res any
+		// The capture timeout bounds the wait, so the poll itself has none.
+		return chromedp.Poll(p.Wait.Expression, &res,
+			chromedp.WithPollingInterval(100*time.Millisecond),
+			chromedp.WithPollingTimeout(0),
+		)
+	default:
+		return chromedp.WaitVisible(p.Wait.Selector, chromedp.ByQuery)
+	}
+}
+
+// captureProfile returns the configured profile with the given name, or the
+// default profile when name is empty.
+func (s *Service) captureProfile(name string) (*CaptureProfile, error) {
+	if name == "" {
+		name = DefaultCaptureProfile
+	}
+
+	if p, ok := s.profiles[name]; ok {
+		return p, nil
+	}
+	if name == DefaultCaptureProfile {
+		return defaultCaptureProfile(), nil
+	}
+
+	return nil, fmt.Errorf("unknown capture profile: %s", name)
+}
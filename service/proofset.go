@@ -0,0 +1,120 @@
+package service
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/ipfs-force-community/ark-eternal/database"
+	"github.com/ipfs-force-community/ark-eternal/pdp"
+)
+
+// ProofSetConfig configures the proof sets managed by the service.
+type ProofSetConfig struct {
+	// ID is an existing proof set adopted as the active one on start, if
+	// not zero.
+	ID int
+	// RecordKeeper is the record keeper of the proof sets created by the
+	// service.
+	RecordKeeper string
+	// MaxRoots and MaxBytes are the number of roots and their padded size
+	// after which a proof set is rolled over. Zero disables a threshold.
+	MaxRoots int
+	MaxBytes uint64
+	// BatchRoots is the maximum number of roots added to a proof set in a
+	// single message.
+	BatchRoots int
+}
+
+// full reports whether ps reached the thresholds of the configuration.
+func (c ProofSetConfig) full(ps *database.ProofSet) bool {
+	return c.MaxRoots > 0 && ps.Roots >= c.MaxRoots || c.MaxBytes > 0 && ps.Bytes >= c.MaxBytes
+}
+
+// activeProofSet returns the proof set of a provider new roots are added
+// to, creating or rolling over proof sets as needed. It returns nil while no
+// proof set is ready.
+func (s *Service) activeProofSet(p *Provider) (*database.ProofSet, error) {
+	creating, err := database.QueryProofSetByState(s.db, p.Name, database.ProofSetCreating)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query proof sets: %v", err)
+	}
+	if creating != nil {
+		if err := s.pollProofSetCreation(p, creating); err != nil {
+			return nil, err
+		}
+	}
+
+	active, err := database.QueryProofSetByState(s.db, p.Name, database.ProofSetActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query proof sets: %v", err)
+	}
+	if active != nil && p.ProofSets.full(active) {
+		slog.Info("proof set is full, rolling over", "provider", p.Name, "proof_set_id", active.ProofSetID, "roots", active.Roots, "bytes", active.Bytes)
+		if err := database.UpdateProofSetState(s.db, active.ID, database.ProofSetFull, ""); err != nil {
+			return nil, fmt.Errorf("failed to update proof set state: %v", err)
+		}
+		active = nil
+	}
+	if active != nil {
+		return active, nil
+	}
+
+	creating, err = database.QueryProofSetByState(s.db, p.Name, database.ProofSetCreating)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query proof sets: %v", err)
+	}
+	if creating == nil {
+		if err := s.createProofSet(p); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// createProofSet starts the creation of a proof set with a provider.
+func (s *Service) createProofSet(p *Provider) error {
+	res, err := p.Client.CreateProofSet(s.ctx, &pdp.CreateProofSetRequest{RecordKeeper: p.ProofSets.RecordKeeper})
+	if err != nil {
+		return fmt.Errorf("failed to create proof set: %w", err)
+	}
+
+	if _, err := database.InsertProofSet(s.db, &database.ProofSet{
+		Provider:     p.Name,
+		TxHash:       res.TxHash,
+		RecordKeeper: p.ProofSets.RecordKeeper,
+		State:        database.ProofSetCreating,
+	}); err != nil {
+		return fmt.Errorf("failed to record proof set: %v", err)
+	}
+
+	slog.Info("proof set creation initiated", "provider", p.Name, "tx_hash", res.TxHash)
+	return nil
+}
+
+// pollProofSetCreation activates a proof set once its creation landed, or
+// marks it as failed.
+func (s *Service) pollProofSetCreation(p *Provider, ps *database.ProofSet) error {
+	status, err := p.Client.GetProofSetCreateStatus(s.ctx, ps.TxHash)
+	if err != nil {
+		return fmt.Errorf("failed to get proof set creation status: %w", err)
+	}
+
+	if status.OK != nil && !*status.OK {
+		slog.Error("proof set creation failed", "provider", p.Name, "tx_hash", ps.TxHash, "tx_status", status.TxStatus)
+		if err := database.UpdateProofSetState(s.db, ps.ID, database.ProofSetFailed, "creation message failed: "+status.TxStatus); err != nil {
+			return fmt.Errorf("failed to update proof set state: %v", err)
+		}
+		return nil
+	}
+	if status.ProofSetID == nil {
+		return nil
+	}
+
+	if err := database.ActivateProofSet(s.db, ps.ID, int(*status.ProofSetID)); err != nil {
+		return fmt.Errorf("failed to activate proof set: %v", err)
+	}
+
+	slog.Info("proof set created", "provider", p.Name, "proof_set_id", *status.ProofSetID, "tx_hash", ps.TxHash)
+	return nil
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/ipfs-force-community/ark-eternal/pdp"
+)
+
+// DefaultProvider is the name of the provider configured by the service
+// flags when no providers file is given.
+const DefaultProvider = "default"
+
+// ProviderConfig describes a PDP provider in the providers file. Empty
+// fields fall back to the service flags.
+type ProviderConfig struct {
+	Name           string `json:"name"`
+	URL            string `json:"url"`
+	ServiceName    string `json:"service_name,omitempty"`
+	PrivateKeyPath string `json:"private_key_path,omitempty"`
+	// ProofSetID is an existing proof set of the provider to adopt.
+	ProofSetID   int    `json:"proof_set_id,omitempty"`
+	RecordKeeper string `json:"record_keeper,omitempty"`
+}
+
+// Provider is a PDP provider archives are replicated to. The first provider
+// of the service receives the uploads, and files stored before replication
+// was configured are attributed to it.
+type Provider struct {
+	Name      string
+	Client    pdp.Client
+	ProofSets ProofSetConfig
+}
+
+// LoadProviderConfigs loads the list of providers from a JSON file.
+func LoadProviderConfigs(path string) ([]ProviderConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read providers: %v", err)
+	}
+
+	var list []ProviderConfig
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse providers: %v", err)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no provider is configured")
+	}
+
+	names := make(map[string]bool, len(list))
+	for _, p := range list {
+		if p.Name == "" || p.URL == "" {
+			return nil, fmt.Errorf("provider name and url are required")
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("duplicate provider %q", p.Name)
+		}
+		names[p.Name] = true
+	}
+
+	return list, nil
+}
+
+// primary returns the provider receiving the uploads.
+func (s *Service) primary() *Provider {
+	return s.providers[0]
+}
+
+// provider returns the provider with the given name, or nil if it is no
+// longer configured.
+func (s *Service) provider(name string) *Provider {
+	for _, p := range s.providers {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ipfs-force-community/ark-eternal/database"
+	"github.com/ipfs-force-community/ark-eternal/pdp"
+)
+
+// ReaperConfig configures the handling of files stuck in a status.
+type ReaperConfig struct {
+	// MaxAge is the time a file may stay in a status before it is retried
+	// or failed. Statuses without a max age are never reaped.
+	MaxAge map[database.Status]time.Duration
+	// MaxRetries is the number of times a stuck file is retried before it
+	// is failed.
+	MaxRetries int
+	// FailedSpoolMaxAge is the time the spool of a failed job is kept so
+	// that the job can be retried from it. Zero keeps it forever.
+	FailedSpoolMaxAge time.Duration
+}
+
+// Reap periodically retries the files stuck in a status for longer than its
+// max age, and fails them once they ran out of retries. It also removes the
+// spools of jobs that failed long ago.
+func (s *Service) Reap(interval time.Duration, cfg ReaperConfig) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	slog.Info("reaper started", "interval", interval)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			for status, maxAge := range cfg.MaxAge {
+				if maxAge <= 0 {
+					continue
+				}
+
+				fileInfos, err := database.QueryStuckFiles(s.db, status, time.Now().Add(-maxAge))
+				if err != nil {
+					slog.Error("failed to query stuck files", "status", status, "error", err)
+					continue
+				}
+				for i := range fileInfos {
+					if err := s.reapFile(&fileInfos[i], maxAge, cfg.MaxRetries); err != nil {
+						slog.Error("failed to reap file", "file_id", fileInfos[i].ID, "file_name", fileInfos[i].FileName, "error", err)
+					}
+				}
+			}
+			if cfg.FailedSpoolMaxAge > 0 {
+				s.sweepFailedSpools(cfg.FailedSpoolMaxAge)
+			}
+		}
+	}
+}
+
+// reapFile retries a stuck file, or fails it if it ran out of retries. A
+// pending file has the pieces of its replicas copied again. A confirming one
+// is left alone while the message that sent one of its roots may still land
+// or landed, so that no root is added twice, and has its roots sent again
+// otherwise.
+func (s *Service) reapFile(fileInfo *database.FileInfo, maxAge time.Duration, maxRetries int) error {
+	replicas, err := database.QueryReplicas(s.db, fileInfo.ID)
+	if err != nil {
+		return fmt.Errorf("failed to query replicas: %v", err)
+	}
+
+	reason := fmt.Sprintf("stuck in %s for more than %s", fileInfo.Status, maxAge)
+	if fileInfo.Status == database.StatusConfirming {
+		for _, replica := range replicas {
+			if replica.State != database.ReplicaConfirming {
+				continue
+			}
+			if s.provider(replica.Provider) == nil {
+				return s.failStuckFile(fileInfo, replicas, fmt.Sprintf("%s, provider %s is no longer configured", reason, replica.Provider))
+			}
+			inFlight, err := s.additionInFlight(&replica)
+			if err != nil {
+				return err
+			}
+			if inFlight != "" {
+				slog.Warn("stuck file is not retried", "file_id", fileInfo.ID, "file_name", fileInfo.FileName, "reason", inFlight)
+				return nil
+			}
+		}
+	}
+
+	if fileInfo.Attempts >= maxRetries {
+		return s.failStuckFile(fileInfo, replicas, fmt.Sprintf("%s after %d retries", reason, fileInfo.Attempts))
+	}
+
+	slog.Warn("retrying stuck file", "file_id", fileInfo.ID, "file_name", fileInfo.FileName, "status", fileInfo.Status, "attempt", fileInfo.Attempts+1)
+	for _, replica := range replicas {
+		switch {
+		case fileInfo.Status == database.StatusPending && replica.State == database.ReplicaAddingRoots:
+			s.releaseReplica(fileInfo, &replica, database.ReplicaUploading, reason)
+		case fileInfo.Status == database.StatusConfirming && replica.State == database.ReplicaConfirming:
+			s.releaseReplica(fileInfo, &replica, database.ReplicaAddingRoots, reason)
+		}
+	}
+	if err := database.TransitionFile(s.db, fileInfo.ID, database.StatusPending, reason, nil); err != nil {
+		return fmt.Errorf("failed to update file info status: %w", err)
+	}
+	if err := database.UpdateJobStateByFile(s.db, fileInfo.ID, database.JobAddingRoots, reason); err != nil {
+		return fmt.Errorf("failed to update job state: %v", err)
+	}
+	return nil
+}
+
+// failStuckFile fails a stuck file and the replicas still being stored.
+func (s *Service) failStuckFile(fileInfo *database.FileInfo, replicas []database.Replica, reason string) error {
+	slog.Warn("failing stuck file", "file_id", fileInfo.ID, "file_name", fileInfo.FileName, "reason", reason)
+
+	for _, replica := range replicas {
+		switch replica.State {
+		case database.ReplicaUploading, database.ReplicaAddingRoots, database.ReplicaConfirming:
+			s.releaseReplica(fileInfo, &replica, database.ReplicaFailed, reason)
+		}
+	}
+	if err := database.TransitionFile(s.db, fileInfo.ID, database.StatusFailed, reason, nil); err != nil {
+		return fmt.Errorf("failed to update file info status: %w", err)
+	}
+	if err := database.UpdateJobStateByFile(s.db, fileInfo.ID, database.JobFailed, reason); err != nil {
+		return fmt.Errorf("failed to update job state: %v", err)
+	}
+	return nil
+}
+
+// additionInFlight checks the message that sent the root of a confirming
+// replica to a configured provider. It returns why the root must not be sent
+// again, or an empty string if the message failed or is unknown to the
+// provider.
+func (s *Service) additionInFlight(replica *database.Replica) (string, error) {
+	if replica.TxHash == "" {
+		return "", nil
+	}
+
+	status, err := s.provider(replica.Provider).Client.GetRootAdditionStatus(s.ctx, uint64(replica.ProofSetID), replica.TxHash)
+	switch {
+	case errors.Is(err, pdp.ErrNotFound):
+		return "", nil
+	case err != nil:
+		return "", fmt.Errorf("failed to get status of message %s: %w", replica.TxHash, err)
+	case status.AddMessageOK == nil:
+		return fmt.Sprintf("message %s adding its root to proof set %d is still pending", replica.TxHash, replica.ProofSetID), nil
+	case *status.AddMessageOK:
+		return fmt.Sprintf("message %s adding its root to proof set %d landed", replica.TxHash, replica.ProofSetID), nil
+	}
+	return "", nil
+}
+
+// releaseReplica moves a replica of a stuck file to the given state. A
+// replica whose root was sent no longer counts towards the usage of its
+// proof set.
+func (s *Service) releaseReplica(fileInfo *database.FileInfo, replica *database.Replica, state database.ReplicaState, reason string) {
+	if err := database.UpdateReplicaState(s.db, replica.ID, state, reason); err != nil {
+		slog.Error("failed to update replica state", "replica_id", replica.ID, "error", err)
+		return
+	}
+	if replica.State != database.ReplicaConfirming {
+		return
+	}
+
+	_, size, err := s.rootEntry(fileInfo)
+	if err != nil {
+		slog.Error("failed to query renditions", "file_id", fileInfo.ID, "error", err)
+		return
+	}
+	if err := database.ReleaseProofSetUsage(s.db, replica.Provider, replica.ProofSetID, 1, size); err != nil {
+		slog.Error("failed to update proof set usage", "provider", replica.Provider, "proof_set_id", replica.ProofSetID, "error", err)
+	}
+}
+
+// FileTransitionInfo represents a change of the status of a file in the
+// history response.
+type FileTransitionInfo struct {
+	From    string    `json:"from,omitempty"`
+	To      string    `json:"to"`
+	Attempt int       `json:"attempt"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// fileHistory returns the status history of a file.
+func (s *Service) fileHistory(c *gin.Context) (any, error) {
+	userAddress := c.Query("user_address")
+	if userAddress == "" {
+		return nil, fmt.Errorf("user_address is required")
+	}
+
+	fileName := c.Query("file_name")
+	if fileName == "" {
+		return nil, fmt.Errorf("file_name is required")
+	}
+
+	fileInfo, err := database.QueryFileInfoByName(s.db, userAddress, fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file %s: %v", fileName, err)
+	}
+
+	transitions, err := database.QueryFileTransitions(s.db, fileInfo.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history of file %s: %v", fileName, err)
+	}
+
+	history := make([]FileTransitionInfo, 0, len(transitions))
+	for _, transition := range transitions {
+		history = append(history, FileTransitionInfo{
+			From:    string(transition.FromStatus),
+			To:      string(transition.ToStatus),
+			Attempt: transition.Attempt,
+			Error:   transition.Error,
+			Time:    transition.CreatedAt,
+		})
+	}
+	return history, nil
+}
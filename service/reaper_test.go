@@ -0,0 +1,119 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipfs-force-community/ark-eternal/database"
+	"github.com/ipfs-force-community/ark-eternal/pdp/pdptest"
+)
+
+// stuckEnv returns a service whose file is confirming, the message adding
+// its root never landing until the clock moves past the confirmation delay.
+func stuckEnv(t *testing.T) (*testEnv, *testClock, *database.FileInfo, *database.Replica) {
+	t.Helper()
+
+	clock := &testClock{now: calibrationGenesis}
+	env := newTestEnv(t, pdptest.Options{Now: clock.Now, ConfirmationDelay: time.Hour})
+	env.upload("stuck", randomContent(1<<20))
+	fileInfo := env.schedule("stuck", database.StatusConfirming)
+
+	replicas, err := database.QueryReplicas(env.svc.db, fileInfo.ID)
+	if err != nil || len(replicas) != 1 || replicas[0].State != database.ReplicaConfirming || replicas[0].TxHash == "" {
+		t.Fatalf("replicas: %+v %v", replicas, err)
+	}
+	return env, clock, fileInfo, &replicas[0]
+}
+
+// proofSetRoots returns the number of roots counted in the active proof set.
+func proofSetRoots(t *testing.T, env *testEnv) int {
+	t.Helper()
+
+	ps, err := database.QueryProofSetByState(env.svc.db, env.svc.primary().Name, database.ProofSetActive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ps.Roots
+}
+
+func TestReapFileWithAdditionInFlight(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		landed bool
+	}{
+		{name: "pending"},
+		{name: "landed", landed: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			env, clock, fileInfo, replica := stuckEnv(t)
+			if tt.landed {
+				clock.advance(int(time.Hour / (30 * time.Second)))
+			}
+			roots := proofSetRoots(t, env)
+
+			if err := env.svc.reapFile(fileInfo, time.Hour, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			reaped, err := database.QueryFileInfoByID(env.svc.db, fileInfo.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reaped.Status != database.StatusConfirming || reaped.Attempts != 0 {
+				t.Fatalf("file: %s after %d attempts", reaped.Status, reaped.Attempts)
+			}
+			replicas, err := database.QueryReplicas(env.svc.db, fileInfo.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replicas[0].State != database.ReplicaConfirming || replicas[0].TxHash != replica.TxHash {
+				t.Fatalf("replica: %+v", replicas[0])
+			}
+			if n := proofSetRoots(t, env); n != roots {
+				t.Fatalf("proof set counts %d roots, want %d", n, roots)
+			}
+		})
+	}
+}
+
+func TestReapFileWithoutAdditionInFlight(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		maxRetries int
+		status     database.Status
+		state      database.ReplicaState
+	}{
+		{name: "retried", maxRetries: 3, status: database.StatusPending, state: database.ReplicaAddingRoots},
+		{name: "out of retries", maxRetries: 0, status: database.StatusFailed, state: database.ReplicaFailed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			env, clock, fileInfo, replica := stuckEnv(t)
+			env.pdp.Revert(replica.TxHash)
+			clock.advance(int(time.Hour / (30 * time.Second)))
+			roots := proofSetRoots(t, env)
+
+			if err := env.svc.reapFile(fileInfo, time.Hour, tt.maxRetries); err != nil {
+				t.Fatal(err)
+			}
+
+			reaped, err := database.QueryFileInfoByID(env.svc.db, fileInfo.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reaped.Status != tt.status {
+				t.Fatalf("file: %s, want %s", reaped.Status, tt.status)
+			}
+			replicas, err := database.QueryReplicas(env.svc.db, fileInfo.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replicas[0].State != tt.state {
+				t.Fatalf("replica: %s, want %s", replicas[0].State, tt.state)
+			}
+			// The released root no longer counts towards its proof set.
+			if n := proofSetRoots(t, env); n != roots-1 {
+				t.Fatalf("proof set counts %d roots, want %d", n, roots-1)
+			}
+		})
+	}
+}
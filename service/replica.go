@@ -0,0 +1,275 @@
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/ipfs/go-cid"
+
+	"github.com/ipfs-force-community/ark-eternal/database"
+	"github.com/ipfs-force-community/ark-eternal/pdp"
+)
+
+// replicateFiles records the missing replicas of files and copies the
+// pieces of the replicas being uploaded from the providers that hold them.
+func (s *Service) replicateFiles() {
+	fileInfos, err := database.QueryUnderReplicatedFiles(s.db, s.replicas)
+	if err != nil {
+		slog.Error("failed to query under-replicated files", "error", err)
+	}
+	for i := range fileInfos {
+		if err := s.addReplicas(&fileInfos[i]); err != nil {
+			slog.Error("failed to add replicas", "file_id", fileInfos[i].ID, "file_name", fileInfos[i].FileName, "error", err)
+		}
+	}
+
+	for _, p := range s.providers {
+		replicas, err := database.QueryReplicasByState(s.db, p.Name, database.ReplicaUploading)
+		if err != nil {
+			slog.Error("failed to query replicas", "provider", p.Name, "error", err)
+			continue
+		}
+
+		for _, replica := range replicas {
+			if s.ctx.Err() != nil {
+				return
+			}
+
+			if err := s.copyReplica(p, &replica); err != nil {
+				slog.Error("failed to copy replica", "provider", p.Name, "file_id", replica.FileID, "error", err)
+				if err := database.UpdateReplicaState(s.db, replica.ID, database.ReplicaUploading, err.Error()); err != nil {
+					slog.Error("failed to update replica state", "replica_id", replica.ID, "error", err)
+				}
+				continue
+			}
+
+			if err := database.UpdateReplicaState(s.db, replica.ID, database.ReplicaAddingRoots, ""); err != nil {
+				slog.Error("failed to update replica state", "replica_id", replica.ID, "error", err)
+				continue
+			}
+			slog.Info("replica copied", "provider", p.Name, "file_id", replica.FileID)
+		}
+	}
+}
+
+// addReplicas records replicas of a file with providers until it has the
+// configured number of live replicas. Providers that never held the file are
+// preferred over those that lost it or failed to hold it, which are retried
+// last. Providers the file was removed from are not used again.
+func (s *Service) addReplicas(fileInfo *database.FileInfo) error {
+	replicas, err := database.QueryReplicas(s.db, fileInfo.ID)
+	if err != nil {
+		return fmt.Errorf("failed to query replicas: %v", err)
+	}
+
+	states := make(map[string]database.ReplicaState, len(replicas))
+	live := 0
+	for _, replica := range replicas {
+		states[replica.Provider] = replica.State
+		if replica.State != database.ReplicaLost && replica.State != database.ReplicaFailed && replica.State != database.ReplicaRemoved {
+			live++
+		}
+	}
+
+	var candidates []*Provider
+	for _, p := range s.providers {
+		if _, ok := states[p.Name]; !ok {
+			candidates = append(candidates, p)
+		}
+	}
+	for _, p := range s.providers {
+		if state, ok := states[p.Name]; ok && (state == database.ReplicaLost || state == database.ReplicaFailed) {
+			candidates = append(candidates, p)
+		}
+	}
+
+	for _, p := range candidates[:min(s.replicas-live, len(candidates))] {
+		if err := database.InsertReplica(s.db, fileInfo.ID, p.Name, database.ReplicaUploading); err != nil {
+			return fmt.Errorf("failed to record replica with %s: %v", p.Name, err)
+		}
+		slog.Info("replicating file", "file_id", fileInfo.ID, "file_name", fileInfo.FileName, "provider", p.Name)
+	}
+
+	return nil
+}
+
+// copyReplica copies the pieces of a file to a provider from the other
+// providers holding them.
+func (s *Service) copyReplica(target *Provider, replica *database.Replica) error {
+	fileInfo, err := database.QueryFileInfoByID(s.db, replica.FileID)
+	if err != nil {
+		return fmt.Errorf("failed to query file: %v", err)
+	}
+
+	entry, _, err := s.rootEntry(fileInfo)
+	if err != nil {
+		return fmt.Errorf("failed to query renditions: %v", err)
+	}
+
+	// A provider re-replicating a root it dropped may still hold the
+	// pieces, in which case they are only checked to be there.
+	var sources []*Provider
+	for _, p := range s.pieceProviders(fileInfo.ID) {
+		if p != target {
+			sources = append(sources, p)
+		}
+	}
+	sources = append(sources, target)
+
+	for _, subroot := range entry.Subroots {
+		data, err := s.downloadPiece(s.ctx, sources, subroot.SubrootCID)
+		if err != nil {
+			return err
+		}
+
+		pieceCID, err := cid.Decode(subroot.SubrootCID)
+		if err != nil {
+			return fmt.Errorf("invalid piece CID %s: %v", subroot.SubrootCID, err)
+		}
+		digest, err := commcid.CIDToDataCommitmentV1(pieceCID)
+		if err != nil {
+			return fmt.Errorf("invalid piece CID %s: %v", subroot.SubrootCID, err)
+		}
+
+		req := &pdp.UploadPieceRequest{
+			Check: pdp.PieceCheck{
+				Name: "sha2-256-trunc254-padded",
+				Hash: hex.EncodeToString(digest),
+				Size: int64(len(data)),
+			},
+		}
+		err = retry(s.ctx, "copy piece "+subroot.SubrootCID, func() error {
+			_, err := target.Client.UploadPiece(s.ctx, req, bytes.NewReader(data))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upload piece %s: %w", subroot.SubrootCID, err)
+		}
+	}
+
+	return nil
+}
+
+// replicaProviders returns the providers holding the pieces of a file, those
+// that added its root first.
+func (s *Service) replicaProviders(fileID uint) []*Provider {
+	return s.providersByState(fileID, database.ReplicaCompleted, database.ReplicaConfirming, database.ReplicaAddingRoots)
+}
+
+// pieceProviders returns the providers a file can be copied from. Providers
+// that dropped the root may still serve its pieces, so they come last.
+func (s *Service) pieceProviders(fileID uint) []*Provider {
+	return s.providersByState(fileID, database.ReplicaCompleted, database.ReplicaConfirming, database.ReplicaAddingRoots, database.ReplicaLost)
+}
+
+// providersByState returns the providers of the replicas of a file in the
+// given states, in the order of the states.
+func (s *Service) providersByState(fileID uint, states ...database.ReplicaState) []*Provider {
+	replicas, err := database.QueryReplicas(s.db, fileID)
+	if err != nil {
+		slog.Error("failed to query replicas", "file_id", fileID, "error", err)
+		return []*Provider{s.primary()}
+	}
+
+	var providers []*Provider
+	for _, state := range states {
+		for _, replica := range replicas {
+			if replica.State != state {
+				continue
+			}
+			if p := s.provider(replica.Provider); p != nil {
+				providers = append(providers, p)
+			}
+		}
+	}
+
+	return providers
+}
+
+// Repair periodically checks that the providers still hold the roots of the
+// completed replicas. Replicas whose root was dropped are marked as lost, so
+// that the scheduler replicates the file again.
+func (s *Service) Repair(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	slog.Info("repair loop started", "interval", interval)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			for _, p := range s.providers {
+				if err := s.checkRoots(p); err != nil {
+					slog.Error("failed to check roots", "provider", p.Name, "error", err)
+				}
+			}
+		}
+	}
+}
+
+// checkRoots marks the completed replicas with a provider whose root is no
+// longer in their proof set as lost.
+func (s *Service) checkRoots(p *Provider) error {
+	sets, err := database.QueryProvingProofSets(s.db, p.Name)
+	if err != nil {
+		return fmt.Errorf("failed to query proof sets: %v", err)
+	}
+
+	for _, set := range sets {
+		roots := make(map[string]bool)
+		ps, err := p.Client.GetProofSet(s.ctx, uint64(set.ProofSetID))
+		switch {
+		case errors.Is(err, pdp.ErrNotFound):
+			// The whole proof set is gone, and with it all its roots.
+			slog.Warn("proof set not found", "provider", p.Name, "proof_set_id", set.ProofSetID)
+			if err := database.UpdateProofSetState(s.db, set.ID, database.ProofSetFailed, "proof set not found"); err != nil {
+				return fmt.Errorf("failed to update proof set state: %v", err)
+			}
+		case err != nil:
+			return fmt.Errorf("failed to get proof set %d: %w", set.ProofSetID, err)
+		default:
+			for _, root := range ps.Roots {
+				roots[root.RootCID] = true
+			}
+		}
+
+		replicas, err := database.QueryCompletedReplicas(s.db, p.Name, set.ProofSetID)
+		if err != nil {
+			return fmt.Errorf("failed to query replicas: %v", err)
+		}
+		for _, replica := range replicas {
+			fileInfo, err := database.QueryFileInfoByID(s.db, replica.FileID)
+			if err != nil {
+				slog.Error("failed to query file", "file_id", replica.FileID, "error", err)
+				continue
+			}
+			if roots[fileInfo.Root] {
+				continue
+			}
+
+			slog.Warn("provider dropped root", "provider", p.Name, "proof_set_id", set.ProofSetID, "file_id", fileInfo.ID, "root", fileInfo.Root)
+			msg := fmt.Sprintf("root dropped from proof set %d", set.ProofSetID)
+			if err := database.UpdateReplicaState(s.db, replica.ID, database.ReplicaLost, msg); err != nil {
+				slog.Error("failed to update replica state", "replica_id", replica.ID, "error", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// pieceSources describes the providers a piece is fetched from, for errors.
+func pieceSources(providers []*Provider) string {
+	names := make([]string, 0, len(providers))
+	for _, p := range providers {
+		names = append(names, p.Name)
+	}
+	return strings.Join(names, ", ")
+}
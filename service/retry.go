@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ipfs-force-community/ark-eternal/pdp"
+)
+
+const (
+	// maxAttempts bounds the attempts of a retried request.
+	maxAttempts = 5
+	// retryBaseDelay is the delay before the first retry, doubled after
+	// every further attempt up to retryMaxDelay.
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 30 * time.Second
+)
+
+// retryable reports whether err is a transient failure: a transport error,
+// a 5xx response or a 429 response.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var se *pdp.StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode == http.StatusTooManyRequests || errors.Is(se, pdp.ErrServer)
+	}
+
+	var ue *url.Error
+	return errors.As(err, &ue)
+}
+
+// retry calls fn until it succeeds, fails permanently or runs out of
+// attempts. Retries back off exponentially with jitter, unless the service
+// asked for a specific delay through Retry-After. It gives up without
+// waiting when the context expires before the next attempt.
+func retry(ctx context.Context, op string, fn func() error) error {
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == maxAttempts || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		wait := retryWait(err, delay)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return err
+		}
+		slog.Warn("retrying after transient failure", "operation", op, "attempt", attempt, "delay", wait, "error", err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+
+		delay = min(delay*2, retryMaxDelay)
+	}
+}
+
+// retryWait returns the time to wait before retrying after err, the current
+// backoff delay with jitter or the delay the service asked for. The latter
+// is capped at retryMaxDelay, so a service cannot stall a worker for long.
+func retryWait(err error, delay time.Duration) time.Duration {
+	var se *pdp.StatusError
+	if errors.As(err, &se) && se.RetryAfter > 0 {
+		return min(se.RetryAfter, retryMaxDelay)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ipfs-force-community/ark-eternal/pdp"
+)
+
+func TestRetryable(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "too many requests", err: &pdp.StatusError{StatusCode: http.StatusTooManyRequests}, want: true},
+		{name: "internal server error", err: &pdp.StatusError{StatusCode: http.StatusInternalServerError}, want: true},
+		{name: "service unavailable", err: &pdp.StatusError{StatusCode: http.StatusServiceUnavailable}, want: true},
+		{name: "bad request", err: &pdp.StatusError{StatusCode: http.StatusBadRequest}},
+		{name: "not found", err: &pdp.StatusError{StatusCode: http.StatusNotFound}},
+		{name: "conflict", err: &pdp.StatusError{StatusCode: http.StatusConflict}},
+		{name: "transport", err: &url.Error{Op: "Get", URL: "http://pdp", Err: errors.New("connection refused")}, want: true},
+		{name: "canceled", err: &url.Error{Op: "Get", URL: "http://pdp", Err: context.Canceled}},
+		{name: "other", err: errors.New("invalid piece")},
+	} {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("%s: retryable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		errs     []error
+		calls    int
+		wantFail bool
+	}{
+		{
+			name:  "too many requests",
+			errs:  []error{&pdp.StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Millisecond}},
+			calls: 2,
+		},
+		{
+			name: "server errors",
+			errs: []error{
+				&pdp.StatusError{StatusCode: http.StatusBadGateway, RetryAfter: time.Millisecond},
+				&pdp.StatusError{StatusCode: http.StatusServiceUnavailable, RetryAfter: time.Millisecond},
+			},
+			calls: 3,
+		},
+		{
+			name:     "persistent server error",
+			errs:     repeatErr(&pdp.StatusError{StatusCode: http.StatusServiceUnavailable, RetryAfter: time.Millisecond}, maxAttempts+1),
+			calls:    maxAttempts,
+			wantFail: true,
+		},
+		{
+			name:     "client error",
+			errs:     []error{&pdp.StatusError{StatusCode: http.StatusBadRequest}},
+			calls:    1,
+			wantFail: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retry(context.Background(), "test", func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if calls != tt.calls {
+				t.Fatalf("%d calls, want %d", calls, tt.calls)
+			}
+			if (err != nil) != tt.wantFail {
+				t.Fatalf("error: %v", err)
+			}
+		})
+	}
+}
+
+func repeatErr(err error, n int) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+func TestRetryWait(t *testing.T) {
+	if wait := retryWait(&pdp.StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: 2 * time.Second}, retryBaseDelay); wait != 2*time.Second {
+		t.Errorf("Retry-After of 2s: waits %v", wait)
+	}
+	if wait := retryWait(&pdp.StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: 24 * time.Hour}, retryBaseDelay); wait != retryMaxDelay {
+		t.Errorf("Retry-After of a day: waits %v, want %v", wait, retryMaxDelay)
+	}
+	for i := 0; i < 100; i++ {
+		if wait := retryWait(&pdp.StatusError{StatusCode: http.StatusServiceUnavailable}, 4*time.Second); wait < 2*time.Second || wait > 4*time.Second {
+			t.Fatalf("backoff of 4s: waits %v", wait)
+		}
+	}
+}
+
+func TestRetryStopsBeforeDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	calls := 0
+	start := time.Now()
+	err := retry(ctx, "test", func() error {
+		calls++
+		return &pdp.StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: 10 * time.Second}
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("%d calls, error: %v", calls, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("waited %v for a retry past the deadline", elapsed)
+	}
+}
@@ -3,27 +3,46 @@ package service
 import (
 	"context"
 	"crypto/ecdsa"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 
 	"github.com/ipfs-force-community/ark-eternal/database"
+	"github.com/ipfs-force-community/ark-eternal/pdp"
 )
 
 // Service represents the Ark Eternal service.
 type Service struct {
-	ctx         context.Context
-	srv         *http.Server
-	db          *gorm.DB
-	privateKey  *ecdsa.PrivateKey
-	proofSetID  int
-	serviceURL  string
-	serviceName string
+	ctx        context.Context
+	srv        *http.Server
+	db         *gorm.DB
+	privateKey *ecdsa.PrivateKey
+	// providers holds the PDP providers archives are replicated to, the
+	// first one receiving the uploads.
+	providers []*Provider
+	replicas  int
+	profiles  map[string]*CaptureProfile
+	pool      *BrowserPool
+	// spoolDir holds the captures of upload jobs until their files are
+	// recorded.
+	spoolDir string
+	// maxUploadSize bounds the files uploaded directly, 0 disables the
+	// limit.
+	maxUploadSize int64
+	// unverifiedRanges makes ranged downloads fetch only the requested part
+	// of the pieces, which cannot be checked against their CIDs.
+	unverifiedRanges bool
+
+	// jobNotify wakes up idle upload workers when a job is queued.
+	jobNotify chan struct{}
+	claimMu   sync.Mutex
 }
 
 // NewService creates a new instance of the Service.
@@ -31,17 +50,27 @@ func NewService(
 	ctx context.Context,
 	db *gorm.DB,
 	privateKey *ecdsa.PrivateKey,
-	proofSetID int,
-	serviceURL string,
-	serviceName string,
+	providers []*Provider,
+	replicas int,
+	profiles map[string]*CaptureProfile,
+	pool *BrowserPool,
+	spoolDir string,
+	maxUploadSize int64,
+	unverifiedRanges bool,
 ) *Service {
 	s := &Service{
-		ctx:         ctx,
-		db:          db,
-		privateKey:  privateKey,
-		proofSetID:  proofSetID,
-		serviceURL:  serviceURL,
-		serviceName: serviceName,
+		ctx:        ctx,
+		db:         db,
+		privateKey: privateKey,
+		providers:  providers,
+		replicas:   min(max(replicas, 1), len(providers)),
+		profiles:   profiles,
+		pool:       pool,
+		spoolDir:   spoolDir,
+		jobNotify:  make(chan struct{}, 1),
+
+		maxUploadSize:    maxUploadSize,
+		unverifiedRanges: unverifiedRanges,
 	}
 
 	r := s.registerRoutes()
@@ -58,8 +87,9 @@ func (s *Service) registerRoutes() *gin.Engine {
 
 	r.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization, Range, If-Range, If-None-Match")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "Accept-Ranges, Content-Range, Content-Disposition, ETag")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(http.StatusNoContent)
 			return
@@ -74,28 +104,77 @@ func (s *Service) registerRoutes() *gin.Engine {
 	})
 
 	r.POST("/upload", func(c *gin.Context) {
-		if err := s.uploadFile(c); err != nil {
-			slog.Error("failed to upload file", "error", err)
+		jobID, err := s.uploadFile(c)
+		if err != nil {
+			slog.Error("failed to queue upload", "error", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"error": err.Error(),
 			})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{
-			"message": "file uploaded successfully",
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "upload queued",
+			"job_id":  jobID,
 		})
 	})
 
-	r.GET("/download", func(c *gin.Context) {
-		if err := s.downloadFile(c); err != nil {
-			slog.Error("failed to download file", "error", err)
+	r.POST("/jobs/:id/retry", func(c *gin.Context) {
+		if err := s.retryJob(c); err != nil {
+			slog.Error("failed to retry job", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "upload queued",
+		})
+	})
+
+	r.GET("/jobs/:id", func(c *gin.Context) {
+		job, err := s.jobStatus(c)
+		if err != nil {
+			slog.Error("failed to get job status", "error", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"error": err.Error(),
 			})
 			return
 		}
+		c.JSON(http.StatusOK, job)
+	})
+
+	r.POST("/upload/file", func(c *gin.Context) {
+		jobID, err := s.uploadRawFile(c)
+		if err != nil {
+			slog.Error("failed to upload raw file", "error", err)
+			c.JSON(uploadErrorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "upload queued",
+			"job_id":  jobID,
+		})
 	})
 
+	download := func(c *gin.Context) {
+		if err := s.downloadFile(c); err != nil {
+			slog.Error("failed to download file", "error", err)
+			// A streamed response cannot be turned into an error anymore.
+			if c.Writer.Written() {
+				abortStream(c)
+				return
+			}
+			c.JSON(downloadErrorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+	r.GET("/download", download)
+	r.HEAD("/download", download)
+
 	r.GET("/files", func(c *gin.Context) {
 		files, err := s.listFiles(c)
 		if err != nil {
@@ -108,16 +187,57 @@ func (s *Service) registerRoutes() *gin.Engine {
 		c.JSON(http.StatusOK, files)
 	})
 
-	r.GET("/:cid", func(c *gin.Context) {
-		if err := s.fetchFileByRootCID(c); err != nil {
-			slog.Error("failed to fetch file by root CID", "error", err)
+	r.GET("/files/history", func(c *gin.Context) {
+		history, err := s.fileHistory(c)
+		if err != nil {
+			slog.Error("failed to get file history", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, history)
+	})
+
+	r.GET("/proofs/:cid", func(c *gin.Context) {
+		history, err := s.proofHistory(c)
+		if err != nil {
+			slog.Error("failed to get proof history", "error", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"error": err.Error(),
 			})
 			return
 		}
+		c.JSON(http.StatusOK, history)
+	})
+
+	r.GET("/pool/stats", func(c *gin.Context) {
+		if s.pool == nil {
+			c.JSON(http.StatusOK, gin.H{
+				"enabled": false,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, s.pool.Stats())
 	})
 
+	fetchByRoot := func(c *gin.Context) {
+		if err := s.fetchFileByRootCID(c); err != nil {
+			slog.Error("failed to fetch file by root CID", "error", err)
+			// A streamed response cannot be turned into an error anymore.
+			if c.Writer.Written() {
+				abortStream(c)
+				return
+			}
+			c.JSON(downloadErrorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+	r.GET("/:cid", fetchByRoot)
+	r.HEAD("/:cid", fetchByRoot)
+
 	return r
 }
 
@@ -137,6 +257,31 @@ func (s *Service) Schedule() {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
+	// Proof sets and files recorded before replication was configured
+	// belong to the primary provider.
+	if err := database.AssignProofSetProvider(s.db, s.primary().Name); err != nil {
+		slog.Error("failed to assign proof sets to the primary provider", "error", err)
+	}
+	if n, err := database.BackfillReplicas(s.db, s.primary().Name); err != nil {
+		slog.Error("failed to record replicas of existing files", "error", err)
+	} else if n > 0 {
+		slog.Info("recorded replicas of existing files", "count", n, "provider", s.primary().Name)
+	}
+	if n, err := database.AdoptLegacyProofSets(s.db, s.primary().Name); err != nil {
+		slog.Error("failed to adopt proof sets of existing files", "error", err)
+	} else if n > 0 {
+		slog.Info("adopted proof sets of existing files", "count", n, "provider", s.primary().Name)
+	}
+
+	for _, p := range s.providers {
+		if p.ProofSets.ID == 0 {
+			continue
+		}
+		if err := database.AdoptProofSet(s.db, p.Name, p.ProofSets.ID); err != nil {
+			slog.Error("failed to adopt proof set", "provider", p.Name, "proof_set_id", p.ProofSets.ID, "error", err)
+		}
+	}
+
 	slog.Info("scheduler started, running every 10 seconds")
 	for {
 		select {
@@ -152,43 +297,372 @@ func (s *Service) Schedule() {
 }
 
 func (s *Service) performScheduledTask() error {
-	fileInfos, err := database.QueryPendingInfo(s.db)
-	if err != nil {
-		return fmt.Errorf("failed to query pending data: %v", err)
+	s.replicateFiles()
+
+	for _, p := range s.providers {
+		if err := s.addRoots(p); err != nil {
+			slog.Error("failed to add roots", "provider", p.Name, "error", err)
+		}
+		if err := s.confirmRoots(p); err != nil {
+			slog.Error("failed to confirm roots", "provider", p.Name, "error", err)
+		}
 	}
 
-	// TODO: If the status remains pending for a long time, it should be marked as failed.
+	return nil
+}
+
+// pendingRoot is the root of a replica waiting to be added to a proof set.
+type pendingRoot struct {
+	replica  database.Replica
+	fileInfo *database.FileInfo
+	entry    pdp.RootEntry
+	size     uint64
+}
+
+// addRoots adds the roots of the replicas held by a provider to its proof
+// sets. The roots are grouped by proof set and added in batches of at most
+// BatchRoots roots, each sent in a single message. A failure to get the
+// active proof set only holds back the roots waiting for one, and is
+// returned once the others were added.
+func (s *Service) addRoots(p *Provider) error {
+	// The proof set is checked even without pending replicas, so that one
+	// is ready by the first upload.
+	active, activeErr := s.activeProofSet(p)
 
-	jwtToken, err := createJWTToken(s.serviceName, s.privateKey)
+	replicas, err := database.QueryReplicasByState(s.db, p.Name, database.ReplicaAddingRoots)
 	if err != nil {
-		return fmt.Errorf("failed to create JWT token: %v", err)
-	}
-
-	for _, fileInfo := range fileInfos {
-		cids := strings.ReplaceAll(fileInfo.CIDs, " ", "+")
-		root := fmt.Sprintf("%s:%s", fileInfo.Root, cids)
-		if err := AddRoots("", s.serviceURL, jwtToken, fileInfo.ProofSetID, []string{root}); err != nil {
-			slog.Error("failed to add roots", "file_id", fileInfo.ID, "file_name", fileInfo.FileName, "error", err)
-			if !strings.Contains(err.Error(), "not found") {
-				if err := database.UpdateFileStatus(s.db, fileInfo.ID, database.StatusFailed); err != nil {
-					slog.Error("failed to update file info status", "file_id", fileInfo.ID, "file_name", fileInfo.FileName, "error", err)
-				}
+		return fmt.Errorf("failed to query pending replicas: %v", err)
+	}
+
+	// Replicas recorded for a given proof set are added to it, the others
+	// to the active proof set when their root is added.
+	assigned := make(map[int][]*pendingRoot)
+	var proofSetIDs []int
+	var unassigned []*pendingRoot
+	for _, replica := range replicas {
+		fileInfo, err := database.QueryFileInfoByID(s.db, replica.FileID)
+		if err != nil {
+			slog.Error("failed to query file", "file_id", replica.FileID, "error", err)
+			continue
+		}
+
+		entry, size, err := s.rootEntry(fileInfo)
+		if err != nil {
+			slog.Error("failed to query renditions", "file_id", fileInfo.ID, "file_name", fileInfo.FileName, "error", err)
+			continue
+		}
+
+		root := &pendingRoot{replica: replica, fileInfo: fileInfo, entry: entry, size: size}
+		if replica.ProofSetID == 0 {
+			unassigned = append(unassigned, root)
+			continue
+		}
+		if _, ok := assigned[replica.ProofSetID]; !ok {
+			proofSetIDs = append(proofSetIDs, replica.ProofSetID)
+		}
+		assigned[replica.ProofSetID] = append(assigned[replica.ProofSetID], root)
+	}
+
+	batchRoots := max(p.ProofSets.BatchRoots, 1)
+	for _, proofSetID := range proofSetIDs {
+		roots := assigned[proofSetID]
+		for len(roots) > 0 {
+			batch := roots[:min(batchRoots, len(roots))]
+			roots = roots[len(batch):]
+			s.recordAddedRoots(p, proofSetID, s.submitRoots(p, proofSetID, batch))
+		}
+	}
+
+	for len(unassigned) > 0 {
+		if active == nil {
+			if activeErr == nil {
+				slog.Info("waiting for a proof set to add roots to", "provider", p.Name, "roots", len(unassigned))
 			}
+			break
+		}
+
+		// The batch stops where the proof set would be full, the remaining
+		// roots wait for the next proof set.
+		usage := database.ProofSet{Roots: active.Roots, Bytes: active.Bytes}
+		n := 0
+		for n < len(unassigned) && n < batchRoots && !p.ProofSets.full(&usage) {
+			usage.Roots++
+			usage.Bytes += unassigned[n].size
+			n++
+		}
+		batch := unassigned[:n]
+		unassigned = unassigned[n:]
 
+		added := s.submitRoots(p, active.ProofSetID, batch)
+		s.recordAddedRoots(p, active.ProofSetID, added)
+		for _, root := range added {
+			active.Roots++
+			active.Bytes += root.size
+		}
+		if p.ProofSets.full(active) {
+			active, activeErr = s.activeProofSet(p)
+		}
+	}
+
+	return activeErr
+}
+
+// submitRoots adds a batch of roots to a proof set and returns those that
+// were added. A batch rejected by the service is split in halves until the
+// rejected roots are isolated, so that each error is recorded on the replica
+// it belongs to. Transient errors leave the whole batch for a later run.
+func (s *Service) submitRoots(p *Provider, proofSetID int, batch []*pendingRoot) []*pendingRoot {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	req := &pdp.AddRootsRequest{}
+	for _, root := range batch {
+		req.Roots = append(req.Roots, root.entry)
+	}
+
+	res, err := p.Client.AddRoots(s.ctx, uint64(proofSetID), req)
+	if err == nil {
+		slog.Info("roots added", "provider", p.Name, "proof_set_id", proofSetID, "roots", len(batch), "tx_hash", res.TxHash)
+		for _, root := range batch {
+			s.submitRoot(p, proofSetID, root, res.TxHash)
+		}
+		return batch
+	}
+
+	slog.Error("failed to add roots", "provider", p.Name, "proof_set_id", proofSetID, "roots", len(batch), "error", err)
+	if len(batch) > 1 && !retryable(err) && s.ctx.Err() == nil {
+		half := len(batch) / 2
+		return append(s.submitRoots(p, proofSetID, batch[:half]), s.submitRoots(p, proofSetID, batch[half:])...)
+	}
+
+	for _, root := range batch {
+		// The service may not know the pieces yet, in which case the root
+		// is added on a later run.
+		if len(batch) > 1 || retryable(err) || errors.Is(err, pdp.ErrNotFound) {
+			if err := database.UpdateReplicaState(s.db, root.replica.ID, database.ReplicaAddingRoots, err.Error()); err != nil {
+				slog.Error("failed to update replica state", "replica_id", root.replica.ID, "error", err)
+			}
 			continue
 		}
 
-		if err := database.UpdateFileStatus(s.db, fileInfo.ID, database.StatusCompleted); err != nil {
-			slog.Error("failed to update file info status", "file_id", fileInfo.ID, "file_name", fileInfo.FileName, "error", err)
+		if err := database.UpdateReplicaState(s.db, root.replica.ID, database.ReplicaFailed, err.Error()); err != nil {
+			slog.Error("failed to update replica state", "replica_id", root.replica.ID, "error", err)
+		}
+		s.failFileIfLost(root.fileInfo, err)
+	}
+	return nil
+}
+
+// submitRoot records the replica of a root sent to a proof set by the
+// message with the given hash, which waits to land on chain. Services that
+// do not report the message have their roots taken as added.
+func (s *Service) submitRoot(p *Provider, proofSetID int, root *pendingRoot, txHash string) {
+	if txHash == "" {
+		if err := database.SubmitReplica(s.db, root.replica.ID, proofSetID, ""); err != nil {
+			slog.Error("failed to update replica state", "replica_id", root.replica.ID, "error", err)
+			return
+		}
+		s.confirmRoot(p, &root.replica, root.fileInfo, proofSetID, 0, 0)
+		return
+	}
+
+	if err := database.SubmitReplica(s.db, root.replica.ID, proofSetID, txHash); err != nil {
+		slog.Error("failed to update replica state", "replica_id", root.replica.ID, "error", err)
+		return
+	}
+
+	fileInfo := root.fileInfo
+	if fileInfo.Status != database.StatusPending {
+		return
+	}
+	if err := database.TransitionFile(s.db, fileInfo.ID, database.StatusConfirming, "", nil); err != nil {
+		slog.Error("failed to update file info status", "file_id", fileInfo.ID, "file_name", fileInfo.FileName, "error", err)
+		return
+	}
+	if err := database.UpdateJobStateByFile(s.db, fileInfo.ID, database.JobConfirming, ""); err != nil {
+		slog.Error("failed to update job state", "file_id", fileInfo.ID, "file_name", fileInfo.FileName, "error", err)
+	}
+}
+
+// confirmRoot records the root of a replica as added to a proof set with
+// the given ID at the given epoch. The file is completed by its first
+// replica.
+func (s *Service) confirmRoot(p *Provider, replica *database.Replica, fileInfo *database.FileInfo, proofSetID int, rootID uint64, epoch int64) {
+	if err := database.CompleteReplica(s.db, replica.ID, rootID, epoch); err != nil {
+		slog.Error("failed to update replica state", "replica_id", replica.ID, "error", err)
+		return
+	}
+
+	if fileInfo.Status != database.StatusPending && fileInfo.Status != database.StatusConfirming {
+		slog.Info("replica root added", "file_id", fileInfo.ID, "file_name", fileInfo.FileName, "provider", p.Name, "proof_set_id", proofSetID, "root_id", rootID)
+		return
+	}
+
+	if err := database.CompleteFile(s.db, fileInfo.ID, proofSetID); err != nil {
+		slog.Error("failed to update file info status", "file_id", fileInfo.ID, "file_name", fileInfo.FileName, "error", err)
+		return
+	}
+	fileInfo.Status = database.StatusCompleted
+
+	if err := database.UpdateJobStateByFile(s.db, fileInfo.ID, database.JobProving, ""); err != nil {
+		slog.Error("failed to update job state", "file_id", fileInfo.ID, "file_name", fileInfo.FileName, "error", err)
+	}
+
+	slog.Info("updated file info status to completed", "file_id", fileInfo.ID, "file_name", fileInfo.FileName, "provider", p.Name, "proof_set_id", proofSetID, "root_id", rootID)
+}
+
+// confirmRoots polls the status of the messages adding the roots of the
+// replicas held by a provider. Replicas are completed once their message
+// landed, and failed if it reverted.
+func (s *Service) confirmRoots(p *Provider) error {
+	replicas, err := database.QueryConfirmingReplicas(s.db, p.Name)
+	if err != nil {
+		return fmt.Errorf("failed to query confirming replicas: %v", err)
+	}
+
+	// The replicas of a message are contiguous and in the order their
+	// roots were sent.
+	for len(replicas) > 0 {
+		n := 1
+		for n < len(replicas) && replicas[n].TxHash == replicas[0].TxHash && replicas[n].ProofSetID == replicas[0].ProofSetID {
+			n++
+		}
+		batch := replicas[:n]
+		replicas = replicas[n:]
+
+		if err := s.confirmBatch(p, batch); err != nil {
+			slog.Error("failed to confirm roots", "provider", p.Name, "proof_set_id", batch[0].ProofSetID, "tx_hash", batch[0].TxHash, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// confirmBatch checks the status of the message adding the roots of the
+// given replicas.
+func (s *Service) confirmBatch(p *Provider, batch []database.Replica) error {
+	proofSetID, txHash := batch[0].ProofSetID, batch[0].TxHash
+	status, err := p.Client.GetRootAdditionStatus(s.ctx, uint64(proofSetID), txHash)
+	if err != nil {
+		return err
+	}
+	if status.AddMessageOK == nil {
+		return nil
+	}
+
+	if !*status.AddMessageOK {
+		reason := fmt.Errorf("message %s adding the roots to proof set %d reverted", txHash, proofSetID)
+		slog.Error("roots addition reverted", "provider", p.Name, "proof_set_id", proofSetID, "tx_hash", txHash, "roots", len(batch))
+
+		var size uint64
+		for _, replica := range batch {
+			if err := database.UpdateReplicaState(s.db, replica.ID, database.ReplicaFailed, reason.Error()); err != nil {
+				slog.Error("failed to update replica state", "replica_id", replica.ID, "error", err)
+				continue
+			}
+
+			fileInfo, err := database.QueryFileInfoByID(s.db, replica.FileID)
+			if err != nil {
+				slog.Error("failed to query file", "file_id", replica.FileID, "error", err)
+				continue
+			}
+			if _, rootSize, err := s.rootEntry(fileInfo); err == nil {
+				size += rootSize
+			}
+			s.failFileIfLost(fileInfo, reason)
+		}
+
+		// The roots no longer count towards the usage of the proof set.
+		if err := database.ReleaseProofSetUsage(s.db, p.Name, proofSetID, len(batch), size); err != nil {
+			slog.Error("failed to update proof set usage", "provider", p.Name, "proof_set_id", proofSetID, "error", err)
+		}
+		return nil
+	}
+
+	if len(status.ConfirmedRootIDs) != len(batch) {
+		slog.Warn("unexpected number of confirmed roots", "provider", p.Name, "proof_set_id", proofSetID, "tx_hash", txHash,
+			"roots", len(batch), "confirmed", len(status.ConfirmedRootIDs))
+	}
+	for i := range batch {
+		fileInfo, err := database.QueryFileInfoByID(s.db, batch[i].FileID)
+		if err != nil {
+			slog.Error("failed to query file", "file_id", batch[i].FileID, "error", err)
 			continue
 		}
 
-		slog.Info("updated file info status to completed", "file_id", fileInfo.ID, "file_name", fileInfo.FileName)
+		var rootID uint64
+		if len(status.ConfirmedRootIDs) == len(batch) {
+			rootID = status.ConfirmedRootIDs[i]
+		}
+		s.confirmRoot(p, &batch[i], fileInfo, proofSetID, rootID, status.Epoch)
 	}
 
 	return nil
 }
 
+// recordAddedRoots adds the roots added to a proof set to its usage.
+func (s *Service) recordAddedRoots(p *Provider, proofSetID int, added []*pendingRoot) {
+	if len(added) == 0 {
+		return
+	}
+
+	var size uint64
+	for _, root := range added {
+		size += root.size
+	}
+	if err := database.AddProofSetUsage(s.db, p.Name, proofSetID, len(added), size); err != nil {
+		slog.Error("failed to update proof set usage", "provider", p.Name, "proof_set_id", proofSetID, "error", err)
+	}
+}
+
+// rootEntry returns the root of a file with its subroots, the pieces of its
+// content followed by those of its renditions, and their padded size.
+func (s *Service) rootEntry(fileInfo *database.FileInfo) (pdp.RootEntry, uint64, error) {
+	subroots := strings.Fields(fileInfo.CIDs)
+	size := fileInfo.Size
+	renditions, err := database.QueryRenditions(s.db, fileInfo.ID)
+	if err != nil {
+		return pdp.RootEntry{}, 0, err
+	}
+	for _, rendition := range renditions {
+		subroots = append(subroots, strings.Fields(rendition.CIDs)...)
+		size += rendition.Size
+	}
+
+	entry := pdp.RootEntry{RootCID: fileInfo.Root}
+	for _, subroot := range subroots {
+		entry.Subroots = append(entry.Subroots, pdp.SubrootEntry{SubrootCID: subroot})
+	}
+	return entry, size, nil
+}
+
+// failFileIfLost marks a file whose root was not added yet and its job as
+// failed once none of its replicas can hold it anymore.
+func (s *Service) failFileIfLost(fileInfo *database.FileInfo, cause error) {
+	if fileInfo.Status != database.StatusPending && fileInfo.Status != database.StatusConfirming {
+		return
+	}
+
+	replicas, err := database.QueryReplicas(s.db, fileInfo.ID)
+	if err != nil {
+		slog.Error("failed to query replicas", "file_id", fileInfo.ID, "error", err)
+		return
+	}
+	for _, replica := range replicas {
+		if replica.State == database.ReplicaUploading || replica.State == database.ReplicaAddingRoots || replica.State == database.ReplicaConfirming {
+			return
+		}
+	}
+
+	if err := database.TransitionFile(s.db, fileInfo.ID, database.StatusFailed, cause.Error(), nil); err != nil {
+		slog.Error("failed to update file info status", "file_id", fileInfo.ID, "file_name", fileInfo.FileName, "error", err)
+	}
+	if err := database.UpdateJobStateByFile(s.db, fileInfo.ID, database.JobFailed, cause.Error()); err != nil {
+		slog.Error("failed to update job state", "file_id", fileInfo.ID, "file_name", fileInfo.FileName, "error", err)
+	}
+}
+
 // Close gracefully shuts down the service.
 func (s *Service) Close() error {
 	if s.srv != nil {
@@ -0,0 +1,224 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ipfs-force-community/ark-eternal/database"
+	"github.com/ipfs-force-community/ark-eternal/pdp"
+	"github.com/ipfs-force-community/ark-eternal/pdp/pdptest"
+)
+
+// testEnv is a service storing its files with a fake PDP provider.
+type testEnv struct {
+	t    *testing.T
+	pdp  *pdptest.Server
+	svc  *Service
+	http *httptest.Server
+}
+
+func newTestEnv(t *testing.T, opts pdptest.Options) *testEnv {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	fake := pdptest.NewServer(opts)
+	pdpServer := httptest.NewServer(fake)
+	t.Cleanup(pdpServer.Close)
+
+	db, err := database.InitDB(filepath.Join(t.TempDir(), "ark.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	provider := &Provider{
+		Name: DefaultProvider,
+		Client: pdp.NewClient(pdp.Config{
+			URL:   pdpServer.URL,
+			Token: func() (string, error) { return "token", nil },
+		}),
+		ProofSets: ProofSetConfig{RecordKeeper: "0x0000000000000000000000000000000000000001", BatchRoots: 50},
+	}
+	svc := NewService(ctx, db, nil, []*Provider{provider}, 1, nil, nil, t.TempDir(), 0, false)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		svc.ProcessJobs(1)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	srv := httptest.NewServer(svc.srv.Handler)
+	t.Cleanup(srv.Close)
+
+	return &testEnv{t: t, pdp: fake, svc: svc, http: srv}
+}
+
+// do sends a request to the service and returns the response with its body.
+func (e *testEnv) do(method, path string, body io.Reader, header map[string]string) (*http.Response, []byte) {
+	e.t.Helper()
+
+	req, err := http.NewRequest(method, e.http.URL+path, body)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return resp, data
+}
+
+// store uploads content and runs the scheduler until its root is added and
+// confirmed.
+func (e *testEnv) store(fileName string, content []byte) *database.FileInfo {
+	e.t.Helper()
+
+	e.upload(fileName, content)
+	return e.schedule(fileName, database.StatusCompleted)
+}
+
+// upload queues the upload of content.
+func (e *testEnv) upload(fileName string, content []byte) {
+	e.t.Helper()
+
+	resp, data := e.do(http.MethodPost, "/upload/file?user_address=user&file_name="+fileName, bytes.NewReader(content), map[string]string{"Content-Type": "video/mp4"})
+	if resp.StatusCode != http.StatusAccepted {
+		e.t.Fatalf("upload: %d %s", resp.StatusCode, data)
+	}
+}
+
+// schedule runs the scheduler until the uploaded file reaches the given
+// status.
+func (e *testEnv) schedule(fileName string, status database.Status) *database.FileInfo {
+	e.t.Helper()
+
+	deadline := time.Now().Add(20 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := e.svc.performScheduledTask(); err != nil {
+			e.t.Fatal(err)
+		}
+		fileInfo, err := database.QueryFileInfoByName(e.svc.db, "user", fileName)
+		if err == nil && fileInfo.Status == status {
+			return fileInfo
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	e.t.Fatalf("file %s did not become %s", fileName, status)
+	return nil
+}
+
+func randomContent(size int) []byte {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(content)
+	return content
+}
+
+func TestStoreAndDownload(t *testing.T) {
+	env := newTestEnv(t, pdptest.Options{})
+	content := randomContent(2*chunkSize + 1000)
+	fileInfo := env.store("archive", content)
+	if n := len(strings.Fields(fileInfo.CIDs)); n != 3 {
+		t.Fatalf("file has %d pieces, want 3", n)
+	}
+
+	resp, data := env.do(http.MethodGet, "/"+fileInfo.Root, nil, nil)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(data, content) {
+		t.Fatalf("download: %d, %d bytes", resp.StatusCode, len(data))
+	}
+}
+
+func TestAddRootsIsolatesRejectedRoot(t *testing.T) {
+	env := newTestEnv(t, pdptest.Options{})
+
+	// The files are recorded before the scheduler runs, so that their roots
+	// are sent in a single batch.
+	names := []string{"first", "rejected", "third", "fourth"}
+	for i, name := range names {
+		env.upload(name, randomContent(1<<20+i))
+	}
+	fileInfos := make(map[string]*database.FileInfo)
+	deadline := time.Now().Add(20 * time.Second)
+	for len(fileInfos) < len(names) && time.Now().Before(deadline) {
+		for _, name := range names {
+			if fileInfo, err := database.QueryFileInfoByName(env.svc.db, "user", name); err == nil {
+				fileInfos[name] = fileInfo
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(fileInfos) != len(names) {
+		t.Fatalf("%d of %d files were recorded", len(fileInfos), len(names))
+	}
+
+	env.pdp.Inject(pdptest.Fault{
+		Method: http.MethodPost,
+		Path:   "/pdp/proof-sets/",
+		Body:   fileInfos["rejected"].Root,
+		Status: http.StatusBadRequest,
+	})
+
+	for _, name := range names {
+		if name == "rejected" {
+			continue
+		}
+		env.schedule(name, database.StatusCompleted)
+	}
+
+	rejected, err := database.QueryFileInfoByID(env.svc.db, fileInfos["rejected"].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejected.Status != database.StatusFailed {
+		t.Fatalf("rejected file: %s", rejected.Status)
+	}
+	replicas, err := database.QueryReplicas(env.svc.db, rejected.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replicas) != 1 || replicas[0].State != database.ReplicaFailed || !strings.Contains(replicas[0].Error, "injected fault") {
+		t.Fatalf("replicas of the rejected file: %+v", replicas)
+	}
+
+	sets, err := database.QueryProvingProofSets(env.svc.db, env.svc.primary().Name)
+	if err != nil || len(sets) != 1 {
+		t.Fatalf("proof sets: %v %v", sets, err)
+	}
+	ps, err := env.svc.primary().Client.GetProofSet(context.Background(), uint64(sets[0].ProofSetID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := make(map[string]bool)
+	for _, root := range ps.Roots {
+		added[root.RootCID] = true
+	}
+	for _, name := range names {
+		if added[fileInfos[name].Root] != (name != "rejected") {
+			t.Errorf("root of %s added: %v", name, added[fileInfos[name].Root])
+		}
+	}
+}
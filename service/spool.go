@@ -0,0 +1,161 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ipfs-force-community/ark-eternal/database"
+)
+
+// contentSource is content that can be read at any offset, such as an
+// in-memory capture or a spooled file.
+type contentSource interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// spooledFile is a temporary file holding content that has to be read more
+// than once. It is removed when it is closed.
+type spooledFile struct {
+	*os.File
+	size int64
+}
+
+// spool copies r into a new spooled file.
+func spool(r io.Reader) (*spooledFile, error) {
+	f, err := os.CreateTemp("", "ark-spool-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %v", err)
+	}
+	sf := &spooledFile{File: f}
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		sf.Close()
+		return nil, fmt.Errorf("failed to spool content: %v", err)
+	}
+	sf.size = n
+
+	return sf, nil
+}
+
+// Size returns the size of the spooled content.
+func (f *spooledFile) Size() int64 {
+	return f.size
+}
+
+// Close closes and removes the file.
+func (f *spooledFile) Close() error {
+	err := f.File.Close()
+	if rmErr := os.Remove(f.Name()); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// spoolSource is a file of a job spool opened for reading. Unlike a spooled
+// file, it is kept when it is closed so that an interrupted job can resume
+// from it.
+type spoolSource struct {
+	*os.File
+	size int64
+}
+
+// Size returns the size of the spooled content.
+func (f *spoolSource) Size() int64 {
+	return f.size
+}
+
+// spoolPath returns the path of the file holding a part of a job spool.
+func (s *Service) spoolPath(spool, part string) string {
+	return filepath.Join(s.spoolDir, spool+"."+part)
+}
+
+// writeSpool writes a part of a job spool. The content is written to a
+// temporary file that is only renamed once synced, so a spool file is always
+// complete.
+func (s *Service) writeSpool(spool, part string, r io.Reader) error {
+	f, err := os.CreateTemp(s.spoolDir, spool+"."+part+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create spool file: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to spool %s: %w", part, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync spool file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close spool file: %v", err)
+	}
+
+	if err := os.Rename(f.Name(), s.spoolPath(spool, part)); err != nil {
+		return fmt.Errorf("failed to save spool file: %v", err)
+	}
+	return nil
+}
+
+// openSpool opens a part of a job spool.
+func (s *Service) openSpool(spool, part string) (*spoolSource, error) {
+	f, err := os.Open(s.spoolPath(spool, part))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spool file: %v", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to stat spool file: %v", err)
+	}
+
+	return &spoolSource{File: f, size: fi.Size()}, nil
+}
+
+// sweepFailedSpools removes the spools of the jobs that failed longer than
+// maxAge ago. They can no longer be retried from their spool, and a retry
+// captures their resource again.
+func (s *Service) sweepFailedSpools(maxAge time.Duration) {
+	jobs, err := database.QueryStaleFailedJobs(s.db, time.Now().Add(-maxAge))
+	if err != nil {
+		slog.Error("failed to query failed jobs", "error", err)
+		return
+	}
+
+	// Workers are kept from claiming a job while its spool is removed, so
+	// a job retried meanwhile is not resumed from a spool being removed.
+	s.claimMu.Lock()
+	defer s.claimMu.Unlock()
+
+	for _, job := range jobs {
+		cleared, err := database.ForgetJobSpool(s.db, job.ID)
+		if err != nil {
+			slog.Error("failed to clear job spool", "job_id", job.ID, "error", err)
+			continue
+		}
+		if !cleared {
+			continue
+		}
+
+		parts := append([]string{contentPart}, strings.Fields(job.Renditions)...)
+		s.removeSpool(job.Spool, parts)
+		slog.Info("removed spool of failed job", "job_id", job.ID, "spool", job.Spool)
+	}
+}
+
+// removeSpool removes the files of a job spool.
+func (s *Service) removeSpool(spool string, parts []string) {
+	for _, part := range parts {
+		if err := os.Remove(s.spoolPath(spool, part)); err != nil && !os.IsNotExist(err) {
+			slog.Warn("failed to remove spool file", "spool", spool, "part", part, "error", err)
+		}
+	}
+}
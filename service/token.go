@@ -31,6 +31,14 @@ func GetJWTToken(serviceName, keyPath string) (string, error) {
 	return jwtToken, nil
 }
 
+// TokenSource returns a function creating JWT tokens for the specified
+// service, as used to authenticate PDP requests.
+func TokenSource(serviceName string, privateKey *ecdsa.PrivateKey) func() (string, error) {
+	return func() (string, error) {
+		return createJWTToken(serviceName, privateKey)
+	}
+}
+
 // LoadPrivateKey loads the ECDSA private key from the specified path.
 func LoadPrivateKey(keyPath string) (*ecdsa.PrivateKey, error) {
 	file, err := os.Open(keyPath)
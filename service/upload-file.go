@@ -0,0 +1,153 @@
+package service
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ipfs-force-community/ark-eternal/database"
+)
+
+// maxFormFieldSize bounds the form fields preceding the file part.
+const maxFormFieldSize = 1 << 10
+
+// fileUpload is a file sent directly by the client.
+type fileUpload struct {
+	userAddress  string
+	fileName     string
+	originalName string
+	contentType  string
+	body         io.Reader
+}
+
+// errUploadTooLarge is returned when an upload is larger than the maximum
+// upload size.
+var errUploadTooLarge = errors.New("upload exceeds the maximum size")
+
+// uploadRawFile queues the upload of a file sent by the client instead of a
+// capture. The body is either multipart/form-data with the file in the "file"
+// part, or the file itself. It is never held in memory but spooled, so its
+// size is only bounded by the maximum upload size and by what a root can
+// hold, and the job starts from the spool as an interrupted job would.
+func (s *Service) uploadRawFile(c *gin.Context) (uint, error) {
+	limit := int64(maxRootContentSize)
+	if s.maxUploadSize > 0 {
+		limit = min(limit, s.maxUploadSize)
+	}
+	if c.Request.ContentLength > limit {
+		return 0, fmt.Errorf("%w of %d bytes", errUploadTooLarge, limit)
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+
+	fu, err := parseFileUpload(c)
+	if err != nil {
+		return 0, err
+	}
+
+	if fu.userAddress == "" {
+		return 0, fmt.Errorf("user_address is required")
+	}
+	if fu.fileName == "" {
+		fu.fileName = fu.originalName
+	}
+	if fu.fileName == "" {
+		return 0, fmt.Errorf("file_name is required")
+	}
+
+	br := bufio.NewReaderSize(fu.body, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	spool := "upload-" + strings.ToLower(rand.Text())
+	if err := s.writeSpool(spool, contentPart, br); err != nil {
+		return 0, err
+	}
+
+	jobID, err := database.InsertJob(s.db, &database.Job{
+		UserAddress:   fu.userAddress,
+		FileName:      fu.fileName,
+		Format:        string(formatRaw),
+		OriginalName:  fu.originalName,
+		Spool:         spool,
+		CaptureFormat: string(formatRaw),
+		MimeType:      sniffContentType(fu.contentType, head),
+	})
+	if err != nil {
+		s.removeSpool(spool, []string{contentPart})
+		return 0, fmt.Errorf("failed to queue upload job: %v", err)
+	}
+
+	s.notifyJobs()
+	return jobID, nil
+}
+
+// uploadErrorStatus returns the HTTP status of an upload error.
+func uploadErrorStatus(err error) int {
+	var maxErr *http.MaxBytesError
+	if errors.Is(err, errUploadTooLarge) || errors.As(err, &maxErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// parseFileUpload reads the upload metadata from the query string and, for
+// multipart bodies, from the form fields preceding the file part. The body of
+// the returned upload is the unread file content.
+func parseFileUpload(c *gin.Context) (*fileUpload, error) {
+	fu := &fileUpload{
+		userAddress: c.Query("user_address"),
+		fileName:    c.Query("file_name"),
+	}
+
+	if mediaType(c.ContentType()) != "multipart/form-data" {
+		fu.contentType = c.GetHeader("Content-Type")
+		fu.body = c.Request.Body
+		if _, params, err := mime.ParseMediaType(c.GetHeader("Content-Disposition")); err == nil && params["filename"] != "" {
+			fu.originalName = filepath.Base(params["filename"])
+		}
+		return fu, nil
+	}
+
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read multipart body: %w", err)
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("file part is required")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read multipart body: %w", err)
+		}
+
+		switch part.FormName() {
+		case "file":
+			fu.originalName = part.FileName()
+			fu.contentType = part.Header.Get("Content-Type")
+			fu.body = part
+			return fu, nil
+		case "user_address", "file_name":
+			value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read form field %s: %w", part.FormName(), err)
+			}
+			if part.FormName() == "user_address" {
+				fu.userAddress = string(value)
+			} else {
+				fu.fileName = string(value)
+			}
+		}
+	}
+}
@@ -1,277 +1,405 @@
 package service
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math/bits"
 	"net/http"
 	"strings"
-	"time"
+	"sync"
 
-	"github.com/PuerkitoBio/goquery"
-	"github.com/chromedp/chromedp"
 	"github.com/filecoin-project/go-commp-utils/nonffi"
 	commcid "github.com/filecoin-project/go-fil-commcid"
 	commp "github.com/filecoin-project/go-fil-commp-hashhash"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/gin-gonic/gin"
 	"github.com/ipfs/go-cid"
+	"gorm.io/gorm"
 
 	"github.com/ipfs-force-community/ark-eternal/database"
+	"github.com/ipfs-force-community/ark-eternal/pdp"
 )
 
 const chunkSize = 10 << 20
 
+// maxRootSize is the padded size of the pieces a root can hold, the size of
+// a 64GiB sector.
+const maxRootSize = 64 << 30
+
+// maxRootContentSize is the size of the largest content a root can hold,
+// that many full chunks.
+const maxRootContentSize = maxRootSize / (16 << 20) * chunkSize
+
+// errRootTooLarge is returned for content that does not fit in a root.
+var errRootTooLarge = errors.New("content exceeds the maximum root size")
+
+// uploadConcurrency bounds the pieces of one upload sent concurrently.
+const uploadConcurrency = 4
+
 type uploadRequest struct {
-	UserAddress string `json:"user_address"`
-	FileName    string `json:"file_name"`
-	ResourceURL string `json:"resource_url"`
+	UserAddress string   `json:"user_address"`
+	FileName    string   `json:"file_name"`
+	ResourceURL string   `json:"resource_url"`
+	Format      string   `json:"format"`
+	Renditions  []string `json:"renditions"`
+	Profile     string   `json:"profile"`
 }
 
-func (s *Service) uploadFile(c *gin.Context) error {
+// uploadFile validates an upload request and queues it as a job, returning
+// the job ID. The capture and upload run in the background.
+func (s *Service) uploadFile(c *gin.Context) (uint, error) {
 	ur := &uploadRequest{}
 	if err := c.ShouldBindJSON(ur); err != nil {
-		return fmt.Errorf("failed to bind JSON: %w", err)
+		return 0, fmt.Errorf("failed to bind JSON: %w", err)
 	}
 
-	content, err := downloadContent(s.ctx, ur.ResourceURL)
+	if ur.UserAddress == "" {
+		return 0, fmt.Errorf("user_address is required")
+	}
+	if ur.FileName == "" {
+		return 0, fmt.Errorf("file_name is required")
+	}
+	if ur.ResourceURL == "" {
+		return 0, fmt.Errorf("resource_url is required")
+	}
+
+	format, err := parseCaptureFormat(ur.Format)
 	if err != nil {
-		return fmt.Errorf("failed to download content: %w", err)
+		return 0, err
 	}
 
-	fileSize := int64(len(content))
-	type rootSetInfo struct {
-		pieces     []abi.PieceInfo
-		subrootStr string
+	renditions, err := parseRenditions(ur.Renditions)
+	if err != nil {
+		return 0, err
 	}
-	rootSets := []rootSetInfo{}
-	rootSets = append(rootSets, rootSetInfo{
-		pieces:     make([]abi.PieceInfo, 0),
-		subrootStr: "",
-	})
-	rootSize := uint64(0)
-	maxRootSize, err := abi.RegisteredSealProof_StackedDrg64GiBV1_1.SectorSize()
+
+	profile, err := s.captureProfile(ur.Profile)
 	if err != nil {
-		return fmt.Errorf("failed to get sector size: %v", err)
+		return 0, err
+	}
+
+	names := make([]string, 0, len(renditions))
+	for _, r := range renditions {
+		names = append(names, string(r))
 	}
 
-	jwtToken, err := createJWTToken(s.serviceName, s.privateKey)
+	jobID, err := database.InsertJob(s.db, &database.Job{
+		UserAddress: ur.UserAddress,
+		FileName:    ur.FileName,
+		ResourceURL: ur.ResourceURL,
+		Format:      string(format),
+		Renditions:  strings.Join(names, " "),
+		Profile:     profile.Name,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to create JWT token: %v", err)
+		return 0, fmt.Errorf("failed to queue upload job: %v", err)
 	}
 
-	client := &http.Client{}
-	chunkCids := make([]string, 0)
-	for idx := int64(0); idx < fileSize; idx += chunkSize {
+	s.notifyJobs()
+	return jobID, nil
+}
 
-		end := min(idx+chunkSize, fileSize)
-		// Prepare the piece
-		n := end - idx
-		chunkReader := bytes.NewReader(content[idx:end])
-		commP, paddedPieceSize, commpDigest, err := preparePiece(chunkReader)
-		if err != nil {
-			return fmt.Errorf("failed to prepare piece: %v", err)
-		}
+// contentPiece is a chunk of content together with its piece.
+type contentPiece struct {
+	offset int64
+	size   int64
+	info   abi.PieceInfo
+	digest []byte
+}
 
-		// Prepare the request data
+// chunkBounds splits content of the given size into chunks and returns the
+// offset and size of each. commP is not defined for short inputs, so a short
+// tail is appended to the last full chunk instead of becoming its own chunk.
+func chunkBounds(size int64) ([][2]int64, error) {
+	if size == 0 {
+		return nil, fmt.Errorf("content is empty")
+	}
+	if uint64(size) < commp.MinPiecePayload {
+		return nil, fmt.Errorf("content of %d bytes is shorter than the minimum of %d bytes", size, commp.MinPiecePayload)
+	}
 
-		checkData := map[string]any{
-			"name": "sha2-256-trunc254-padded",
-			"hash": hex.EncodeToString(commpDigest),
-			"size": n,
+	var bounds [][2]int64
+	for offset := int64(0); offset < size; {
+		n := min(chunkSize, size-offset)
+		if rest := size - offset - n; rest > 0 && uint64(rest) < commp.MinPiecePayload {
+			n += rest
 		}
+		bounds = append(bounds, [2]int64{offset, n})
+		offset += n
+	}
 
-		reqData := map[string]any{
-			"check": checkData,
-		}
+	return bounds, nil
+}
 
-		reqBody, err := json.Marshal(reqData)
-		if err != nil {
-			return fmt.Errorf("failed to marshal request data: %v", err)
-		}
+// paddedPieceSize returns the padded size of the piece of size bytes of
+// content, the power of two holding them once Fr32 padded.
+func paddedPieceSize(size int64) uint64 {
+	padded := uint64(max((size+126)/127*128, 128))
+	return 1 << bits.Len64(padded-1)
+}
 
-		// Upload the piece
-		err = uploadOnePiece(client, s.serviceURL, reqBody, jwtToken, chunkReader, int64(n))
+// checkRootSize returns errRootTooLarge if contents of the given sizes do
+// not fit in a root together. It is known before the pieces are hashed.
+func checkRootSize(sizes ...int64) error {
+	var total uint64
+	for _, size := range sizes {
+		bounds, err := chunkBounds(size)
 		if err != nil {
-			return fmt.Errorf("failed to upload piece: %v", err)
+			return err
 		}
-
-		slog.Info("Piece uploaded successfully", "cid", commP.String())
-
-		chunkCids = append(chunkCids, commP.String())
-
-		if rootSize+paddedPieceSize > uint64(maxRootSize) {
-			rootSets = append(rootSets, rootSetInfo{
-				pieces:     make([]abi.PieceInfo, 0),
-				subrootStr: "",
-			})
-			rootSize = 0
+		for _, b := range bounds {
+			total += paddedPieceSize(b[1])
 		}
-		rootSize += paddedPieceSize
-		rootSets[len(rootSets)-1].pieces = append(rootSets[len(rootSets)-1].pieces, abi.PieceInfo{Size: abi.PaddedPieceSize(paddedPieceSize), PieceCID: commP})
-		rootSets[len(rootSets)-1].subrootStr = fmt.Sprintf("%s+%s", rootSets[len(rootSets)-1].subrootStr, commP)
+	}
+	if total > maxRootSize {
+		return fmt.Errorf("%w: %d bytes of padded pieces, at most %d", errRootTooLarge, total, maxRootSize)
+	}
+	return nil
+}
 
+// hashPieces computes the pieces of content chunk by chunk. The pieces in
+// done were computed by a previous attempt and are kept; hashing resumes with
+// the next chunk. hashed, if not nil, is called as soon as a piece is computed.
+func hashPieces(src contentSource, done []contentPiece, hashed func(piece contentPiece) error) ([]contentPiece, error) {
+	bounds, err := chunkBounds(src.Size())
+	if err != nil {
+		return nil, err
+	}
+	if len(done) > len(bounds) {
+		return nil, fmt.Errorf("%d pieces were recorded for %d chunks", len(done), len(bounds))
 	}
 
-	for _, rootSet := range rootSets {
-		pieceSize := uint64(0)
-		for _, piece := range rootSet.pieces {
-			pieceSize += uint64(piece.Size)
+	pieces := make([]contentPiece, 0, len(bounds))
+	for i, b := range bounds {
+		if i < len(done) {
+			if done[i].offset != b[0] || done[i].size != b[1] {
+				return nil, fmt.Errorf("recorded piece %d does not match the content", i)
+			}
+			pieces = append(pieces, done[i])
+			continue
 		}
 
-		root, err := nonffi.GenerateUnsealedCID(abi.RegisteredSealProof_StackedDrg64GiBV1_1, rootSet.pieces)
+		commP, paddedPieceSize, commpDigest, err := preparePiece(io.NewSectionReader(src, b[0], b[1]))
 		if err != nil {
-			return fmt.Errorf("failed to generate unsealed CID: %v", err)
+			return nil, fmt.Errorf("failed to prepare piece: %v", err)
 		}
 
-		if err := database.InsertData(s.db, ur.UserAddress, ur.FileName, pieceSize, s.proofSetID, root.String(), chunkCids); err != nil {
-			return fmt.Errorf("failed to insert data into database: %v", err)
+		piece := contentPiece{
+			offset: b[0],
+			size:   b[1],
+			info:   abi.PieceInfo{Size: abi.PaddedPieceSize(paddedPieceSize), PieceCID: commP},
+			digest: commpDigest,
 		}
+		if hashed != nil {
+			if err := hashed(piece); err != nil {
+				return nil, err
+			}
+		}
+		pieces = append(pieces, piece)
 	}
 
-	return nil
+	return pieces, nil
 }
 
-func uploadOnePiece(client *http.Client, serviceURL string, reqBody []byte, jwtToken string, r io.ReadSeeker, pieceSize int64) error {
-	req, err := http.NewRequest("POST", serviceURL+"/pdp/piece", bytes.NewReader(reqBody))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
-	}
-	req.Header.Set("Authorization", "Bearer "+jwtToken)
-	req.Header.Set("Content-Type", "application/json")
+// uploadPieces uploads the pieces of src concurrently, retrying transient
+// failures of each piece. Pieces for which skip returns true are already held
+// by the PDP service and are not uploaded again; uploaded is called once the
+// service holds a piece. The first permanent failure cancels the others.
+func (s *Service) uploadPieces(ctx context.Context, src io.ReaderAt, pieces []contentPiece, skip func(i int) bool, uploaded func(i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send request: %v", err)
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
 	}
-	defer resp.Body.Close()
 
-	switch resp.StatusCode {
-	case http.StatusOK:
-		// Piece already exists, get the pieceCID from the response
-		var respData map[string]string
-		err = json.NewDecoder(resp.Body).Decode(&respData)
-		if err != nil {
-			return fmt.Errorf("failed to parse response: %v", err)
-		}
-		pieceCID := respData["pieceCID"]
-		fmt.Printf("Piece already exists with CID: %s\n", pieceCID)
-
-		return nil
-	case http.StatusCreated:
-		// Get the upload URL from the Location header
-		uploadURL := resp.Header.Get("Location")
-		if uploadURL == "" {
-			return fmt.Errorf("server did not provide upload URL in Location header")
+	semaphore := make(chan struct{}, uploadConcurrency)
+	for i, piece := range pieces {
+		if skip != nil && skip(i) {
+			slog.Info("Skipping piece already uploaded", "cid", piece.info.PieceCID.String())
+			continue
 		}
 
-		// Upload the piece data via PUT
-		if _, err := r.Seek(0, io.SeekStart); err != nil {
-			return fmt.Errorf("failed to seek file: %v", err)
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
 		}
-		uploadReq, err := http.NewRequest("PUT", serviceURL+uploadURL, r)
-		if err != nil {
-			return fmt.Errorf("failed to create upload request: %v", err)
+		if ctx.Err() != nil {
+			break
 		}
-		// Set the Content-Length header
-		uploadReq.ContentLength = pieceSize
-		// Set the Content-Type header
-		uploadReq.Header.Set("Content-Type", "application/octet-stream")
 
-		uploadResp, err := client.Do(uploadReq)
-		if err != nil {
-			return fmt.Errorf("failed to upload piece data: %v", err)
-		}
-		defer uploadResp.Body.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
 
-		if uploadResp.StatusCode != http.StatusNoContent {
-			body, _ := io.ReadAll(uploadResp.Body)
-			return fmt.Errorf("upload failed with status code %d: %s", uploadResp.StatusCode, string(body))
-		}
+			err := retry(ctx, "upload piece "+piece.info.PieceCID.String(), func() error {
+				return s.uploadPiece(ctx, src, piece)
+			})
+			if err == nil && uploaded != nil {
+				err = uploaded(i)
+			}
+			if err != nil {
+				fail(err)
+			}
+		}()
+	}
+	wg.Wait()
 
-		return nil
-	default:
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("server returned status code %d: %s", resp.StatusCode, string(body))
+	if firstErr != nil {
+		return firstErr
 	}
+	return ctx.Err()
 }
 
-func preparePiece(r io.ReadSeeker) (cid.Cid, uint64, []byte, error) {
-	// Create commp calculator
-	cp := &commp.Calc{}
+// uploadPiece uploads the chunk of src backing piece to the primary
+// provider. The other replicas are copied from it by the scheduler.
+func (s *Service) uploadPiece(ctx context.Context, src io.ReaderAt, piece contentPiece) error {
+	req := &pdp.UploadPieceRequest{
+		Check: pdp.PieceCheck{
+			Name: "sha2-256-trunc254-padded",
+			Hash: hex.EncodeToString(piece.digest),
+			Size: piece.size,
+		},
+	}
 
-	// Copy data into commp calculator
-	_, err := io.Copy(cp, r)
+	res, err := s.primary().Client.UploadPiece(ctx, req, io.NewSectionReader(src, piece.offset, piece.size))
 	if err != nil {
-		return cid.Undef, 0, nil, fmt.Errorf("failed to read input file: %v", err)
+		return fmt.Errorf("failed to upload piece %s: %w", piece.info.PieceCID, err)
 	}
 
-	// Finalize digest
-	digest, paddedPieceSize, err := cp.Digest()
+	if res.Existed {
+		slog.Info("Piece already exists", "cid", piece.info.PieceCID.String())
+	} else {
+		slog.Info("Piece uploaded successfully", "cid", piece.info.PieceCID.String())
+	}
+	return nil
+}
+
+// saveFile computes the root of the uploaded pieces and records the file, its
+// renditions and its replica on the primary provider, returning the file ID.
+// The renditions are stored as their own pieces under the same root as the
+// primary content, after it and in the given order.
+func (s *Service) saveFile(tx *gorm.DB, fileInfo *database.FileInfo, content []contentPiece, renditions []renditionFormat, renditionPieces map[renditionFormat][]contentPiece) (uint, error) {
+	contentPieces := pieceInfos(content)
+	rootPieces := append([]abi.PieceInfo{}, contentPieces...)
+	for _, r := range renditions {
+		rootPieces = append(rootPieces, pieceInfos(renditionPieces[r])...)
+	}
+
+	if piecesSize(rootPieces) > maxRootSize {
+		return 0, fmt.Errorf("%w: %d bytes of padded pieces, at most %d", errRootTooLarge, piecesSize(rootPieces), maxRootSize)
+	}
+
+	root, err := nonffi.GenerateUnsealedCID(abi.RegisteredSealProof_StackedDrg64GiBV1_1, rootPieces)
 	if err != nil {
-		return cid.Undef, 0, nil, fmt.Errorf("failed to compute digest: %v", err)
+		return 0, fmt.Errorf("failed to generate unsealed CID: %v", err)
 	}
 
-	// Convert digest to CID
-	pieceCIDComputed, err := commcid.DataCommitmentV1ToCID(digest)
+	fileInfo.Size = piecesSize(contentPieces)
+	fileInfo.ContentSize = contentSize(content)
+	fileInfo.Root = root.String()
+
+	fileID, err := database.InsertData(tx, fileInfo, pieceCIDs(contentPieces))
 	if err != nil {
-		return cid.Undef, 0, nil, fmt.Errorf("failed to compute piece CID: %v", err)
+		return 0, fmt.Errorf("failed to insert data into database: %v", err)
 	}
 
-	// now compute sha256
-	if _, err := r.Seek(0, io.SeekStart); err != nil {
-		return cid.Undef, 0, nil, fmt.Errorf("failed to seek file: %v", err)
+	for _, r := range renditions {
+		pieces := pieceInfos(renditionPieces[r])
+		if err := database.InsertRendition(tx, fileID, string(r), piecesSize(pieces), contentSize(renditionPieces[r]), pieceCIDs(pieces)); err != nil {
+			return 0, fmt.Errorf("failed to insert %s rendition into database: %v", r, err)
+		}
+	}
+
+	if err := database.InsertReplica(tx, fileID, s.primary().Name, database.ReplicaAddingRoots); err != nil {
+		return 0, fmt.Errorf("failed to insert replica into database: %v", err)
+	}
+
+	return fileID, nil
+}
+
+// encodeHeaders returns the JSON encoding of headers, or an empty string
+// when there are none.
+func encodeHeaders(headers http.Header) (string, error) {
+	if len(headers) == 0 {
+		return "", nil
 	}
 
-	h := sha256.New()
-	_, err = io.Copy(h, r)
+	data, err := json.Marshal(headers)
 	if err != nil {
-		return cid.Undef, 0, nil, fmt.Errorf("failed to read input file: %v", err)
+		return "", fmt.Errorf("failed to encode headers: %v", err)
 	}
+	return string(data), nil
+}
 
-	return pieceCIDComputed, paddedPieceSize, digest, nil
+func pieceInfos(pieces []contentPiece) []abi.PieceInfo {
+	infos := make([]abi.PieceInfo, 0, len(pieces))
+	for _, piece := range pieces {
+		infos = append(infos, piece.info)
+	}
+	return infos
 }
 
-func downloadContent(ctx context.Context, resourceURL string) ([]byte, error) {
-	slog.Info("Downloading content from resource URL", "url", resourceURL)
-	// 1. Create Chromedp context with timeout
-	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
+// contentSize returns the size of the content backing pieces.
+func contentSize(pieces []contentPiece) int64 {
+	size := int64(0)
+	for _, piece := range pieces {
+		size += piece.size
+	}
+	return size
+}
 
-	allocCtx, allocCancel := chromedp.NewExecAllocator(ctx, chromedp.DefaultExecAllocatorOptions[:]...)
-	defer allocCancel()
+func piecesSize(pieces []abi.PieceInfo) uint64 {
+	size := uint64(0)
+	for _, piece := range pieces {
+		size += uint64(piece.Size)
+	}
+	return size
+}
 
-	chromeCtx, chromeCancel := chromedp.NewContext(allocCtx)
-	defer chromeCancel()
+func pieceCIDs(pieces []abi.PieceInfo) []string {
+	cids := make([]string, 0, len(pieces))
+	for _, piece := range pieces {
+		cids = append(cids, piece.PieceCID.String())
+	}
+	return cids
+}
 
-	// 2. Use Chromedp to fetch rendered HTML
-	var htmlContent string
-	err := chromedp.Run(chromeCtx,
-		chromedp.Navigate(resourceURL),
-		chromedp.WaitVisible("body", chromedp.ByQuery), // Wait for page load
-		chromedp.OuterHTML("html", &htmlContent),       // Get full HTML
-	)
+func preparePiece(r io.Reader) (cid.Cid, uint64, []byte, error) {
+	// Create commp calculator
+	cp := &commp.Calc{}
+
+	// Copy data into commp calculator
+	_, err := io.Copy(cp, r)
 	if err != nil {
-		return nil, fmt.Errorf("failed to render page with chromedp: %v", err)
+		return cid.Undef, 0, nil, fmt.Errorf("failed to read input file: %v", err)
 	}
 
-	// 4. Use goquery to parse HTML (since Colly doesn't have ParseHTML)
-	doc, err := goquery.NewDocumentFromReader(strings.NewReader(htmlContent))
+	// Finalize digest
+	digest, paddedPieceSize, err := cp.Digest()
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse HTML with goquery: %v", err)
+		return cid.Undef, 0, nil, fmt.Errorf("failed to compute digest: %v", err)
 	}
 
-	// 5. Save HTML to file
-	html, err := doc.Html()
+	// Convert digest to CID
+	pieceCIDComputed, err := commcid.DataCommitmentV1ToCID(digest)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get HTML content: %v", err)
+		return cid.Undef, 0, nil, fmt.Errorf("failed to compute piece CID: %v", err)
 	}
 
-	slog.Info("Content downloaded successfully", "length", len(html))
-	return []byte(html), nil
+	return pieceCIDComputed, paddedPieceSize, digest, nil
 }
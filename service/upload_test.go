@@ -0,0 +1,59 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipfs-force-community/ark-eternal/pdp/pdptest"
+)
+
+func TestPaddedPieceSize(t *testing.T) {
+	for _, size := range []int64{65, 127, 128, 254, 255, 1000, 1 << 20, chunkSize - 1, chunkSize, chunkSize + 64} {
+		_, want, _, err := preparePiece(bytes.NewReader(make([]byte, size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := paddedPieceSize(size); got != want {
+			t.Errorf("paddedPieceSize(%d) = %d, want %d", size, got, want)
+		}
+	}
+}
+
+func TestCheckRootSize(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		sizes    []int64
+		tooLarge bool
+	}{
+		{name: "small", sizes: []int64{1 << 20}},
+		{name: "largest content", sizes: []int64{maxRootContentSize}},
+		{name: "largest content with a short tail", sizes: []int64{maxRootContentSize + 64}},
+		{name: "content past a root", sizes: []int64{maxRootContentSize + chunkSize}, tooLarge: true},
+		{name: "renditions past a root", sizes: []int64{maxRootContentSize - chunkSize, chunkSize, 1 << 20}, tooLarge: true},
+	} {
+		err := checkRootSize(tt.sizes...)
+		if errors.Is(err, errRootTooLarge) != tt.tooLarge || (err != nil && !tt.tooLarge) {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestUploadRawFileTooLarge(t *testing.T) {
+	env := newTestEnv(t, pdptest.Options{})
+
+	// Content that cannot fit in a root is rejected whatever the maximum
+	// upload size, before any of it is read.
+	for _, maxUploadSize := range []int64{0, 2 * maxRootContentSize} {
+		env.svc.maxUploadSize = maxUploadSize
+		req := httptest.NewRequest(http.MethodPost, "/upload/file?user_address=user&file_name=huge", bytes.NewReader(nil))
+		req.ContentLength = maxRootContentSize + chunkSize
+		w := httptest.NewRecorder()
+		env.svc.srv.Handler.ServeHTTP(w, req)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("max upload size %d: %d %s", maxUploadSize, w.Code, w.Body)
+		}
+	}
+}
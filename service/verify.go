@@ -0,0 +1,164 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ipfs/go-cid"
+
+	"github.com/ipfs-force-community/ark-eternal/database"
+)
+
+// ErrPieceMismatch is reported when the content served for a piece does not
+// hash to its CID.
+var ErrPieceMismatch = errors.New("piece content does not match its CID")
+
+// PieceMismatchError reports a piece whose content served by a provider
+// hashes to another CID.
+type PieceMismatchError struct {
+	Provider string
+	PieceCID string
+	// Computed is the CID of the served content, empty if it could not be
+	// hashed at all.
+	Computed string
+}
+
+func (e *PieceMismatchError) Error() string {
+	if e.Computed == "" {
+		return fmt.Sprintf("piece %s served by %s cannot be hashed", e.PieceCID, e.Provider)
+	}
+	return fmt.Sprintf("piece %s served by %s hashes to %s", e.PieceCID, e.Provider, e.Computed)
+}
+
+// Is reports the error as ErrPieceMismatch.
+func (e *PieceMismatchError) Is(target error) bool {
+	return target == ErrPieceMismatch
+}
+
+// verifyPiece checks that the content served by a provider for a piece
+// hashes to its CID.
+func verifyPiece(p *Provider, pieceCID string, data []byte) error {
+	expected, err := cid.Decode(pieceCID)
+	if err != nil {
+		return fmt.Errorf("invalid piece CID %s: %v", pieceCID, err)
+	}
+
+	computed, _, _, err := preparePiece(bytes.NewReader(data))
+	if err != nil {
+		return &PieceMismatchError{Provider: p.Name, PieceCID: pieceCID}
+	}
+	if !computed.Equals(expected) {
+		return &PieceMismatchError{Provider: p.Name, PieceCID: pieceCID, Computed: computed.String()}
+	}
+
+	return nil
+}
+
+// downloadErrorStatus returns the status code a failed download is answered
+// with. Corrupted pieces and unsatisfiable ranges are told apart from other
+// failures.
+func downloadErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrPieceMismatch):
+		return http.StatusBadGateway
+	case errors.Is(err, errRangeNotSatisfiable):
+		return http.StatusRequestedRangeNotSatisfiable
+	}
+	return http.StatusInternalServerError
+}
+
+// Piece verification statuses.
+const (
+	pieceIntact      = "ok"
+	pieceMismatch    = "mismatch"
+	pieceUnavailable = "unavailable"
+)
+
+// VerificationReport is the result of checking the pieces of a file served
+// by its providers against their CIDs.
+type VerificationReport struct {
+	Root      string   `json:"root"`
+	FileName  string   `json:"file_name"`
+	Format    string   `json:"format"`
+	Providers []string `json:"providers"`
+	// Verified reports whether every provider served every piece intact.
+	Verified bool                `json:"verified"`
+	Pieces   []PieceVerification `json:"pieces"`
+}
+
+// PieceVerification is the check of a piece served by a provider.
+type PieceVerification struct {
+	CID      string `json:"cid"`
+	Provider string `json:"provider"`
+	Status   string `json:"status"`
+	Size     int    `json:"size,omitempty"`
+	Computed string `json:"computed_cid,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// verifyFile downloads the given pieces of a file from each of its providers
+// and reports whether they hash to their CIDs.
+func (s *Service) verifyFile(ctx context.Context, fileInfo *database.FileInfo, format string, cids []string) (*VerificationReport, error) {
+	providers := s.replicaProviders(fileInfo.ID)
+	if len(providers) == 0 {
+		providers = []*Provider{s.primary()}
+	}
+
+	report := &VerificationReport{
+		Root:     fileInfo.Root,
+		FileName: fileInfo.FileName,
+		Format:   format,
+		Verified: true,
+		Pieces:   make([]PieceVerification, 0, len(cids)*len(providers)),
+	}
+	for _, p := range providers {
+		report.Providers = append(report.Providers, p.Name)
+	}
+
+	for _, pieceCID := range cids {
+		for _, p := range providers {
+			check := PieceVerification{CID: pieceCID, Provider: p.Name, Status: pieceIntact}
+			data, err := downloadPieceFrom(ctx, p, pieceCID)
+			if err == nil {
+				check.Size = len(data)
+				err = verifyPiece(p, pieceCID, data)
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			var mismatch *PieceMismatchError
+			switch {
+			case errors.As(err, &mismatch):
+				check.Status = pieceMismatch
+				check.Computed = mismatch.Computed
+				check.Error = err.Error()
+			case err != nil:
+				check.Status = pieceUnavailable
+				check.Error = err.Error()
+			}
+			if check.Status != pieceIntact {
+				report.Verified = false
+			}
+			report.Pieces = append(report.Pieces, check)
+		}
+	}
+
+	return report, nil
+}
+
+// serveVerification answers a download in verify mode with the verification
+// report of the requested pieces instead of their content.
+func (s *Service) serveVerification(c *gin.Context, fileInfo *database.FileInfo, format string, cids []string) error {
+	report, err := s.verifyFile(c.Request.Context(), fileInfo, format, cids)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, report)
+	return nil
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ipfs-force-community/ark-eternal/pdp/pdptest"
+)
+
+// verification asks for the verification report of a file.
+func (e *testEnv) verification(path string) *VerificationReport {
+	e.t.Helper()
+
+	resp, data := e.do(http.MethodGet, path, nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		e.t.Fatalf("verify: %d %s", resp.StatusCode, data)
+	}
+	var report VerificationReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		e.t.Fatal(err)
+	}
+	return &report
+}
+
+func TestVerifyFile(t *testing.T) {
+	env := newTestEnv(t, pdptest.Options{})
+	env.store("archive", randomContent(chunkSize+1000))
+
+	report := env.verification("/download?user_address=user&file_name=archive&verify=true")
+	if !report.Verified || len(report.Pieces) != 2 {
+		t.Fatalf("report: %+v", report)
+	}
+	for _, piece := range report.Pieces {
+		if piece.Status != pieceIntact {
+			t.Fatalf("piece %s: %s %s", piece.CID, piece.Status, piece.Error)
+		}
+	}
+}
+
+func TestDownloadCorruptPiece(t *testing.T) {
+	env := newTestEnv(t, pdptest.Options{})
+	fileInfo := env.store("corrupt", randomContent(1<<20))
+	pieceCID := strings.Fields(fileInfo.CIDs)[0]
+	if err := env.pdp.CorruptPiece(pieceCID); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, data := env.do(http.MethodGet, "/"+fileInfo.Root, nil, nil)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("download: %d %s", resp.StatusCode, data)
+	}
+
+	report := env.verification("/" + fileInfo.Root + "?verify=true")
+	if report.Verified || len(report.Pieces) != 1 || report.Pieces[0].Status != pieceMismatch {
+		t.Fatalf("report: %+v", report)
+	}
+}
@@ -0,0 +1,279 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	waczVersion     = "1.1.1"
+	waczContentType = "application/wacz"
+	waczWARCName    = "data.warc"
+	waczTimestamp   = "20060102150405"
+)
+
+// waczResource describes a file of the package in datapackage.json.
+type waczResource struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Hash  string `json:"hash"`
+	Bytes int    `json:"bytes"`
+}
+
+// waczDataPackage is the datapackage.json manifest of a WACZ file.
+type waczDataPackage struct {
+	Profile     string         `json:"profile"`
+	WACZVersion string         `json:"wacz_version"`
+	Title       string         `json:"title,omitempty"`
+	MainPageURL string         `json:"mainPageUrl,omitempty"`
+	MainPageTS  string         `json:"mainPageDate,omitempty"`
+	Created     string         `json:"created"`
+	Software    string         `json:"software"`
+	Resources   []waczResource `json:"resources"`
+}
+
+// waczSignedData is the signature over the datapackage.json digest.
+type waczSignedData struct {
+	Hash      string `json:"hash"`
+	Created   string `json:"created"`
+	Software  string `json:"software"`
+	Signature string `json:"signature"`
+	PublicKey string `json:"publicKey"`
+}
+
+// waczDigest is the datapackage-digest.json file of a WACZ file.
+type waczDigest struct {
+	Path       string          `json:"path"`
+	Hash       string          `json:"hash"`
+	SignedData *waczSignedData `json:"signedData,omitempty"`
+}
+
+// captureWACZ records the page as WARC and packages it as a WACZ collection
+// signed with the service key.
+func captureWACZ(cs *captureSession, key *ecdsa.PrivateKey) ([]byte, error) {
+	// Inside a WACZ the WARC is stored under a fixed name that the CDXJ
+	// index refers to, whatever the name of the stored file.
+	wc, err := recordWARC(cs, waczWARCName)
+	if err != nil {
+		return nil, err
+	}
+
+	return packageWACZ(wc, key)
+}
+
+// packageWACZ builds a WACZ file containing the WARC, its CDXJ index, the
+// page list and a datapackage manifest whose digest is signed with key.
+func packageWACZ(wc *warcCapture, key *ecdsa.PrivateKey) ([]byte, error) {
+	created := time.Now().UTC().Format(time.RFC3339)
+
+	pageID := strings.Trim(newWARCRecordID(), "<>")
+	pages, err := encodeJSONLines(
+		map[string]any{"format": "json-pages-1.0", "id": "pages", "title": "All Pages"},
+		map[string]any{"id": strings.TrimPrefix(pageID, "urn:uuid:"), "url": wc.pageURL, "ts": wc.startedAt.Format(time.RFC3339), "title": wc.title},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode pages: %v", err)
+	}
+
+	files := []struct {
+		name string
+		path string
+		data []byte
+	}{
+		{waczWARCName, "archive/" + waczWARCName, wc.warc},
+		{"index.cdxj", "indexes/index.cdxj", encodeCDXJ(wc.index)},
+		{"pages.jsonl", "pages/pages.jsonl", pages},
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	dp := waczDataPackage{
+		Profile:     "data-package",
+		WACZVersion: waczVersion,
+		Title:       wc.title,
+		MainPageURL: wc.pageURL,
+		MainPageTS:  wc.startedAt.Format(time.RFC3339),
+		Created:     created,
+		Software:    warcSoftware,
+	}
+	for _, f := range files {
+		// Entries are stored uncompressed so replay tools can seek into the
+		// WARC through the CDXJ offsets without inflating the archive.
+		if err := writeZipEntry(zw, f.path, f.data); err != nil {
+			return nil, err
+		}
+		dp.Resources = append(dp.Resources, waczResource{
+			Name:  f.name,
+			Path:  f.path,
+			Hash:  sha256Hash(f.data),
+			Bytes: len(f.data),
+		})
+	}
+
+	dpBytes, err := json.MarshalIndent(dp, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal datapackage: %v", err)
+	}
+	if err := writeZipEntry(zw, "datapackage.json", dpBytes); err != nil {
+		return nil, err
+	}
+
+	digest := waczDigest{
+		Path: "datapackage.json",
+		Hash: sha256Hash(dpBytes),
+	}
+	if key != nil {
+		signedData, err := signWACZDigest(digest.Hash, created, key)
+		if err != nil {
+			return nil, err
+		}
+		digest.SignedData = signedData
+	}
+
+	digestBytes, err := json.MarshalIndent(digest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal datapackage digest: %v", err)
+	}
+	if err := writeZipEntry(zw, "datapackage-digest.json", digestBytes); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finalize WACZ: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// signWACZDigest signs the datapackage digest following the anonymous
+// signing profile of the WACZ authentication spec: an ECDSA signature over
+// the hash string in IEEE P1363 form, plus the SPKI public key.
+func signWACZDigest(hash, created string, key *ecdsa.PrivateKey) (*waczSignedData, error) {
+	sum := sha256.Sum256([]byte(hash))
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign datapackage digest: %v", err)
+	}
+
+	size := (key.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal public key: %v", err)
+	}
+
+	return &waczSignedData{
+		Hash:      hash,
+		Created:   created,
+		Software:  warcSoftware,
+		Signature: base64.StdEncoding.EncodeToString(signature),
+		PublicKey: base64.StdEncoding.EncodeToString(publicKey),
+	}, nil
+}
+
+func writeZipEntry(zw *zip.Writer, name string, data []byte) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create %s in WACZ: %v", name, err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s in WACZ: %v", name, err)
+	}
+	return nil
+}
+
+// encodeCDXJ renders index entries as a sorted CDXJ index of the WARC.
+func encodeCDXJ(entries []warcIndexEntry) []byte {
+	lines := make([]string, 0, len(entries))
+	for _, e := range entries {
+		fields := map[string]any{
+			"url":      e.url,
+			"mime":     e.mime,
+			"digest":   e.digest,
+			"offset":   e.offset,
+			"length":   e.length,
+			"filename": waczWARCName,
+		}
+		if e.status != 0 {
+			fields["status"] = e.status
+		}
+
+		data, err := json.Marshal(fields)
+		if err != nil {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %s", surt(e.url), e.date.UTC().Format(waczTimestamp), data))
+	}
+	sort.Strings(lines)
+
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// surt returns the Sort-friendly URI Reordering Transform of rawURL, e.g.
+// "com,example)/path?q" for "https://www.example.com/path?q".
+func surt(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	parts := strings.Split(host, ".")
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+
+	key := strings.Join(parts, ",")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		key += ":" + port
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	key += ")" + strings.ToLower(path)
+	if u.RawQuery != "" {
+		key += "?" + strings.ToLower(u.RawQuery)
+	}
+	return key
+}
+
+func encodeJSONLines(values ...any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, v := range values {
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func sha256Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
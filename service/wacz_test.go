@@ -0,0 +1,89 @@
+package service
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSURT(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://www.example.com/path?q", "com,example)/path?q"},
+		{"http://example.com", "com,example)/"},
+		{"https://Sub.Example.COM/A/B?X=Y", "com,example,sub)/a/b?x=y"},
+		{"http://example.com:80/", "com,example)/"},
+		{"https://example.com:443/", "com,example)/"},
+		{"http://example.com:8080/x", "com,example:8080)/x"},
+		{"https://example.com/a%20b", "com,example)/a%20b"},
+		{"urn:dom:https://example.com/", "urn:dom:https://example.com/"},
+		{"not a url", "not a url"},
+	}
+	for _, tt := range tests {
+		if got := surt(tt.url); got != tt.want {
+			t.Errorf("surt(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeCDXJ(t *testing.T) {
+	if got := encodeCDXJ(nil); got != nil {
+		t.Errorf("encodeCDXJ(nil) = %q, want nil", got)
+	}
+
+	date := time.Date(2024, 5, 1, 12, 30, 45, 0, time.FixedZone("CEST", 2*60*60))
+	entries := []warcIndexEntry{
+		{url: "https://www.example.com/style.css", date: date, mime: "text/css", status: 200, digest: "sha256:b", offset: 900, length: 300},
+		{url: "urn:dom:https://example.com/", date: date, mime: "text/html", digest: "sha256:c", offset: 1200, length: 400},
+		{url: "https://example.com/", date: date, mime: "text/html", status: 200, digest: "sha256:a", offset: 100, length: 800},
+	}
+
+	out := string(encodeCDXJ(entries))
+	if !strings.HasSuffix(out, "\n") {
+		t.Fatalf("index does not end with a newline: %q", out)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+
+	wantKeys := []string{"com,example)/", "com,example)/style.css", "urn:dom:https://example.com/"}
+	wantURLs := []string{"https://example.com/", "https://www.example.com/style.css", "urn:dom:https://example.com/"}
+	if len(lines) != len(wantKeys) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(wantKeys), out)
+	}
+	for i, line := range lines {
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) != 3 {
+			t.Fatalf("line %d: malformed CDXJ line %q", i, line)
+		}
+		if parts[0] != wantKeys[i] {
+			t.Errorf("line %d: got key %q, want %q", i, parts[0], wantKeys[i])
+		}
+		// Timestamps are in UTC.
+		if parts[1] != "20240501103045" {
+			t.Errorf("line %d: got timestamp %q, want %q", i, parts[1], "20240501103045")
+		}
+
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(parts[2]), &fields); err != nil {
+			t.Fatalf("line %d: invalid JSON block %q: %v", i, parts[2], err)
+		}
+		if fields["url"] != wantURLs[i] {
+			t.Errorf("line %d: got url %v, want %q", i, fields["url"], wantURLs[i])
+		}
+		if fields["filename"] != waczWARCName {
+			t.Errorf("line %d: got filename %v, want %q", i, fields["filename"], waczWARCName)
+		}
+		_, hasStatus := fields["status"]
+		if wantStatus := !strings.HasPrefix(wantURLs[i], "urn:"); hasStatus != wantStatus {
+			t.Errorf("line %d: status present = %v, want %v", i, hasStatus, wantStatus)
+		}
+	}
+
+	var first map[string]any
+	_ = json.Unmarshal([]byte(strings.SplitN(lines[0], " ", 3)[2]), &first)
+	if first["offset"] != float64(100) || first["length"] != float64(800) || first["status"] != float64(200) {
+		t.Errorf("got offset %v length %v status %v, want 100 800 200", first["offset"], first["length"], first["status"])
+	}
+}
@@ -0,0 +1,344 @@
+package service
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	warcVersion     = "WARC/1.1"
+	warcSoftware    = "ark-eternal"
+	warcContentType = "application/warc"
+)
+
+// hopByHopHeaders are dropped from recorded responses because the browser
+// hands over decoded bodies, so the original framing no longer applies.
+var hopByHopHeaders = map[string]bool{
+	"content-encoding":  true,
+	"transfer-encoding": true,
+	"content-length":    true,
+}
+
+// warcField is a single named field of a WARC record header or a
+// application/warc-fields block.
+type warcField struct {
+	name  string
+	value string
+}
+
+// warcRecord is a single WARC record before serialisation.
+type warcRecord struct {
+	recordType   string
+	recordID     string
+	targetURI    string
+	date         time.Time
+	contentType  string
+	concurrentTo string
+	fields       []warcField
+	block        []byte
+}
+
+// warcIndexEntry locates a replayable record inside a WARC file.
+type warcIndexEntry struct {
+	url    string
+	date   time.Time
+	mime   string
+	status int64
+	digest string
+	offset int64
+	length int64
+}
+
+// warcWriter serialises WARC/1.1 records to an underlying writer and keeps
+// an index of the response and resource records it wrote.
+type warcWriter struct {
+	w          io.Writer
+	warcinfoID string
+	offset     int64
+	index      []warcIndexEntry
+}
+
+func newWARCWriter(w io.Writer) *warcWriter {
+	return &warcWriter{w: w}
+}
+
+// writeWarcinfo writes the leading warcinfo record. Every record written
+// afterwards references it through WARC-Warcinfo-ID.
+func (ww *warcWriter) writeWarcinfo(fileName string, fields []warcField) error {
+	info := append([]warcField{
+		{"software", warcSoftware},
+		{"format", "WARC File Format 1.1"},
+		{"conformsTo", "http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/"},
+	}, fields...)
+
+	rec := &warcRecord{
+		recordType:  "warcinfo",
+		recordID:    newWARCRecordID(),
+		date:        time.Now().UTC(),
+		contentType: "application/warc-fields",
+		fields:      []warcField{{"WARC-Filename", fileName}},
+		block:       encodeWARCFields(info),
+	}
+	if _, err := ww.write(rec); err != nil {
+		return err
+	}
+
+	ww.warcinfoID = rec.recordID
+	return nil
+}
+
+// write serialises rec and returns its offset in the output.
+func (ww *warcWriter) write(rec *warcRecord) (int64, error) {
+	if rec.recordID == "" {
+		rec.recordID = newWARCRecordID()
+	}
+
+	var header bytes.Buffer
+	header.WriteString(warcVersion + "\r\n")
+	writeField := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&header, "%s: %s\r\n", name, value)
+		}
+	}
+	writeField("WARC-Type", rec.recordType)
+	writeField("WARC-Record-ID", rec.recordID)
+	writeField("WARC-Date", rec.date.UTC().Format(time.RFC3339))
+	writeField("WARC-Target-URI", rec.targetURI)
+	writeField("WARC-Concurrent-To", rec.concurrentTo)
+	if rec.recordType != "warcinfo" {
+		writeField("WARC-Warcinfo-ID", ww.warcinfoID)
+	}
+	for _, f := range rec.fields {
+		writeField(f.name, f.value)
+	}
+	writeField("WARC-Block-Digest", warcDigest(rec.block))
+	writeField("Content-Type", rec.contentType)
+	writeField("Content-Length", strconv.Itoa(len(rec.block)))
+	header.WriteString("\r\n")
+
+	offset := ww.offset
+	if _, err := ww.w.Write(header.Bytes()); err != nil {
+		return 0, fmt.Errorf("failed to write WARC header: %v", err)
+	}
+	if _, err := ww.w.Write(rec.block); err != nil {
+		return 0, fmt.Errorf("failed to write WARC block: %v", err)
+	}
+	if _, err := io.WriteString(ww.w, "\r\n\r\n"); err != nil {
+		return 0, fmt.Errorf("failed to write WARC record trailer: %v", err)
+	}
+	ww.offset += int64(header.Len() + len(rec.block) + 4)
+
+	return offset, nil
+}
+
+// writeExchange writes the request, response and metadata records for one
+// network exchange. Exchanges without a response only get the request and
+// metadata records so that failures are still documented.
+func (ww *warcWriter) writeExchange(ex *networkExchange) error {
+	responseID := newWARCRecordID()
+	requestID := newWARCRecordID()
+
+	if ex.response != nil {
+		payload := ex.body
+		rec := &warcRecord{
+			recordType:  "response",
+			recordID:    responseID,
+			targetURI:   ex.url,
+			date:        ex.startedAt,
+			contentType: "application/http;msgtype=response",
+			block:       httpResponseBlock(ex.response.Status, ex.response.StatusText, ex.response.Headers, payload),
+			fields: []warcField{
+				{"WARC-IP-Address", ex.response.RemoteIPAddress},
+				{"WARC-Payload-Digest", warcDigest(payload)},
+			},
+		}
+		offset, err := ww.write(rec)
+		if err != nil {
+			return err
+		}
+
+		ww.index = append(ww.index, warcIndexEntry{
+			url:    ex.url,
+			date:   ex.startedAt,
+			mime:   ex.response.MimeType,
+			status: ex.response.Status,
+			digest: warcDigest(payload),
+			offset: offset,
+			length: ww.offset - offset,
+		})
+	}
+
+	headers := ex.requestHeaders
+	if ex.response != nil && len(ex.response.RequestHeaders) > 0 {
+		headers = ex.response.RequestHeaders
+	}
+	req := &warcRecord{
+		recordType:  "request",
+		recordID:    requestID,
+		targetURI:   ex.url,
+		date:        ex.startedAt,
+		contentType: "application/http;msgtype=request",
+		block:       httpRequestBlock(ex.method, ex.url, headers, ex.postData),
+	}
+	if ex.response != nil {
+		req.concurrentTo = responseID
+	}
+	if _, err := ww.write(req); err != nil {
+		return err
+	}
+
+	meta := []warcField{{"resourceType", string(ex.resourceType)}}
+	if ex.response != nil {
+		meta = append(meta,
+			warcField{"mimeType", ex.response.MimeType},
+			warcField{"protocol", ex.response.Protocol},
+			warcField{"fromDiskCache", strconv.FormatBool(ex.response.FromDiskCache)},
+			warcField{"fromServiceWorker", strconv.FormatBool(ex.response.FromServiceWorker)},
+		)
+		if ex.body == nil && !ex.redirected {
+			meta = append(meta, warcField{"payloadUnavailable", "true"})
+		}
+	}
+	if ex.errorText != "" {
+		meta = append(meta, warcField{"errorText", ex.errorText})
+	}
+
+	concurrentTo := requestID
+	if ex.response != nil {
+		concurrentTo = responseID
+	}
+	_, err := ww.write(&warcRecord{
+		recordType:   "metadata",
+		targetURI:    ex.url,
+		date:         ex.startedAt,
+		contentType:  "application/warc-fields",
+		concurrentTo: concurrentTo,
+		block:        encodeWARCFields(meta),
+	})
+	return err
+}
+
+// writeResource writes a resource record holding content that has no HTTP
+// exchange of its own, such as the rendered DOM.
+func (ww *warcWriter) writeResource(targetURI, contentType string, data []byte) error {
+	rec := &warcRecord{
+		recordType:  "resource",
+		targetURI:   targetURI,
+		date:        time.Now().UTC(),
+		contentType: contentType,
+		block:       data,
+	}
+	offset, err := ww.write(rec)
+	if err != nil {
+		return err
+	}
+
+	ww.index = append(ww.index, warcIndexEntry{
+		url:    targetURI,
+		date:   rec.date,
+		mime:   contentType,
+		digest: warcDigest(data),
+		offset: offset,
+		length: ww.offset - offset,
+	})
+	return nil
+}
+
+func httpRequestBlock(method, rawURL string, headers map[string]any, body []byte) []byte {
+	var b bytes.Buffer
+
+	target := rawURL
+	host := ""
+	if req, err := http.NewRequest(method, rawURL, nil); err == nil {
+		target = req.URL.RequestURI()
+		host = req.URL.Host
+	}
+
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", method, target)
+	if _, ok := lookupHeader(headers, "host"); !ok && host != "" {
+		fmt.Fprintf(&b, "Host: %s\r\n", host)
+	}
+	writeHTTPHeaders(&b, headers, nil)
+	b.WriteString("\r\n")
+	b.Write(body)
+
+	return b.Bytes()
+}
+
+func httpResponseBlock(status int64, statusText string, headers map[string]any, body []byte) []byte {
+	var b bytes.Buffer
+
+	if statusText == "" {
+		statusText = http.StatusText(int(status))
+	}
+	fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", status, statusText)
+	writeHTTPHeaders(&b, headers, hopByHopHeaders)
+	fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	b.WriteString("\r\n")
+	b.Write(body)
+
+	return b.Bytes()
+}
+
+// writeHTTPHeaders writes headers in a stable order. CDP joins repeated
+// headers with newlines, so they are split back into separate lines.
+func writeHTTPHeaders(b *bytes.Buffer, headers map[string]any, skip map[string]bool) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		// HTTP/2 pseudo headers have no HTTP/1.1 representation.
+		if strings.HasPrefix(name, ":") || skip[strings.ToLower(name)] {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, value := range strings.Split(headerValue(headers[name]), "\n") {
+			fmt.Fprintf(b, "%s: %s\r\n", name, value)
+		}
+	}
+}
+
+func lookupHeader(headers map[string]any, name string) (string, bool) {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return headerValue(v), true
+		}
+	}
+	return "", false
+}
+
+func encodeWARCFields(fields []warcField) []byte {
+	var b bytes.Buffer
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\r\n", f.name, f.value)
+	}
+	return b.Bytes()
+}
+
+func warcDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+func newWARCRecordID() string {
+	var u [16]byte
+	_, _ = rand.Read(u[:])
+	u[6] = (u[6] & 0x0f) | 0x40 // version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/textproto"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+)
+
+// parsedWARCRecord is a WARC record read back from serialised output.
+type parsedWARCRecord struct {
+	offset int64
+	length int64
+	header textproto.MIMEHeader
+	block  []byte
+}
+
+// parseWARC splits data into records, failing the test on any framing
+// error: a missing version line, a Content-Length that does not match the
+// block or a missing record trailer.
+func parseWARC(t *testing.T, data []byte) []parsedWARCRecord {
+	t.Helper()
+
+	var records []parsedWARCRecord
+	src := bytes.NewReader(data)
+	r := bufio.NewReader(src)
+	// consumed is the number of bytes of data read from r so far.
+	consumed := func() int64 { return int64(len(data) - src.Len() - r.Buffered()) }
+	var offset int64
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			return records
+		}
+
+		tp := textproto.NewReader(r)
+		version, err := tp.ReadLine()
+		if err != nil {
+			t.Fatalf("record at %d: failed to read version line: %v", offset, err)
+		}
+		if version != warcVersion {
+			t.Fatalf("record at %d: got version line %q, want %q", offset, version, warcVersion)
+		}
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			t.Fatalf("record at %d: failed to read header: %v", offset, err)
+		}
+
+		length, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			t.Fatalf("record at %d: invalid Content-Length %q", offset, header.Get("Content-Length"))
+		}
+		block := make([]byte, length)
+		if _, err := io.ReadFull(r, block); err != nil {
+			t.Fatalf("record at %d: block shorter than Content-Length %d: %v", offset, length, err)
+		}
+		trailer := make([]byte, 4)
+		if _, err := io.ReadFull(r, trailer); err != nil || string(trailer) != "\r\n\r\n" {
+			t.Fatalf("record at %d: got trailer %q, want CRLF CRLF", offset, trailer)
+		}
+
+		end := consumed()
+		records = append(records, parsedWARCRecord{offset: offset, length: end - offset, header: header, block: block})
+		offset = end
+	}
+}
+
+func TestWriteWARC(t *testing.T) {
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	exchanges := []networkExchange{
+		{
+			method:         "GET",
+			url:            "https://example.com/",
+			resourceType:   network.ResourceTypeDocument,
+			requestHeaders: network.Headers{"Accept": "text/html"},
+			response: &network.Response{
+				Status:   200,
+				MimeType: "text/html",
+				Headers: network.Headers{
+					"Content-Type":     "text/html",
+					"Content-Encoding": "gzip",
+					"Content-Length":   "12",
+				},
+			},
+			body:      []byte("<html></html>"),
+			startedAt: started,
+		},
+		{
+			method:       "GET",
+			url:          "https://example.com/missing.css",
+			resourceType: network.ResourceTypeStylesheet,
+			errorText:    "net::ERR_NAME_NOT_RESOLVED",
+			startedAt:    started,
+		},
+	}
+
+	wc := &warcCapture{}
+	if err := wc.write("capture.warc", "https://example.com/", exchanges, "<html><body></body></html>"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	records := parseWARC(t, wc.warc)
+
+	wantTypes := []string{"warcinfo", "response", "request", "metadata", "request", "metadata", "resource"}
+	if len(records) != len(wantTypes) {
+		t.Fatalf("got %d records, want %d", len(records), len(wantTypes))
+	}
+	for i, rec := range records {
+		if got := rec.header.Get("WARC-Type"); got != wantTypes[i] {
+			t.Errorf("record %d: got WARC-Type %q, want %q", i, got, wantTypes[i])
+		}
+		if got, want := rec.header.Get("WARC-Block-Digest"), warcDigest(rec.block); got != want {
+			t.Errorf("record %d: got WARC-Block-Digest %q, want %q", i, got, want)
+		}
+		if i > 0 && rec.header.Get("WARC-Warcinfo-ID") != records[0].header.Get("WARC-Record-ID") {
+			t.Errorf("record %d does not reference the warcinfo record", i)
+		}
+	}
+
+	if got := records[0].header.Get("WARC-Filename"); got != "capture.warc" {
+		t.Errorf("got WARC-Filename %q, want %q", got, "capture.warc")
+	}
+
+	response := string(records[1].block)
+	if !bytes.HasSuffix(records[1].block, []byte("\r\n\r\n<html></html>")) {
+		t.Errorf("response block does not end with the payload: %q", response)
+	}
+	if !bytes.Contains(records[1].block, []byte("Content-Length: 13\r\n")) {
+		t.Errorf("response block does not declare the decoded payload length: %q", response)
+	}
+	if bytes.Contains(records[1].block, []byte("Content-Encoding")) {
+		t.Errorf("response block keeps the original Content-Encoding: %q", response)
+	}
+	if got := records[2].header.Get("WARC-Concurrent-To"); got != records[1].header.Get("WARC-Record-ID") {
+		t.Errorf("request is concurrent to %q, want the response", got)
+	}
+
+	// The index must point at the response and resource records exactly, so
+	// replay can seek into the WARC through the CDXJ.
+	if len(wc.index) != 2 {
+		t.Fatalf("got %d index entries, want 2", len(wc.index))
+	}
+	for i, want := range []parsedWARCRecord{records[1], records[6]} {
+		e := wc.index[i]
+		if e.offset != want.offset || e.length != want.length {
+			t.Errorf("index entry %d: got offset %d length %d, want %d %d", i, e.offset, e.length, want.offset, want.length)
+		}
+	}
+	if int(records[6].offset+records[6].length) != len(wc.warc) {
+		t.Errorf("records cover %d bytes, want %d", records[6].offset+records[6].length, len(wc.warc))
+	}
+}